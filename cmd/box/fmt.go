@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"box/internal/box"
+)
+
+// formatFiles runs 'box fmt': it prints each file formatted, rewrites it
+// with -w or prints a diff with -d. Without files it formats stdin to
+// stdout. It returns 1 when a file cannot be read, parsed or written.
+func formatFiles(args []string) int {
+	write, diff := false, false
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && args[0] != "-" {
+		switch args[0] {
+		case "-w":
+			write = true
+		case "-d":
+			diff = true
+		default:
+			fmt.Fprintf(os.Stderr, "Unknown option %s\n", args[0])
+			fmt.Fprintln(os.Stderr, "Usage: box fmt [-w] [-d] [script.box...]")
+			return 1
+		}
+		args = args[1:]
+	}
+
+	if len(args) == 0 {
+		if write {
+			fmt.Fprintln(os.Stderr, "box fmt: cannot use -w with standard input")
+			return 1
+		}
+		args = []string{"-"}
+	}
+
+	status := 0
+	for _, path := range args {
+		if err := formatFile(path, write, diff); err != nil {
+			reportError(err, "box fmt")
+			status = 1
+		}
+	}
+	return status
+}
+
+// formatFile formats one file, or stdin for "-"
+func formatFile(path string, write, diff bool) error {
+	var content []byte
+	var err error
+	name := path
+	if path == "-" {
+		name = "<standard input>"
+		content, err = io.ReadAll(os.Stdin)
+	} else {
+		content, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return err
+	}
+
+	formatted, err := box.FormatSource(name, string(content))
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case diff:
+		fmt.Print(unifiedDiff(name, string(content), formatted))
+	case write:
+		if formatted != string(content) {
+			info, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			return os.WriteFile(path, []byte(formatted), info.Mode().Perm())
+		}
+	default:
+		fmt.Print(formatted)
+	}
+	return nil
+}
+
+// unifiedDiff returns the changes from before to after in unified format
+// with three lines of context, or "" when they are the same
+func unifiedDiff(name, before, after string) string {
+	if before == after {
+		return ""
+	}
+	a, b := splitLines(before), splitLines(after)
+
+	// Longest common subsequence of lines, from the end
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	// Walk it into a list of kept, removed and added lines
+	var edits []diffEdit
+	var changes []int // Indexes of the removed and added lines
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			edits = append(edits, diffEdit{' ', a[i], i, j})
+			i, j = i+1, j+1
+			continue
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, diffEdit{'-', a[i], i, j})
+			i++
+		default:
+			edits = append(edits, diffEdit{'+', b[j], i, j})
+			j++
+		}
+		changes = append(changes, len(edits)-1)
+	}
+
+	// Group changes whose context would touch into one hunk
+	const context = 3
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s.orig\n+++ %s\n", name, name)
+	for k := 0; k < len(changes); {
+		first, last := changes[k], changes[k]
+		for k++; k < len(changes) && changes[k] <= last+2*context+1; k++ {
+			last = changes[k]
+		}
+		start, end := max(first-context, 0), min(last+context+1, len(edits))
+
+		removed, added := 0, 0
+		for _, e := range edits[start:end] {
+			if e.op != '+' {
+				removed++
+			}
+			if e.op != '-' {
+				added++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(edits[start].i, removed), hunkRange(edits[start].j, added))
+		for _, e := range edits[start:end] {
+			fmt.Fprintf(&out, "%c%s\n", e.op, e.line)
+		}
+	}
+	return out.String()
+}
+
+// diffEdit is one line of a diff
+type diffEdit struct {
+	op   byte // ' ', '-' or '+'
+	line string
+	i, j int // Lines of before and after ahead of this one
+}
+
+// hunkRange formats the start and length of a hunk side, 1-based
+func hunkRange(start, n int) string {
+	if n == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if n == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, n)
+}
+
+// splitLines splits text into lines without their newlines
+func splitLines(text string) []string {
+	lines := strings.Split(text, "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"box/internal/box"
+)
+
+// runLSP serves the Language Server Protocol on stdin and stdout for
+// editors: diagnostics from the parser and checker, definitions, hovers,
+// completion, document symbols and formatting. It returns when the client
+// sends exit, with 0 after a shutdown request and 1 without one.
+func runLSP() int {
+	server := &lspServer{
+		in:    bufio.NewReader(os.Stdin),
+		out:   os.Stdout,
+		docs:  make(map[string]*lspDocument),
+		verbs: box.NewEvaluator(box.NewScope()).BuiltinNames(),
+	}
+	return server.serve()
+}
+
+// JSON-RPC error codes
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcNotInitialized = -32002
+)
+
+type lspServer struct {
+	in          *bufio.Reader
+	out         io.Writer
+	docs        map[string]*lspDocument // Open documents by URI
+	verbs       []string
+	initialized bool
+	shutdown    bool
+}
+
+// lspDocument is an open file: its text as the editor has it, and the
+// last program parsed from it, kept while edits leave it unparseable
+type lspDocument struct {
+	uri     string
+	path    string
+	lines   []string
+	program *box.Program
+}
+
+type rpcMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"` // UTF-16 code units
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"` // 1 error, 2 warning
+	Code     string   `json:"code,omitempty"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspTextEdit struct {
+	Range   lspRange `json:"range"`
+	NewText string   `json:"newText"`
+}
+
+type lspCompletionItem struct {
+	Label    string      `json:"label"`
+	Kind     int         `json:"kind"`
+	Detail   string      `json:"detail,omitempty"`
+	TextEdit lspTextEdit `json:"textEdit"`
+}
+
+type lspSymbol struct {
+	Name           string      `json:"name"`
+	Detail         string      `json:"detail,omitempty"`
+	Kind           int         `json:"kind"`
+	Range          lspRange    `json:"range"`
+	SelectionRange lspRange    `json:"selectionRange"`
+	Children       []lspSymbol `json:"children,omitempty"`
+}
+
+// positionParams are the parameters of the requests about one place in
+// a document
+type positionParams struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position lspPosition `json:"position"`
+}
+
+// LSP kinds for the completions and symbols box reports
+var (
+	completionKinds = map[string]int{"verb": 3, "function": 3, "field": 5, "variable": 6, "namespace": 9, "keyword": 14, "data": 22}
+	symbolKinds     = map[string]int{"field": 8, "function": 12, "data": 23}
+)
+
+// serve reads and answers messages until exit or the end of input
+func (s *lspServer) serve() int {
+	for {
+		body, err := s.read()
+		if err != nil {
+			if err != io.EOF {
+				fmt.Fprintf(os.Stderr, "box lsp: %v\n", err)
+			}
+			return 1
+		}
+
+		var msg rpcMessage
+		if err := json.Unmarshal(body, &msg); err != nil {
+			s.reply(nil, nil, &rpcError{rpcParseError, err.Error()})
+			continue
+		}
+		if msg.Method == "exit" {
+			if s.shutdown {
+				return 0
+			}
+			return 1
+		}
+
+		result, rpcErr := s.handle(&msg)
+		if msg.ID != nil {
+			s.reply(msg.ID, result, rpcErr)
+		}
+	}
+}
+
+// handle runs one request or notification and returns its result
+func (s *lspServer) handle(msg *rpcMessage) (any, *rpcError) {
+	switch {
+	case msg.Method == "initialize":
+		s.initialized = true
+		return map[string]any{
+			"capabilities": map[string]any{
+				"textDocumentSync":           map[string]any{"openClose": true, "change": 1},
+				"definitionProvider":         true,
+				"hoverProvider":              true,
+				"completionProvider":         map[string]any{"triggerCharacters": []string{"$", "{", "."}},
+				"documentSymbolProvider":     true,
+				"documentFormattingProvider": true,
+			},
+			"serverInfo": map[string]any{"name": "box"},
+		}, nil
+	case !s.initialized:
+		return nil, &rpcError{rpcNotInitialized, "initialize has not been called"}
+	case s.shutdown:
+		return nil, &rpcError{rpcInvalidRequest, "the server is shutting down"}
+	}
+
+	switch msg.Method {
+	case "initialized":
+	case "shutdown":
+		s.shutdown = true
+	case "textDocument/didOpen":
+		var params struct {
+			TextDocument struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"textDocument"`
+		}
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, &rpcError{rpcInvalidParams, err.Error()}
+		}
+		doc := &lspDocument{uri: params.TextDocument.URI, path: uriPath(params.TextDocument.URI)}
+		s.docs[doc.uri] = doc
+		s.update(doc, params.TextDocument.Text)
+	case "textDocument/didChange":
+		var params struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+			ContentChanges []struct {
+				Text string `json:"text"`
+			} `json:"contentChanges"`
+		}
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, &rpcError{rpcInvalidParams, err.Error()}
+		}
+		doc, ok := s.docs[params.TextDocument.URI]
+		if ok && len(params.ContentChanges) > 0 {
+			// Changes are whole documents, so the last one is the text
+			s.update(doc, params.ContentChanges[len(params.ContentChanges)-1].Text)
+		}
+	case "textDocument/didClose":
+		var params positionParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, &rpcError{rpcInvalidParams, err.Error()}
+		}
+		delete(s.docs, params.TextDocument.URI)
+		s.publish(params.TextDocument.URI, []lspDiagnostic{})
+	case "textDocument/definition":
+		return s.query(msg.Params, s.definition)
+	case "textDocument/hover":
+		return s.query(msg.Params, s.hover)
+	case "textDocument/completion":
+		return s.query(msg.Params, s.completion)
+	case "textDocument/documentSymbol":
+		return s.query(msg.Params, s.symbols)
+	case "textDocument/formatting":
+		return s.query(msg.Params, s.format)
+	default:
+		if msg.ID != nil {
+			return nil, &rpcError{rpcMethodNotFound, fmt.Sprintf("method not found: %s", msg.Method)}
+		}
+	}
+	return nil, nil
+}
+
+// query decodes the parameters of a request about an open document and
+// answers it. A document that is not open, or has never parsed, has
+// nothing to answer with.
+func (s *lspServer) query(raw json.RawMessage, answer func(*lspDocument, lspPosition) any) (any, *rpcError) {
+	var params positionParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, &rpcError{rpcInvalidParams, err.Error()}
+	}
+	doc, ok := s.docs[params.TextDocument.URI]
+	if !ok || doc.program == nil {
+		return nil, nil
+	}
+	return answer(doc, params.Position), nil
+}
+
+// update takes a document's new text, parses and checks it, and publishes
+// what was found
+func (s *lspServer) update(doc *lspDocument, text string) {
+	doc.lines = strings.Split(text, "\n")
+
+	var diags []box.Diagnostic
+	parser, _ := box.NewParticleParser(doc.path)
+	program, err := parser.ParseString(text)
+	if err != nil {
+		errs := box.Errors(err)
+		if errs == nil {
+			errs = []*box.BoxError{{Message: err.Error()}}
+		}
+		diags = box.Diagnostics(errs)
+	} else {
+		doc.program = program
+		diags = box.Check(program, s.verbs)
+	}
+
+	published := []lspDiagnostic{}
+	for _, diag := range diags {
+		d := lspDiagnostic{Severity: 1, Source: "box", Message: diag.Message}
+		if !diag.IsError() {
+			d.Severity = 2
+		}
+		if diag.Rule != "error" {
+			d.Code = diag.Rule
+		}
+		if at := diag.Location; at.Filename != "" && at.Filename != doc.path {
+			// In an imported file: reported at the top of this one
+			d.Message = diag.Error()
+		} else if at.Line > 0 {
+			d.Range = doc.span(at)
+		}
+		if diag.Help != "" {
+			d.Message += "\n" + diag.Help
+		}
+		published = append(published, d)
+	}
+	s.publish(doc.uri, published)
+}
+
+func (s *lspServer) publish(uri string, diags []lspDiagnostic) {
+	s.notify("textDocument/publishDiagnostics", map[string]any{"uri": uri, "diagnostics": diags})
+}
+
+func (s *lspServer) definition(doc *lspDocument, pos lspPosition) any {
+	line, column := doc.position(pos)
+	at, ok := box.Definition(doc.program, doc.line(line), line, column)
+	if !ok {
+		return nil
+	}
+	target := s.open(at.Filename)
+	start := target.point(at.Line, at.Column)
+	return lspLocation{URI: target.uri, Range: lspRange{start, start}}
+}
+
+func (s *lspServer) hover(doc *lspDocument, pos lspPosition) any {
+	line, column := doc.position(pos)
+	text, ok := box.Hover(doc.program, doc.line(line), line, column)
+	if !ok {
+		return nil
+	}
+	return map[string]any{"contents": map[string]string{"kind": "markdown", "value": text}}
+}
+
+func (s *lspServer) completion(doc *lspDocument, pos lspPosition) any {
+	line, column := doc.position(pos)
+	completions, from := box.Complete(doc.program, s.verbs, doc.line(line), line, column)
+	replace := lspRange{doc.point(line, from), doc.point(line, column)}
+	items := make([]lspCompletionItem, len(completions))
+	for i, c := range completions {
+		items[i] = lspCompletionItem{
+			Label:    c.Label,
+			Kind:     completionKinds[c.Kind],
+			Detail:   c.Detail,
+			TextEdit: lspTextEdit{replace, c.Label},
+		}
+	}
+	return map[string]any{"isIncomplete": false, "items": items}
+}
+
+func (s *lspServer) symbols(doc *lspDocument, _ lspPosition) any {
+	var convert func(symbols []box.Symbol) []lspSymbol
+	convert = func(symbols []box.Symbol) []lspSymbol {
+		converted := make([]lspSymbol, len(symbols))
+		for i, symbol := range symbols {
+			at := symbol.Location
+			header := lspRange{doc.point(at.Line, at.Column), doc.point(at.Line, utf8.RuneCountInString(doc.line(at.Line))+1)}
+			converted[i] = lspSymbol{
+				Name:           symbol.Name,
+				Detail:         symbol.Detail,
+				Kind:           symbolKinds[symbol.Kind],
+				Range:          lspRange{header.Start, doc.point(symbol.EndLine, utf8.RuneCountInString(doc.line(symbol.EndLine))+1)},
+				SelectionRange: header,
+				Children:       convert(symbol.Children),
+			}
+		}
+		return converted
+	}
+	return convert(box.Symbols(doc.program))
+}
+
+// format replaces the whole document with its formatted text, or answers
+// no edits when it is already formatted or does not parse
+func (s *lspServer) format(doc *lspDocument, _ lspPosition) any {
+	text := strings.Join(doc.lines, "\n")
+	formatted, err := box.FormatSource(doc.path, text)
+	if err != nil || formatted == text {
+		return []lspTextEdit{}
+	}
+	last := len(doc.lines)
+	end := doc.point(last, utf8.RuneCountInString(doc.line(last))+1)
+	return []lspTextEdit{{lspRange{lspPosition{}, end}, formatted}}
+}
+
+// open returns the document for a file, the open one when the editor has
+// it, otherwise read from disk
+func (s *lspServer) open(path string) *lspDocument {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	uri := pathURI(path)
+	if doc, ok := s.docs[uri]; ok {
+		return doc
+	}
+	content, _ := os.ReadFile(path)
+	return &lspDocument{uri: uri, path: path, lines: strings.Split(string(content), "\n")}
+}
+
+// read returns the body of the next message, framed by a Content-Length
+// header
+func (s *lspServer) read() ([]byte, error) {
+	length := -1
+	for {
+		line, err := s.in.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		if name, value, ok := strings.Cut(line, ":"); ok && strings.EqualFold(name, "Content-Length") {
+			if length, err = strconv.Atoi(strings.TrimSpace(value)); err != nil {
+				return nil, fmt.Errorf("invalid Content-Length %q", value)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("message without Content-Length")
+	}
+	body := make([]byte, length)
+	_, err := io.ReadFull(s.in, body)
+	return body, err
+}
+
+func (s *lspServer) reply(id json.RawMessage, result any, rpcErr *rpcError) {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	if rpcErr != nil {
+		s.write(map[string]any{"jsonrpc": "2.0", "id": id, "error": rpcErr})
+		return
+	}
+	s.write(map[string]any{"jsonrpc": "2.0", "id": id, "result": result})
+}
+
+func (s *lspServer) notify(method string, params any) {
+	s.write(map[string]any{"jsonrpc": "2.0", "method": method, "params": params})
+}
+
+func (s *lspServer) write(msg any) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "box lsp: %v\n", err)
+		return
+	}
+	fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+// line returns the text of a 1-based line, "" past the end
+func (d *lspDocument) line(n int) string {
+	if n < 1 || n > len(d.lines) {
+		return ""
+	}
+	return strings.TrimSuffix(d.lines[n-1], "\r")
+}
+
+// position turns an LSP position into a 1-based line and rune column
+func (d *lspDocument) position(pos lspPosition) (int, int) {
+	line := pos.Line + 1
+	column, units := 1, 0
+	for _, r := range d.line(line) {
+		if units >= pos.Character {
+			break
+		}
+		units += utf16.RuneLen(r)
+		column++
+	}
+	return line, column
+}
+
+// point turns a 1-based line and rune column into an LSP position
+func (d *lspDocument) point(line, column int) lspPosition {
+	if line < 1 {
+		return lspPosition{}
+	}
+	units := 0
+	for i, r := range []rune(d.line(line)) {
+		if i >= column-1 {
+			break
+		}
+		units += utf16.RuneLen(r)
+	}
+	return lspPosition{Line: line - 1, Character: units}
+}
+
+// span returns the range of a located error: its length when known,
+// otherwise the word it starts at
+func (d *lspDocument) span(at box.Location) lspRange {
+	start := d.point(at.Line, at.Column)
+	length := at.Length
+	if length == 0 {
+		runes := []rune(d.line(at.Line))
+		for i := at.Column - 1; i >= 0 && i < len(runes) && runes[i] != ' ' && runes[i] != '\t'; i++ {
+			length++
+		}
+	}
+	return lspRange{start, d.point(at.Line, at.Column+length)}
+}
+
+// uriPath returns the file a file: URI names, or the URI itself for
+// documents that are not files
+func uriPath(uri string) string {
+	if u, err := url.Parse(uri); err == nil && u.Scheme == "file" {
+		return filepath.FromSlash(u.Path)
+	}
+	return uri
+}
+
+func pathURI(path string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
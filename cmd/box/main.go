@@ -6,16 +6,18 @@ import (
 	"strings"
 
 	"box/internal/box"
+
+	"golang.org/x/term"
 )
 
 func main() {
 	if len(os.Args) < 2 {
-		fmt.Println("Usage:")
-		fmt.Println("  box <script.box> [args...]  - Run a box script")
-		fmt.Println("  box lex <script.box>        - Debug lexer output")
-		fmt.Println("  box ast <script.box>        - Debug parser AST")
-		fmt.Println("  box update                  - Update box interpreter")
-		os.Exit(1)
+		os.Exit(runREPL())
+	}
+
+	if os.Args[1] == "help" || os.Args[1] == "-h" || os.Args[1] == "--help" {
+		printUsage()
+		return
 	}
 
 	if os.Args[1] == "lex" {
@@ -36,52 +38,258 @@ func main() {
 		return
 	}
 
+	if os.Args[1] == "fns" {
+		if len(os.Args) < 3 {
+			fmt.Println("Usage: box fns <script.box>")
+			os.Exit(1)
+		}
+		listFunctions(os.Args[2])
+		return
+	}
+
 	if os.Args[1] == "update" {
 		updateBox()
 		return
 	}
 
-	scriptPath := os.Args[1]
-	args := os.Args[2:]
+	if os.Args[1] == "fmt" {
+		os.Exit(formatFiles(os.Args[2:]))
+	}
 
-	content, err := os.ReadFile(scriptPath)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading file: %v\n", err)
-		os.Exit(1)
+	if os.Args[1] == "lsp" {
+		os.Exit(runLSP())
 	}
 
-	parser, err := box.NewParticleParser(scriptPath)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Parser initialization error: %v\n", err)
+	if os.Args[1] == "check" {
+		if _, args := parseFlags(os.Args[2:]); len(args) == 1 {
+			os.Exit(checkScript(args[0]))
+		}
+		fmt.Println("Usage: box check [--error-format=<fmt>] <script.box>")
 		os.Exit(1)
 	}
 
-	program, err := parser.ParseString(string(content))
-	if err != nil {
-		if boxErr, ok := err.(*box.BoxError); ok {
-			fmt.Fprint(os.Stderr, box.FormatError(boxErr))
-		} else {
-			fmt.Fprintf(os.Stderr, "Parse error: %v\n", err)
-		}
+	strict, args := parseFlags(os.Args[1:])
+	if len(args) == 0 {
+		printUsage()
+		os.Exit(1)
+	}
+	scriptPath, args := args[0], args[1:]
+	if errorFormat == "sarif" {
+		// A SARIF log describes a check, not a run
+		fmt.Fprintln(os.Stderr, "--error-format=sarif only applies to checks: use 'box check --error-format=sarif <script.box>'")
 		os.Exit(1)
 	}
 
+	program := parseScript(scriptPath)
+	// A [main] that reads its arguments may take --help itself
+	if len(args) == 1 && args[0] == "--help" && !box.TakesArgs(program) {
+		fmt.Print(box.FormatUsage(program, scriptPath))
+		return
+	}
 	scope := box.NewScope()
 	evaluator := box.NewEvaluatorWithFilename(scope, scriptPath)
+	evaluator.SetStrict(strict)
 
 	result := evaluator.Eval(program, args)
 	if result.Error != nil {
-		if boxErr, ok := result.Error.(*box.BoxError); ok {
-			fmt.Fprint(os.Stderr, box.FormatError(boxErr))
-		} else {
-			fmt.Fprintf(os.Stderr, "Runtime error: %v\n", result.Error)
-		}
+		reportError(result.Error, "Runtime error")
 		os.Exit(1)
 	}
 
 	os.Exit(result.Status)
 }
 
+// parseFlags reads the options before the script path, exiting on an
+// unknown one, and returns whether --strict was given and the rest
+func parseFlags(args []string) (bool, []string) {
+	strict := false
+	for len(args) > 0 && strings.HasPrefix(args[0], "--") {
+		flag := args[0]
+		args = args[1:]
+		switch {
+		case flag == "--strict":
+			strict = true
+		case strings.HasPrefix(flag, "--error-format="):
+			errorFormat = strings.TrimPrefix(flag, "--error-format=")
+			if errorFormat != "text" && errorFormat != "json" && errorFormat != "sarif" {
+				fmt.Fprintf(os.Stderr, "Unknown error format %q: use text, json or sarif\n", errorFormat)
+				os.Exit(1)
+			}
+		default:
+			fmt.Fprintf(os.Stderr, "Unknown option %s\n", flag)
+			printUsage()
+			os.Exit(1)
+		}
+	}
+	return strict, args
+}
+
+// errorFormat is how errors are reported: text for people, json for one
+// object per line on stderr, sarif for a log of 'box check' diagnostics on
+// stdout
+var errorFormat = "text"
+
+// reportError writes an error, or each error of a list, in the chosen
+// format. Errors without a location are reported with the prefix in text
+// mode.
+func reportError(err error, prefix string) {
+	errs := box.Errors(err)
+	switch errorFormat {
+	case "json":
+		if errs == nil {
+			errs = []*box.BoxError{{Message: fmt.Sprintf("%s: %v", prefix, err)}}
+		}
+		for _, boxErr := range errs {
+			fmt.Fprint(os.Stderr, rendered(box.FormatErrorJSON(boxErr)))
+		}
+	default:
+		if errs == nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", prefix, err)
+			return
+		}
+		for i, boxErr := range errs {
+			if i > 0 {
+				fmt.Fprintln(os.Stderr)
+			}
+			fmt.Fprint(os.Stderr, formatError(boxErr))
+		}
+		if len(errs) > 1 {
+			fmt.Fprintf(os.Stderr, "\n%d errors\n", len(errs))
+		}
+	}
+}
+
+// rendered returns JSON or SARIF output, exiting when it could not be
+// rendered
+func rendered(output string, err error) string {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error rendering %s output: %v\n", errorFormat, err)
+		os.Exit(1)
+	}
+	return output
+}
+
+// formatError renders an error for stderr, in colour when it is a terminal
+// and NO_COLOR is not set
+func formatError(err *box.BoxError) string {
+	if os.Getenv("NO_COLOR") == "" && term.IsTerminal(int(os.Stderr.Fd())) {
+		return box.FormatErrorColor(err)
+	}
+	return box.FormatError(err)
+}
+
+// checkScript runs the static checks on a script and reports what they
+// find. It returns 1 when there are errors, parse errors included, so CI
+// fails; warnings alone return 0.
+func checkScript(scriptPath string) int {
+	var diags []box.Diagnostic
+	if program, err := parseFile(scriptPath); err != nil {
+		errs := box.Errors(err)
+		if errs == nil {
+			errs = []*box.BoxError{{Message: fmt.Sprintf("Error reading file: %v", err)}}
+		}
+		diags = box.Diagnostics(errs)
+	} else {
+		verbs := box.NewEvaluator(box.NewScope()).BuiltinNames()
+		diags = box.Check(program, verbs)
+	}
+
+	errors := 0
+	for _, diag := range diags {
+		if diag.IsError() {
+			errors++
+		}
+	}
+
+	switch errorFormat {
+	case "sarif":
+		fmt.Print(rendered(box.FormatSARIF(diags)))
+	case "json":
+		for i := range diags {
+			fmt.Fprint(os.Stderr, rendered(box.FormatDiagnosticJSON(&diags[i])))
+		}
+	default:
+		color := os.Getenv("NO_COLOR") == "" && term.IsTerminal(int(os.Stderr.Fd()))
+		for i := range diags {
+			if i > 0 {
+				fmt.Fprintln(os.Stderr)
+			}
+			if color {
+				fmt.Fprint(os.Stderr, box.FormatDiagnosticColor(&diags[i]))
+			} else {
+				fmt.Fprint(os.Stderr, box.FormatDiagnostic(&diags[i]))
+			}
+		}
+		if len(diags) > 0 {
+			fmt.Fprintf(os.Stderr, "\n%s, %s\n", plural(errors, "error"), plural(len(diags)-errors, "warning"))
+		}
+	}
+
+	if errors > 0 {
+		return 1
+	}
+	return 0
+}
+
+// plural formats a count with its noun, "1 error" or "2 errors"
+func plural(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+// parseFile reads and parses a script
+func parseFile(scriptPath string) (*box.Program, error) {
+	content, err := os.ReadFile(scriptPath)
+	if err != nil {
+		return nil, err
+	}
+	parser, err := box.NewParticleParser(scriptPath)
+	if err != nil {
+		return nil, err
+	}
+	return parser.ParseString(string(content))
+}
+
+// parseScript reads and parses a script, exiting with the error on failure
+func parseScript(scriptPath string) *box.Program {
+	program, err := parseFile(scriptPath)
+	if err != nil {
+		reportError(err, "Error reading file")
+		os.Exit(1)
+	}
+	return program
+}
+
+// listFunctions prints the -i functions a script can be invoked with
+func listFunctions(scriptPath string) {
+	program := parseScript(scriptPath)
+	fmt.Print(box.FormatUsage(program, scriptPath))
+}
+
+func printUsage() {
+	fmt.Println("Usage:")
+	fmt.Println("  box                         - Start an interactive session")
+	fmt.Println("  box <script.box> [args...]  - Run a box script")
+	fmt.Println("  box --strict <script.box>   - Run with undefined variables as errors")
+	fmt.Println("  box --error-format=<fmt> <script.box>")
+	fmt.Println("                              - Report errors as text, json (one object per")
+	fmt.Println("                                line on stderr); sarif is for 'box check'")
+	fmt.Println("  box check [--error-format=<fmt>] <script.box>")
+	fmt.Println("                              - Report likely mistakes without running;")
+	fmt.Println("                                exits 1 when there are errors")
+	fmt.Println("  box fmt [-w|-d] [script.box...]")
+	fmt.Println("                              - Print scripts, or stdin, formatted; -w rewrites")
+	fmt.Println("                                the files and -d shows the changes as a diff")
+	fmt.Println("  box lsp                     - Serve the Language Server Protocol on stdio")
+	fmt.Println("  box <script.box> --help     - List a script's invokable functions")
+	fmt.Println("  box fns <script.box>        - List a script's invokable functions")
+	fmt.Println("  box lex <script.box>        - Debug lexer output")
+	fmt.Println("  box ast <script.box>        - Debug parser AST")
+	fmt.Println("  box update                  - Update box interpreter")
+}
+
 func lexDebug(filename string) {
 	content, err := os.ReadFile(filename)
 	if err != nil {
@@ -143,8 +351,10 @@ func astDebug(filename string) {
 
 	program, err := parser.ParseString(string(content))
 	if err != nil {
-		if boxErr, ok := err.(*box.BoxError); ok {
-			fmt.Print(box.FormatError(boxErr))
+		if errs := box.Errors(err); errs != nil {
+			for _, boxErr := range errs {
+				fmt.Print(box.FormatError(boxErr))
+			}
 		} else {
 			fmt.Printf("Parse error: %v\n", err)
 		}
@@ -234,6 +444,9 @@ func printBlockBody(body []interface{}, indent string) {
 			if v.Label != "" {
 				fmt.Printf(" %s", v.Label)
 			}
+			for _, expr := range v.Exprs {
+				fmt.Printf(" %s", formatExpression(expr))
+			}
 			fmt.Printf("] (%d items)\n", len(v.Body))
 			printBlockBody(v.Body, indent+"  ")
 		}
@@ -269,10 +482,12 @@ func formatExpression(expr box.Expr) string {
 	case *box.LiteralExpr:
 		return v.Value
 	case *box.VariableExpr:
-		if v.Index != nil {
-			return fmt.Sprintf("${%s[%s]}", v.Name, *v.Index)
+		return v.String()
+	case *box.InterpExpr:
+		if v.Quote != 0 {
+			return `"` + v.String() + `"`
 		}
-		return "$" + v.Name
+		return v.String()
 	case *box.BlockLookupExpr:
 		return "${" + v.Path + "}"
 	case *box.CommandSubExpr:
@@ -353,5 +568,5 @@ func updateBox() {
 	fmt.Println("")
 	fmt.Println("alternatively, to update box manually:")
 	fmt.Println("  git clone https://github.com/shrub4thedub/boxlang.git")
-	fmt.Println("  cd boxlang && go build -o box cmd/box/main.go")
+	fmt.Println("  cd boxlang && go build -o box ./cmd/box")
 }
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"box/internal/box"
+
+	"golang.org/x/term"
+)
+
+const (
+	replFilename     = "<stdin>"
+	replPrompt       = "box> "
+	replContinuation = "...> "
+	replHistoryLimit = 1000
+)
+
+// lineReader is the source of REPL input: an interactive terminal with line
+// editing, or plain lines from a pipe.
+type lineReader interface {
+	ReadLine(prompt string) (string, error)
+	Close()
+}
+
+// runREPL starts an interactive session that keeps one evaluator alive
+// across inputs and returns the status the session should exit with.
+func runREPL() int {
+	scope := box.NewScope()
+	evaluator := box.NewEvaluatorWithFilename(scope, replFilename)
+	evaluator.SetArgs(nil)
+	scope.Set("status", box.Value{"0"})
+
+	var reader lineReader
+	if term.IsTerminal(int(os.Stdin.Fd())) && term.IsTerminal(int(os.Stdout.Fd())) {
+		reader = newTerminalReader(evaluator)
+	} else {
+		reader = &pipeReader{scanner: bufio.NewScanner(os.Stdin)}
+	}
+	defer reader.Close()
+
+	var buffer []string
+	depth := 0
+	status := 0
+
+	for {
+		prompt := replPrompt
+		if len(buffer) > 0 {
+			prompt = replContinuation
+		}
+
+		line, err := reader.ReadLine(prompt)
+		if err != nil {
+			if err == io.EOF && len(buffer) > 0 {
+				// Abandon the unfinished block but keep the session
+				buffer = nil
+				depth = 0
+				fmt.Println()
+				continue
+			}
+			return status
+		}
+
+		if len(buffer) == 0 && strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		buffer = append(buffer, line)
+		depth += blockDelta(line)
+		if depth > 0 {
+			continue
+		}
+
+		source := strings.Join(buffer, "\n")
+		buffer = nil
+		depth = 0
+
+		result := evalREPLChunk(evaluator, source)
+		if result.Error != nil {
+			printREPLError(result.Error, source)
+			status = 1
+			continue
+		}
+		status = result.Status
+		if result.Halt && result.HaltType == box.ExitHalt {
+			return status
+		}
+	}
+}
+
+// evalREPLChunk parses one complete input and runs it in the session.
+func evalREPLChunk(evaluator *box.Evaluator, source string) box.Result {
+	parser, err := box.NewParticleParser(replFilename)
+	if err != nil {
+		return box.Result{Error: err}
+	}
+
+	program, err := parser.ParseString(source)
+	if err != nil {
+		return box.Result{Error: err}
+	}
+
+	return evaluator.EvalChunk(program)
+}
+
+// printREPLError reports an error without ending the session. The REPL has
+// no file to read context from, so the offending input line is attached as
+// the error's code snippet.
+func printREPLError(err error, source string) {
+	errs := box.Errors(err)
+	if errs == nil {
+		fmt.Fprintf(os.Stderr, "✗ %v\n", err)
+		return
+	}
+
+	lines := strings.Split(source, "\n")
+	for _, boxErr := range errs {
+		if boxErr.Code == "" && boxErr.Location.Filename == replFilename {
+			if boxErr.Location.Line >= 1 && boxErr.Location.Line <= len(lines) {
+				boxErr.Code = lines[boxErr.Location.Line-1]
+			}
+		}
+		fmt.Fprint(os.Stderr, formatError(boxErr))
+	}
+}
+
+// blockDelta reports how a line changes block nesting: headers and
+// control structures open a block, a leading 'end' closes one.
+func blockDelta(line string) int {
+	fields := strings.Fields(stripComment(line))
+	if len(fields) == 0 {
+		return 0
+	}
+
+	switch {
+	case strings.HasPrefix(fields[0], "["):
+		return 1
+	case fields[0] == "if" || fields[0] == "while" || fields[0] == "for":
+		return 1
+	case fields[0] == "end":
+		return -1
+	}
+	return 0
+}
+
+// stripComment removes a trailing comment that is not inside quotes.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// pipeReader reads plain lines when stdin is not a terminal.
+type pipeReader struct {
+	scanner *bufio.Scanner
+}
+
+func (r *pipeReader) ReadLine(prompt string) (string, error) {
+	if r.scanner.Scan() {
+		return r.scanner.Text(), nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", io.EOF
+}
+
+func (r *pipeReader) Close() {}
+
+// terminalReader provides line editing, persistent history and tab
+// completion on an interactive terminal.
+type terminalReader struct {
+	term      *term.Terminal
+	evaluator *box.Evaluator
+	history   *historyFile
+}
+
+func newTerminalReader(evaluator *box.Evaluator) *terminalReader {
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}
+
+	r := &terminalReader{
+		term:      term.NewTerminal(rw, replPrompt),
+		evaluator: evaluator,
+		history:   loadHistory(historyPath()),
+	}
+	r.term.History = r.history
+	r.term.AutoCompleteCallback = r.complete
+	return r
+}
+
+func (r *terminalReader) ReadLine(prompt string) (string, error) {
+	// Raw mode is only held while editing so that command output keeps
+	// normal newline translation.
+	state, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		return "", err
+	}
+	defer term.Restore(int(os.Stdin.Fd()), state)
+
+	if width, height, err := term.GetSize(int(os.Stdout.Fd())); err == nil {
+		r.term.SetSize(width, height)
+	}
+	r.term.SetPrompt(prompt)
+	return r.term.ReadLine()
+}
+
+func (r *terminalReader) Close() {
+	r.history.Close()
+}
+
+// complete handles tab completion of the word under the cursor.
+func (r *terminalReader) complete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' {
+		return "", 0, false
+	}
+
+	start := strings.LastIndexAny(line[:pos], " \t") + 1
+	prefix := line[start:pos]
+	firstWord := strings.TrimSpace(line[:start]) == ""
+
+	matches := completions(r.evaluator, prefix, firstWord)
+	if len(matches) == 0 {
+		return "", 0, false
+	}
+
+	completed := commonPrefix(matches)
+	if len(matches) == 1 && !strings.HasPrefix(prefix, "$") {
+		completed += " "
+	}
+	if completed == prefix && len(matches) > 1 {
+		// Nothing more to insert; show the alternatives instead
+		fmt.Fprintf(r.term, "%s\n", strings.Join(matches, "  "))
+		return "", 0, false
+	}
+
+	newLine := line[:start] + completed + line[pos:]
+	return newLine, start + len(completed), true
+}
+
+// completions returns the sorted candidates for a partial word. Variables
+// and data paths complete after '$'; verbs and functions complete in
+// command position.
+func completions(evaluator *box.Evaluator, prefix string, firstWord bool) []string {
+	scope := evaluator.Scope()
+	var candidates []string
+
+	switch {
+	case strings.HasPrefix(prefix, "${"):
+		for name := range scope.Variables {
+			candidates = append(candidates, "${"+name+"}")
+		}
+		for block, fields := range scope.Data {
+			for field := range fields {
+				candidates = append(candidates, "${"+block+"."+field+"}")
+			}
+		}
+	case strings.HasPrefix(prefix, "$"):
+		for name := range scope.Variables {
+			candidates = append(candidates, "$"+name)
+		}
+	case firstWord:
+		candidates = append(candidates, evaluator.BuiltinNames()...)
+		candidates = append(candidates, "if", "while", "for", "end", "import")
+		for name := range scope.Functions {
+			candidates = append(candidates, name)
+		}
+		for namespace, blocks := range scope.Namespaces {
+			for name, block := range blocks {
+				if block.Type == box.FuncBlock && !block.HasModifier("-h") {
+					candidates = append(candidates, namespace+"."+name)
+				}
+			}
+		}
+	}
+
+	var matches []string
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, prefix) {
+			matches = append(matches, candidate)
+		}
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+// commonPrefix returns the longest prefix shared by all words.
+func commonPrefix(words []string) string {
+	prefix := words[0]
+	for _, word := range words[1:] {
+		for !strings.HasPrefix(word, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
+
+// historyPath returns where REPL history is kept: $BOX_HISTORY if set,
+// otherwise ~/.box_history.
+func historyPath() string {
+	if path := os.Getenv("BOX_HISTORY"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".box_history")
+}
+
+// historyFile is a term.History backed by a file, so entries survive
+// between sessions.
+type historyFile struct {
+	entries []string
+	file    *os.File
+}
+
+func loadHistory(path string) *historyFile {
+	h := &historyFile{}
+	if path == "" {
+		return h
+	}
+
+	if content, err := os.ReadFile(path); err == nil {
+		for _, line := range strings.Split(string(content), "\n") {
+			if line != "" {
+				h.entries = append(h.entries, line)
+			}
+		}
+		if len(h.entries) > replHistoryLimit {
+			h.entries = h.entries[len(h.entries)-replHistoryLimit:]
+		}
+	}
+
+	// History is best effort; the session works without it
+	if f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err == nil {
+		h.file = f
+	}
+	return h
+}
+
+func (h *historyFile) Add(entry string) {
+	if strings.TrimSpace(entry) == "" {
+		return
+	}
+	if len(h.entries) > 0 && h.entries[len(h.entries)-1] == entry {
+		return
+	}
+
+	h.entries = append(h.entries, entry)
+	if len(h.entries) > replHistoryLimit {
+		h.entries = h.entries[1:]
+	}
+	if h.file != nil {
+		fmt.Fprintln(h.file, entry)
+	}
+}
+
+func (h *historyFile) Len() int {
+	return len(h.entries)
+}
+
+// At returns an entry with 0 being the most recent, as term.History expects.
+func (h *historyFile) At(idx int) string {
+	return h.entries[len(h.entries)-1-idx]
+}
+
+func (h *historyFile) Close() {
+	if h.file != nil {
+		h.file.Close()
+	}
+}
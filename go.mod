@@ -1,8 +1,11 @@
 module box
 
-go 1.21
+go 1.23.0
 
 require (
 	github.com/alecthomas/participle/v2 v2.1.1
 	github.com/klauspost/compress v1.17.9
+	golang.org/x/term v0.32.0
 )
+
+require golang.org/x/sys v0.33.0 // indirect
@@ -6,6 +6,7 @@ import (
 	"compress/gzip"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
@@ -14,22 +15,59 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/klauspost/compress/zstd"
 )
 
 // BuiltinFunc represents a built-in verb function
-type BuiltinFunc func(args []Value, scope *Scope) Result
+type BuiltinFunc func(args []Value, ctx *Context) Result
+
+// Streams are the standard streams a command reads from and writes to
+type Streams struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// Context is what a builtin verb runs with: the scope it reads and sets
+// variables in, and the streams it must use instead of the process ones
+type Context struct {
+	Scope *Scope
+	Streams
+
+	// Location is where the verb was called from, for located errors
+	Location Location
+
+	eval *Evaluator
+	cmd  *Cmd
+}
+
+// ArgLocation returns where argument i of the verb is written, for errors
+// about that argument. It falls back to the verb's own location.
+func (c *Context) ArgLocation(i int) Location {
+	if c.eval != nil && c.cmd != nil {
+		if at := c.eval.argLocation(c.cmd, i); at.Line != 0 {
+			return at
+		}
+	}
+	return c.Location
+}
 
 // Built-in verb dispatch table - all verbs are C-level helpers
 var builtins = map[string]BuiltinFunc{
 	// Core verbs
 	"echo":   builtinEcho,
 	"set":    builtinSet,
+	"data":   builtinData,
+	"export": builtinExport,
+	"result": builtinResult,
+	"strict": builtinStrict,
 	"exit":   builtinExit,
 	"return": builtinReturn,
 
@@ -49,6 +87,7 @@ var builtins = map[string]BuiltinFunc{
 	"len":   builtinLen,
 	"glob":  builtinGlob,
 	"match": builtinMatch,
+	"range": builtinRange,
 	"hash":  builtinHash,
 	"sleep": builtinSleep,
 
@@ -75,6 +114,8 @@ var builtins = map[string]BuiltinFunc{
 
 	// Control flow helpers
 	"test":     builtinTest,
+	"true":     builtinTrue,
+	"false":    builtinFalse,
 	"break":    builtinBreak,
 	"continue": builtinContinue,
 }
@@ -86,23 +127,29 @@ var (
 
 // File system verbs implementation
 
-func builtinCopy(args []Value, scope *Scope) Result {
+func builtinCopy(args []Value, ctx *Context) Result {
 	if len(args) != 2 {
 		return Result{Error: &BoxError{Message: "copy: requires exactly two arguments (source, dest)"}}
 	}
 
-	src := args[0].String()
-	dst := args[1].String()
+	src, err := ctx.Path(args[0].String())
+	if err != nil {
+		return Result{Error: &BoxError{Message: fmt.Sprintf("copy: %v", err), Location: ctx.ArgLocation(0)}}
+	}
+	dst, err := ctx.Path(args[1].String())
+	if err != nil {
+		return Result{Error: &BoxError{Message: fmt.Sprintf("copy: %v", err), Location: ctx.ArgLocation(1)}}
+	}
 
 	srcFile, err := os.Open(src)
 	if err != nil {
-		return Result{Error: &BoxError{Message: fmt.Sprintf("copy: %v", err)}}
+		return Result{Error: &BoxError{Message: fmt.Sprintf("copy: %v", err), Location: ctx.ArgLocation(0)}}
 	}
 	defer srcFile.Close()
 
 	dstFile, err := os.Create(dst)
 	if err != nil {
-		return Result{Error: &BoxError{Message: fmt.Sprintf("copy: %v", err)}}
+		return Result{Error: &BoxError{Message: fmt.Sprintf("copy: %v", err), Location: ctx.ArgLocation(1)}}
 	}
 	defer dstFile.Close()
 
@@ -114,91 +161,112 @@ func builtinCopy(args []Value, scope *Scope) Result {
 	return Result{Status: 0}
 }
 
-func builtinMove(args []Value, scope *Scope) Result {
+func builtinMove(args []Value, ctx *Context) Result {
 	if len(args) != 2 {
 		return Result{Error: &BoxError{Message: "move: requires exactly two arguments (source, dest)"}}
 	}
 
-	src := args[0].String()
-	dst := args[1].String()
-
-	err := os.Rename(src, dst)
+	src, err := ctx.resolve(args[0].String(), false)
 	if err != nil {
-		return Result{Error: &BoxError{Message: fmt.Sprintf("move: %v", err)}}
+		return Result{Error: &BoxError{Message: fmt.Sprintf("move: %v", err), Location: ctx.ArgLocation(0)}}
+	}
+	dst, err := ctx.resolve(args[1].String(), false)
+	if err != nil {
+		return Result{Error: &BoxError{Message: fmt.Sprintf("move: %v", err), Location: ctx.ArgLocation(1)}}
+	}
+
+	if err := os.Rename(src, dst); err != nil {
+		return Result{Error: &BoxError{Message: fmt.Sprintf("move: %v", err), Location: ctx.ArgLocation(0)}}
 	}
 
 	return Result{Status: 0}
 }
 
-func builtinDelete(args []Value, scope *Scope) Result {
+func builtinDelete(args []Value, ctx *Context) Result {
 	if len(args) != 1 {
 		return Result{Error: &BoxError{Message: "delete: requires exactly one argument"}}
 	}
 
-	path := args[0].String()
-	err := os.RemoveAll(path)
+	path, err := ctx.resolve(args[0].String(), false)
 	if err != nil {
-		return Result{Error: &BoxError{Message: fmt.Sprintf("delete: %v", err)}}
+		return Result{Error: &BoxError{Message: fmt.Sprintf("delete: %v", err), Location: ctx.ArgLocation(0)}}
+	}
+	if err := os.RemoveAll(path); err != nil {
+		return Result{Error: &BoxError{Message: fmt.Sprintf("delete: %v", err), Location: ctx.ArgLocation(0)}}
 	}
 
 	return Result{Status: 0}
 }
 
-func builtinMkdir(args []Value, scope *Scope) Result {
+func builtinMkdir(args []Value, ctx *Context) Result {
 	if len(args) != 1 {
 		return Result{Error: &BoxError{Message: "mkdir: requires exactly one argument"}}
 	}
 
-	path := args[0].String()
-	err := os.MkdirAll(path, 0755)
+	path, err := ctx.Path(args[0].String())
 	if err != nil {
-		return Result{Error: &BoxError{Message: fmt.Sprintf("mkdir: %v", err)}}
+		return Result{Error: &BoxError{Message: fmt.Sprintf("mkdir: %v", err), Location: ctx.ArgLocation(0)}}
+	}
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return Result{Error: &BoxError{Message: fmt.Sprintf("mkdir: %v", err), Location: ctx.ArgLocation(0)}}
 	}
 
 	return Result{Status: 0}
 }
 
-func builtinTouch(args []Value, scope *Scope) Result {
+func builtinTouch(args []Value, ctx *Context) Result {
 	if len(args) != 1 {
 		return Result{Error: &BoxError{Message: "touch: requires exactly one argument"}}
 	}
 
-	path := args[0].String()
+	path, err := ctx.Path(args[0].String())
+	if err != nil {
+		return Result{Error: &BoxError{Message: fmt.Sprintf("touch: %v", err), Location: ctx.ArgLocation(0)}}
+	}
 	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		return Result{Error: &BoxError{Message: fmt.Sprintf("touch: %v", err)}}
+		return Result{Error: &BoxError{Message: fmt.Sprintf("touch: %v", err), Location: ctx.ArgLocation(0)}}
 	}
 	file.Close()
 
 	return Result{Status: 0}
 }
 
-func builtinLink(args []Value, scope *Scope) Result {
+func builtinLink(args []Value, ctx *Context) Result {
 	if len(args) != 2 {
 		return Result{Error: &BoxError{Message: "link: requires exactly two arguments (target, link)"}}
 	}
 
-	target := args[0].String()
-	link := args[1].String()
-
-	err := os.Symlink(target, link)
+	link, err := ctx.resolve(args[1].String(), false)
 	if err != nil {
-		return Result{Error: &BoxError{Message: fmt.Sprintf("link: %v", err)}}
+		return Result{Error: &BoxError{Message: fmt.Sprintf("link: %v", err), Location: ctx.ArgLocation(1)}}
+	}
+	// Under a root the target is kept inside it
+	target, err := ctx.LinkTarget(args[0].String(), link)
+	if err != nil {
+		return Result{Error: &BoxError{Message: fmt.Sprintf("link: %v", err), Location: ctx.ArgLocation(0)}}
+	}
+
+	if err := os.Symlink(target, link); err != nil {
+		return Result{Error: &BoxError{Message: fmt.Sprintf("link: %v", err), Location: ctx.ArgLocation(1)}}
 	}
 
 	return Result{Status: 0}
 }
 
-func builtinWrite(args []Value, scope *Scope) Result {
+func builtinWrite(args []Value, ctx *Context) Result {
 	if len(args) != 2 {
 		return Result{Error: &BoxError{Message: "write: requires exactly two arguments (path, content)"}}
 	}
 
-	path := args[0].String()
+	path, err := ctx.Path(args[0].String())
+	if err != nil {
+		return Result{Error: &BoxError{Message: fmt.Sprintf("write: %v", err), Location: ctx.ArgLocation(0)}}
+	}
 	content := args[1].String()
 
 	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
-		return Result{Error: &BoxError{Message: fmt.Sprintf("write: %v", err)}}
+		return Result{Error: &BoxError{Message: fmt.Sprintf("write: %v", err), Location: ctx.ArgLocation(0)}}
 	}
 
 	return Result{Status: 0}
@@ -206,7 +274,7 @@ func builtinWrite(args []Value, scope *Scope) Result {
 
 // Utility verbs implementation
 
-func builtinLen(args []Value, scope *Scope) Result {
+func builtinLen(args []Value, ctx *Context) Result {
 	if len(args) != 1 {
 		return Result{Error: &BoxError{Message: "len: requires exactly one argument"}}
 	}
@@ -215,50 +283,94 @@ func builtinLen(args []Value, scope *Scope) Result {
 	length := len(value.List())
 	lengthStr := strconv.Itoa(length)
 
-	// Set result in a variable accessible to caller
-	scope.Set("_len_result", Value{lengthStr})
-
-	return Result{Status: 0}
+	return setResult(ctx, "_len_result", Value{lengthStr})
 }
 
-func builtinGlob(args []Value, scope *Scope) Result {
+func builtinGlob(args []Value, ctx *Context) Result {
 	if len(args) != 1 {
 		return Result{Error: &BoxError{Message: "glob: requires exactly one argument"}}
 	}
 
 	pattern := args[0].String()
-	matches, err := filepath.Glob(pattern)
+	real, err := ctx.Path(pattern)
 	if err != nil {
-		return Result{Error: &BoxError{Message: fmt.Sprintf("glob: %v", err)}}
+		return Result{Error: &BoxError{Message: fmt.Sprintf("glob: %v", err), Location: ctx.ArgLocation(0)}}
+	}
+	matches, err := filepath.Glob(real)
+	if err != nil {
+		return Result{Error: &BoxError{Message: fmt.Sprintf("glob: %v", err), Location: ctx.ArgLocation(0)}}
+	}
+	// The system follows links while matching, so drop what they reach
+	// outside the root
+	matches = slices.DeleteFunc(matches, func(match string) bool {
+		return !ctx.Confined(filepath.Dir(match))
+	})
+	if real != pattern {
+		// Report matches the way the script wrote the pattern
+		for i, match := range matches {
+			matches[i] = ctx.DisplayPath(match)
+		}
 	}
 
-	// Set result in a variable accessible to caller
-	scope.Set("_glob_result", Value(matches))
-
-	return Result{Status: 0}
+	return setResult(ctx, "_glob_result", Value(matches))
 }
 
-func builtinMatch(args []Value, scope *Scope) Result {
+func builtinMatch(args []Value, ctx *Context) Result {
 	if len(args) < 2 {
 		return Result{Error: &BoxError{Message: "match: requires at least two arguments (item, patterns...)"}}
 	}
 
 	text := args[0].String()
-	for _, pat := range args[1:] {
-		pattern := pat.String()
-		matched, err := filepath.Match(pattern, text)
-		if err != nil {
-			return Result{Error: &BoxError{Message: fmt.Sprintf("match: %v", err)}}
-		}
-		if matched {
-			return Result{Status: 0}
+	for i, pat := range args[1:] {
+		for _, pattern := range pat.List() {
+			matched, err := filepath.Match(pattern, text)
+			if err != nil {
+				return Result{Error: &BoxError{Message: fmt.Sprintf("match: %v", err), Location: ctx.ArgLocation(i + 1)}}
+			}
+			if matched {
+				return Result{Status: 0}
+			}
 		}
 	}
 
 	return Result{Status: 1}
 }
 
-func builtinHash(args []Value, scope *Scope) Result {
+// builtinRange produces the integers from start up to, but not including,
+// end: range [start] end [step]
+func builtinRange(args []Value, ctx *Context) Result {
+	if len(args) < 1 || len(args) > 3 {
+		return Result{Error: &BoxError{Message: "range: requires one to three arguments ([start] end [step])", Location: ctx.Location}}
+	}
+
+	bounds := make([]int, len(args))
+	for i, arg := range args {
+		n, err := strconv.Atoi(arg.String())
+		if err != nil {
+			return Result{Error: &BoxError{Message: fmt.Sprintf("range: not an integer: %s", arg.String()), Location: ctx.ArgLocation(i)}}
+		}
+		bounds[i] = n
+	}
+
+	start, end, step := 0, bounds[0], 1
+	if len(bounds) > 1 {
+		start, end = bounds[0], bounds[1]
+	}
+	if len(bounds) > 2 {
+		step = bounds[2]
+	}
+	if step == 0 {
+		return Result{Error: &BoxError{Message: "range: step cannot be zero", Location: ctx.ArgLocation(2)}}
+	}
+
+	values := Value{}
+	for i := start; (step > 0 && i < end) || (step < 0 && i > end); i += step {
+		values = append(values, strconv.Itoa(i))
+	}
+	return setResult(ctx, "_range_result", values)
+}
+
+func builtinHash(args []Value, ctx *Context) Result {
 	if len(args) != 1 {
 		return Result{Error: &BoxError{Message: "hash: requires exactly one argument"}}
 	}
@@ -266,15 +378,20 @@ func builtinHash(args []Value, scope *Scope) Result {
 	target := args[0].String()
 	var hashStr string
 
-	if info, err := os.Stat(target); err == nil && !info.IsDir() {
-		file, err := os.Open(target)
+	path, err := ctx.Path(target)
+	if err != nil {
+		return Result{Error: &BoxError{Message: fmt.Sprintf("hash: %v", err), Location: ctx.ArgLocation(0)}}
+	}
+
+	if info, err := os.Stat(path); err == nil && !info.IsDir() {
+		file, err := os.Open(path)
 		if err != nil {
-			return Result{Error: &BoxError{Message: fmt.Sprintf("hash: %v", err)}}
+			return Result{Error: &BoxError{Message: fmt.Sprintf("hash: %v", err), Location: ctx.ArgLocation(0)}}
 		}
 		defer file.Close()
 		hasher := sha256.New()
 		if _, err := io.Copy(hasher, file); err != nil {
-			return Result{Error: &BoxError{Message: fmt.Sprintf("hash: %v", err)}}
+			return Result{Error: &BoxError{Message: fmt.Sprintf("hash: %v", err), Location: ctx.ArgLocation(0)}}
 		}
 		hashStr = hex.EncodeToString(hasher.Sum(nil))
 	} else {
@@ -282,13 +399,10 @@ func builtinHash(args []Value, scope *Scope) Result {
 		hashStr = hex.EncodeToString(sum[:])
 	}
 
-	// Set result in a variable accessible to caller
-	scope.Set("_hash_result", Value{hashStr})
-
-	return Result{Status: 0}
+	return setResult(ctx, "_hash_result", Value{hashStr})
 }
 
-func builtinSleep(args []Value, scope *Scope) Result {
+func builtinSleep(args []Value, ctx *Context) Result {
 	if len(args) != 1 {
 		return Result{Error: &BoxError{Message: "sleep: requires exactly one argument"}}
 	}
@@ -300,7 +414,7 @@ func builtinSleep(args []Value, scope *Scope) Result {
 		if seconds, err2 := strconv.ParseFloat(durationStr, 64); err2 == nil {
 			duration = time.Duration(seconds * float64(time.Second))
 		} else {
-			return Result{Error: &BoxError{Message: fmt.Sprintf("sleep: invalid duration: %v", err)}}
+			return Result{Error: &BoxError{Message: fmt.Sprintf("sleep: invalid duration: %v", err), Location: ctx.ArgLocation(0)}}
 		}
 	}
 
@@ -310,27 +424,28 @@ func builtinSleep(args []Value, scope *Scope) Result {
 
 // I/O verbs implementation
 
-func builtinEnv(args []Value, scope *Scope) Result {
+func builtinEnv(args []Value, ctx *Context) Result {
 	if len(args) == 0 {
 		// List all environment variables
-		environ := os.Environ()
-		scope.Set("_env_result", Value(environ))
-		return Result{Status: 0}
+		environ := ctx.Environ()
+		if environ == nil {
+			environ = os.Environ()
+		}
+		return setResult(ctx, "_env_result", Value(environ))
 	}
 
 	if len(args) == 1 {
 		// Get specific environment variable
 		key := args[0].String()
-		value := os.Getenv(key)
-		scope.Set("_env_result", Value{value})
-		return Result{Status: 0}
+		value := ctx.Getenv(key)
+		return setResult(ctx, "_env_result", Value{value})
 	}
 
 	if len(args) == 2 {
 		// Set environment variable
 		key := args[0].String()
 		value := args[1].String()
-		err := os.Setenv(key, value)
+		err := ctx.Setenv(key, value)
 		if err != nil {
 			return Result{Error: &BoxError{Message: fmt.Sprintf("env: %v", err)}}
 		}
@@ -340,24 +455,23 @@ func builtinEnv(args []Value, scope *Scope) Result {
 	return Result{Error: &BoxError{Message: "env: requires 0, 1, or 2 arguments"}}
 }
 
-func builtinPrompt(args []Value, scope *Scope) Result {
+func builtinPrompt(args []Value, ctx *Context) Result {
 	if len(args) > 1 {
 		return Result{Error: &BoxError{Message: "prompt: requires 0 or 1 argument"}}
 	}
 
 	// Print prompt if provided
 	if len(args) == 1 {
-		fmt.Print(args[0].String())
+		fmt.Fprint(ctx.Stdout, args[0].String())
 	}
 
 	// Read input
-	scanner := bufio.NewScanner(os.Stdin)
+	scanner := bufio.NewScanner(ctx.Stdin)
 	if scanner.Scan() {
 		input := scanner.Text()
 		// Store result in both legacy and spec-compliant variables
-		scope.Set("_prompt_result", Value{input})
-		scope.Set("reply", Value{input})
-		return Result{Status: 0}
+		ctx.Scope.Set("reply", Value{input})
+		return setResult(ctx, "_prompt_result", Value{input})
 	}
 
 	if err := scanner.Err(); err != nil {
@@ -370,13 +484,16 @@ func builtinPrompt(args []Value, scope *Scope) Result {
 
 // Network and archive verbs implementation (spec-compliant pure implementations)
 
-func builtinDownload(args []Value, scope *Scope) Result {
+func builtinDownload(args []Value, ctx *Context) Result {
 	if len(args) < 2 {
 		return Result{Error: &BoxError{Message: "download: requires at least two arguments (url, destination, [expected_hash])"}}
 	}
 
 	url := args[0].String()
-	destination := args[1].String()
+	destination, err := ctx.Path(args[1].String())
+	if err != nil {
+		return Result{Error: &BoxError{Message: fmt.Sprintf("download: %v", err), Location: ctx.ArgLocation(1)}}
+	}
 	var expectedHash string
 	if len(args) > 2 {
 		expectedHash = args[2].String()
@@ -434,17 +551,23 @@ func builtinDownload(args []Value, scope *Scope) Result {
 	return Result{Status: 0}
 }
 
-func builtinUntar(args []Value, scope *Scope) Result {
+func builtinUntar(args []Value, ctx *Context) Result {
 	if len(args) != 2 {
 		return Result{Error: &BoxError{Message: "untar: requires exactly two arguments (archive, destination)"}}
 	}
 
-	archivePath := args[0].String()
-	dest := args[1].String()
+	archivePath, err := ctx.Path(args[0].String())
+	if err != nil {
+		return Result{Error: &BoxError{Message: fmt.Sprintf("untar: %v", err), Location: ctx.ArgLocation(0)}}
+	}
+	dest, err := ctx.Path(args[1].String())
+	if err != nil {
+		return Result{Error: &BoxError{Message: fmt.Sprintf("untar: %v", err), Location: ctx.ArgLocation(1)}}
+	}
 
 	file, err := os.Open(archivePath)
 	if err != nil {
-		return Result{Error: &BoxError{Message: fmt.Sprintf("untar: %v", err)}}
+		return Result{Error: &BoxError{Message: fmt.Sprintf("untar: %v", err), Location: ctx.ArgLocation(0)}}
 	}
 	defer file.Close()
 
@@ -479,6 +602,12 @@ func builtinUntar(args []Value, scope *Scope) Result {
 		if !strings.HasPrefix(filepath.Clean(target), filepath.Clean(dest)+string(os.PathSeparator)) {
 			return Result{Error: &BoxError{Message: "untar: illegal file path"}}
 		}
+		// Resolved as a script path, so links unpacked earlier cannot
+		// carry later entries out of a root
+		target, err = ctx.resolve(ctx.DisplayPath(target), header.Typeflag != tar.TypeSymlink)
+		if err != nil {
+			return Result{Error: &BoxError{Message: fmt.Sprintf("untar: %v", err)}}
+		}
 
 		switch header.Typeflag {
 		case tar.TypeDir:
@@ -502,7 +631,11 @@ func builtinUntar(args []Value, scope *Scope) Result {
 			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
 				return Result{Error: &BoxError{Message: fmt.Sprintf("untar: %v", err)}}
 			}
-			if err := os.Symlink(header.Linkname, target); err != nil {
+			linkname, err := ctx.LinkTarget(header.Linkname, target)
+			if err != nil {
+				return Result{Error: &BoxError{Message: fmt.Sprintf("untar: %v", err)}}
+			}
+			if err := os.Symlink(linkname, target); err != nil {
 				return Result{Error: &BoxError{Message: fmt.Sprintf("untar: %v", err)}}
 			}
 		default:
@@ -513,17 +646,23 @@ func builtinUntar(args []Value, scope *Scope) Result {
 	return Result{Status: 0}
 }
 
-func builtinTar(args []Value, scope *Scope) Result {
+func builtinTar(args []Value, ctx *Context) Result {
 	if len(args) != 2 {
 		return Result{Error: &BoxError{Message: "tar: requires exactly two arguments (source, archive)"}}
 	}
 
-	src := args[0].String()
-	dest := args[1].String()
+	src, err := ctx.Path(args[0].String())
+	if err != nil {
+		return Result{Error: &BoxError{Message: fmt.Sprintf("tar: %v", err), Location: ctx.ArgLocation(0)}}
+	}
+	dest, err := ctx.Path(args[1].String())
+	if err != nil {
+		return Result{Error: &BoxError{Message: fmt.Sprintf("tar: %v", err), Location: ctx.ArgLocation(1)}}
+	}
 
 	outFile, err := os.Create(dest)
 	if err != nil {
-		return Result{Error: &BoxError{Message: fmt.Sprintf("tar: %v", err)}}
+		return Result{Error: &BoxError{Message: fmt.Sprintf("tar: %v", err), Location: ctx.ArgLocation(1)}}
 	}
 	defer outFile.Close()
 
@@ -598,7 +737,7 @@ func builtinTar(args []Value, scope *Scope) Result {
 
 // Arithmetic verb implementation
 
-func builtinArith(args []Value, scope *Scope) Result {
+func builtinArith(args []Value, ctx *Context) Result {
 	if len(args) != 3 {
 		return Result{Error: &BoxError{Message: "arith: requires exactly three arguments (operand1, operator, operand2)"}}
 	}
@@ -609,12 +748,12 @@ func builtinArith(args []Value, scope *Scope) Result {
 
 	op1, err := strconv.ParseFloat(op1Str, 64)
 	if err != nil {
-		return Result{Error: &BoxError{Message: fmt.Sprintf("arith: invalid number: %s", op1Str)}}
+		return Result{Error: &BoxError{Message: fmt.Sprintf("arith: invalid number: %s", op1Str), Location: ctx.ArgLocation(0)}}
 	}
 
 	op2, err := strconv.ParseFloat(op2Str, 64)
 	if err != nil {
-		return Result{Error: &BoxError{Message: fmt.Sprintf("arith: invalid number: %s", op2Str)}}
+		return Result{Error: &BoxError{Message: fmt.Sprintf("arith: invalid number: %s", op2Str), Location: ctx.ArgLocation(2)}}
 	}
 
 	var result float64
@@ -628,18 +767,18 @@ func builtinArith(args []Value, scope *Scope) Result {
 		result = op1 * op2
 	case "/":
 		if op2 == 0 {
-			return Result{Error: &BoxError{Message: "arith: division by zero"}}
+			return Result{Error: &BoxError{Message: "arith: division by zero", Location: ctx.ArgLocation(2)}}
 		}
 		result = op1 / op2
 	case "%":
 		if op2 == 0 {
-			return Result{Error: &BoxError{Message: "arith: modulo by zero"}}
+			return Result{Error: &BoxError{Message: "arith: modulo by zero", Location: ctx.ArgLocation(2)}}
 		}
 		result = math.Mod(op1, op2)
 	case "**":
 		result = math.Pow(op1, op2)
 	default:
-		return Result{Error: &BoxError{Message: fmt.Sprintf("arith: unknown operator: %s", operator)}}
+		return Result{Error: &BoxError{Message: fmt.Sprintf("arith: unknown operator: %s", operator), Location: ctx.ArgLocation(1)}}
 	}
 
 	// Store result as both integer and float representations
@@ -650,14 +789,12 @@ func builtinArith(args []Value, scope *Scope) Result {
 		resultStr = strconv.FormatFloat(result, 'f', -1, 64)
 	}
 
-	scope.Set("_arith_result", Value{resultStr})
-
-	return Result{Status: 0}
+	return setResult(ctx, "_arith_result", Value{resultStr})
 }
 
 // String manipulation verbs implementation
 
-func builtinJoin(args []Value, scope *Scope) Result {
+func builtinJoin(args []Value, ctx *Context) Result {
 	if len(args) < 2 {
 		return Result{Error: &BoxError{Message: "join: requires at least two arguments (separator, value1, ...)"}}
 	}
@@ -670,29 +807,31 @@ func builtinJoin(args []Value, scope *Scope) Result {
 	}
 
 	result := strings.Join(values, separator)
-	scope.Set("_join_result", Value{result})
 
-	// Also output the result for command substitution and pipelines
-	fmt.Print(result)
+	// Also output the result for pipelines
+	fmt.Fprint(ctx.Stdout, result)
 
-	return Result{Status: 0}
+	return setResult(ctx, "_join_result", Value{result})
 }
 
-func builtinCat(args []Value, scope *Scope) Result {
+func builtinCat(args []Value, ctx *Context) Result {
 	if len(args) > 0 {
-		for _, arg := range args {
-			path := arg.String()
+		for i, arg := range args {
+			path, err := ctx.Path(arg.String())
+			if err != nil {
+				return Result{Error: &BoxError{Message: fmt.Sprintf("cat: %v", err), Location: ctx.ArgLocation(i)}}
+			}
 			data, err := os.ReadFile(path)
 			if err != nil {
-				return Result{Error: &BoxError{Message: fmt.Sprintf("cat: %v", err)}}
+				return Result{Error: &BoxError{Message: fmt.Sprintf("cat: %v", err), Location: ctx.ArgLocation(i)}}
 			}
-			fmt.Print(string(data))
+			fmt.Fprint(ctx.Stdout, string(data))
 		}
 	} else {
 		// No arguments, read from stdin and output to stdout
-		scanner := bufio.NewScanner(os.Stdin)
+		scanner := bufio.NewScanner(ctx.Stdin)
 		for scanner.Scan() {
-			fmt.Println(scanner.Text())
+			fmt.Fprintln(ctx.Stdout, scanner.Text())
 		}
 		if err := scanner.Err(); err != nil {
 			return Result{Error: &BoxError{Message: fmt.Sprintf("cat: %v", err)}}
@@ -704,7 +843,7 @@ func builtinCat(args []Value, scope *Scope) Result {
 
 // Core verbs implementation
 
-func builtinSet(args []Value, scope *Scope) Result {
+func builtinSet(args []Value, ctx *Context) Result {
 	if len(args) < 1 {
 		return Result{Error: &BoxError{Message: "set: missing variable name"}}
 	}
@@ -716,21 +855,172 @@ func builtinSet(args []Value, scope *Scope) Result {
 		values = append(values, arg.List()...)
 	}
 
-	scope.Set(varName, Value(values))
+	ctx.Scope.Set(varName, Value(values))
+	return Result{Status: 0}
+}
+
+// builtinData updates fields of a [data] block at runtime:
+// data set block.field value...
+func builtinData(args []Value, ctx *Context) Result {
+	if len(args) < 2 || args[0].String() != "set" {
+		return Result{Error: &BoxError{
+			Message:  "data: expected 'data set block.field value...'",
+			Location: ctx.Location,
+		}}
+	}
+
+	path := args[1].String()
+	dot := strings.LastIndex(path, ".")
+	if dot <= 0 || dot == len(path)-1 {
+		return Result{Error: &BoxError{
+			Message:  fmt.Sprintf("data set: expected block.field, got '%s'", path),
+			Location: ctx.ArgLocation(1),
+		}}
+	}
+	blockName, field := path[:dot], path[dot+1:]
+
+	var block map[string]Value
+	stored := blockName
+	if ctx.eval != nil {
+		// Through the evaluator, so another file's hidden blocks stay
+		// out of reach
+		name, found, err := ctx.eval.lookupData(blockName)
+		if err != nil {
+			boxErr := err.(*BoxError)
+			boxErr.Location = ctx.ArgLocation(1)
+			return Result{Error: boxErr}
+		}
+		block, stored = found, name
+	} else {
+		block, _ = ctx.Scope.LookupData(blockName)
+	}
+	if block == nil {
+		return Result{Error: &BoxError{
+			Message:  fmt.Sprintf("data set: no data block '%s'", blockName),
+			Location: ctx.ArgLocation(1),
+		}}
+	}
+	if ctx.eval != nil {
+		// Checked under the name the block is stored as, which inside an
+		// imported function carries the file's namespace
+		if ctx.eval.constants[stored] {
+			return Result{Error: &BoxError{
+				Message:  fmt.Sprintf("data set: cannot modify constant data block '%s'", blockName),
+				Location: ctx.ArgLocation(1),
+				Help:     fmt.Sprintf("'%s' is declared with -c; remove the modifier to allow changes", blockName),
+			}}
+		}
+		block = ctx.eval.writableData(stored, block)
+	}
+
+	var values []string
+	for _, arg := range args[2:] {
+		values = append(values, arg.List()...)
+	}
+	block[field] = Value(values)
+
 	return Result{Status: 0}
 }
 
-func builtinEcho(args []Value, scope *Scope) Result {
+// builtinExport assigns a variable in the calling function's scope:
+// export name [value...]. Without values the local value is exported.
+func builtinExport(args []Value, ctx *Context) Result {
+	if len(args) < 1 {
+		return Result{Error: &BoxError{Message: "export: missing variable name", Location: ctx.Location}}
+	}
+
+	varName := args[0].String()
+	var value Value
+	if len(args) == 1 {
+		local, ok := ctx.Scope.Get(varName)
+		if !ok {
+			return Result{Error: &BoxError{
+				Message:  fmt.Sprintf("export: undefined variable: %s", varName),
+				Location: ctx.Location,
+				Help:     fmt.Sprintf("Use 'export %s value' to assign it in the caller", varName),
+			}}
+		}
+		value = local
+	} else {
+		var values []string
+		for _, arg := range args[1:] {
+			values = append(values, arg.List()...)
+		}
+		value = Value(values)
+	}
+
+	target := ctx.Scope
+	if call := ctx.Scope.callScope(); call != nil && call.Parent != nil {
+		target = call.Parent
+	}
+	target.Set(varName, value)
+	return Result{Status: 0}
+}
+
+// builtinResult sets the list a function hands back to its caller, which
+// sees it as $_result
+func builtinResult(args []Value, ctx *Context) Result {
+	call := ctx.Scope.callScope()
+	if call == nil {
+		return Result{Error: &BoxError{
+			Message:  "result: only valid inside a function",
+			Location: ctx.Location,
+		}}
+	}
+
+	var values []string
+	for _, arg := range args {
+		values = append(values, arg.List()...)
+	}
+	call.result = Value(values)
+	call.hasResult = true
+	return Result{Status: 0}
+}
+
+// builtinStrict turns strict mode on or off for the rest of the current
+// function: 'strict', 'strict on' or 'strict off'
+func builtinStrict(args []Value, ctx *Context) Result {
+	on := true
+	if len(args) > 0 {
+		switch args[0].String() {
+		case "on":
+		case "off":
+			on = false
+		default:
+			return Result{Error: &BoxError{
+				Message:  fmt.Sprintf("strict: expected on or off, got '%s'", args[0].String()),
+				Location: ctx.ArgLocation(0),
+			}}
+		}
+	}
+	if len(args) > 1 {
+		return Result{Error: &BoxError{Message: "strict: too many arguments", Location: ctx.Location}}
+	}
+	ctx.eval.strict = on
+	return Result{Status: 0}
+}
+
+// setResult stores a verb's result in its compatibility variable, such as
+// _len_result, and returns it as the command's value for $(...)
+func setResult(ctx *Context, name string, value Value) Result {
+	if value == nil {
+		value = Value{}
+	}
+	ctx.Scope.Set(name, value)
+	return Result{Status: 0, Value: value}
+}
+
+func builtinEcho(args []Value, ctx *Context) Result {
 	var parts []string
 	for _, arg := range args {
 		parts = append(parts, arg.String())
 	}
 
-	fmt.Println(strings.Join(parts, " "))
+	fmt.Fprintln(ctx.Stdout, strings.Join(parts, " "))
 	return Result{Status: 0}
 }
 
-func builtinExit(args []Value, scope *Scope) Result {
+func builtinExit(args []Value, ctx *Context) Result {
 	status := 0
 	if len(args) > 0 {
 		if s, err := strconv.Atoi(args[0].String()); err == nil {
@@ -741,7 +1031,7 @@ func builtinExit(args []Value, scope *Scope) Result {
 	return Result{Status: status, Halt: true, HaltType: ExitHalt}
 }
 
-func builtinReturn(args []Value, scope *Scope) Result {
+func builtinReturn(args []Value, ctx *Context) Result {
 	status := 0
 	if len(args) > 0 {
 		if s, err := strconv.Atoi(args[0].String()); err == nil {
@@ -750,40 +1040,43 @@ func builtinReturn(args []Value, scope *Scope) Result {
 	}
 
 	// Update status variable before returning
-	scope.Set("status", Value{strconv.Itoa(status)})
+	ctx.Scope.Set("status", Value{strconv.Itoa(status)})
 
 	return Result{Status: status, Halt: true, HaltType: ReturnHalt}
 }
 
-func builtinCd(args []Value, scope *Scope) Result {
+func builtinCd(args []Value, ctx *Context) Result {
 	if len(args) != 1 {
 		return Result{Error: &BoxError{Message: "cd: requires exactly one argument"}}
 	}
 
 	dir := args[0].String()
-	if err := os.Chdir(dir); err != nil {
-		return Result{Error: &BoxError{Message: fmt.Sprintf("cd: %v", err)}}
+	if err := ctx.Chdir(dir); err != nil {
+		return Result{Error: &BoxError{Message: fmt.Sprintf("cd: %v", err), Location: ctx.ArgLocation(0)}}
 	}
 
 	return Result{Status: 0}
 }
 
 // Additional built-ins for control flow
-func builtinBreak(args []Value, scope *Scope) Result {
+func builtinBreak(args []Value, ctx *Context) Result {
 	return Result{Status: 0, Halt: true, HaltType: BreakHalt}
 }
 
-func builtinContinue(args []Value, scope *Scope) Result {
+func builtinContinue(args []Value, ctx *Context) Result {
 	return Result{Status: 0, Halt: true, HaltType: ContinueHalt}
 }
 
 // Built-ins for testing conditions
-func builtinExists(args []Value, scope *Scope) Result {
+func builtinExists(args []Value, ctx *Context) Result {
 	if len(args) != 1 {
 		return Result{Error: &BoxError{Message: "exists: requires exactly one argument"}}
 	}
 
-	path := args[0].String()
+	path, err := ctx.Path(args[0].String())
+	if err != nil {
+		return Result{Status: 1}
+	}
 	if _, err := os.Stat(path); err == nil {
 		return Result{Status: 0}
 	}
@@ -791,22 +1084,37 @@ func builtinExists(args []Value, scope *Scope) Result {
 	return Result{Status: 1}
 }
 
-func builtinMktemp(args []Value, scope *Scope) Result {
+func builtinMktemp(args []Value, ctx *Context) Result {
 	pattern := "box"
 	if len(args) == 1 {
 		pattern = args[0].String()
 	}
 
-	dir, err := os.MkdirTemp("", pattern)
+	// A confined evaluator keeps its temporary files inside the root
+	parent := ""
+	if root, _ := ctx.Path("/"); root != "/" {
+		tmp, err := ctx.Path("/tmp")
+		if err != nil {
+			return Result{Error: &BoxError{Message: fmt.Sprintf("mktemp: %v", err)}}
+		}
+		parent = tmp
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return Result{Error: &BoxError{Message: fmt.Sprintf("mktemp: %v", err)}}
+		}
+	}
+
+	dir, err := os.MkdirTemp(parent, pattern)
 	if err != nil {
 		return Result{Error: &BoxError{Message: fmt.Sprintf("mktemp: %v", err)}}
 	}
+	if parent != "" {
+		dir = ctx.DisplayPath(dir)
+	}
 
-	scope.Set("_mktemp_result", Value{dir})
-	return Result{Status: 0}
+	return setResult(ctx, "_mktemp_result", Value{dir})
 }
 
-func builtinTest(args []Value, scope *Scope) Result {
+func builtinTest(args []Value, ctx *Context) Result {
 	if len(args) == 0 {
 		return Result{Status: 1}
 	}
@@ -819,9 +1127,19 @@ func builtinTest(args []Value, scope *Scope) Result {
 	return Result{Status: 1}
 }
 
+// true always succeeds, as in 'while true'
+func builtinTrue(args []Value, ctx *Context) Result {
+	return Result{Status: 0}
+}
+
+// false always fails, without an error
+func builtinFalse(args []Value, ctx *Context) Result {
+	return Result{Status: 1}
+}
+
 // Process management verbs
 
-func builtinRun(args []Value, scope *Scope) Result {
+func builtinRun(args []Value, ctx *Context) Result {
 	if len(args) == 0 {
 		return Result{Error: &BoxError{Message: "run: requires at least one argument (command)"}}
 	}
@@ -833,25 +1151,51 @@ func builtinRun(args []Value, scope *Scope) Result {
 	}
 
 	cmd := exec.Command(cmdName, cmdArgs...)
-	// By default, forward stdout and stderr so external commands behave like
-	// normal shell utilities. This allows command substitution and pipelines
-	// to capture output by redirecting os.Stdout/os.Stderr before invoking
-	// builtinRun.
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = os.Stdin
+	cmd.Dir = ctx.Dir()
+	cmd.Env = ctx.Environ()
+	// Forward the command's streams so external commands behave like normal
+	// shell utilities. Redirects, command substitution and pipeline stages
+	// all work by handing the verb different streams.
+	cmd.Stdout = ctx.Stdout
+	cmd.Stderr = ctx.Stderr
+	cmd.Stdin = ctx.Stdin
 
 	if err := cmd.Run(); err != nil {
 		if exitErr, ok := err.(*exec.ExitError); ok {
-			return Result{Status: exitErr.ExitCode()}
+			return Result{Status: exitStatus(exitErr)}
+		}
+		if errors.Is(err, exec.ErrNotFound) {
+			return Result{Error: notFound("run", cmdName, ctx)}
 		}
-		return Result{Error: &BoxError{Message: fmt.Sprintf("run: %v", err)}}
+		return Result{Error: &BoxError{Message: fmt.Sprintf("run: %v", err), Location: ctx.ArgLocation(0)}}
 	}
 
 	return Result{Status: 0}
 }
 
-func builtinSpawn(args []Value, scope *Scope) Result {
+// notFound reports a program missing from $PATH, suggesting the closest
+// one that is there
+func notFound(verb, name string, ctx *Context) *BoxError {
+	err := &BoxError{
+		Message:  fmt.Sprintf("%s: command '%s' not found in PATH", verb, name),
+		Location: ctx.ArgLocation(0),
+	}
+	if suggestion := suggestProgram(name, pathCommands(ctx.Getenv("PATH"))); suggestion != "" {
+		err.Help = fmt.Sprintf("Did you mean '%s'?", suggestion)
+	}
+	return err
+}
+
+// exitStatus converts a process exit into a decimal status, reporting
+// death by signal as 128+signal like POSIX shells do
+func exitStatus(exitErr *exec.ExitError) int {
+	if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return exitErr.ExitCode()
+}
+
+func builtinSpawn(args []Value, ctx *Context) Result {
 	if len(args) == 0 {
 		return Result{Error: &BoxError{Message: "spawn: requires at least one argument (command)"}}
 	}
@@ -863,12 +1207,17 @@ func builtinSpawn(args []Value, scope *Scope) Result {
 	}
 
 	cmd := exec.Command(cmdName, cmdArgs...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = os.Stdin
+	cmd.Dir = ctx.Dir()
+	cmd.Env = ctx.Environ()
+	cmd.Stdout = ctx.Stdout
+	cmd.Stderr = ctx.Stderr
+	cmd.Stdin = ctx.Stdin
 
 	if err := cmd.Start(); err != nil {
-		return Result{Error: &BoxError{Message: fmt.Sprintf("spawn: %v", err)}}
+		if errors.Is(err, exec.ErrNotFound) {
+			return Result{Error: notFound("spawn", cmdName, ctx)}
+		}
+		return Result{Error: &BoxError{Message: fmt.Sprintf("spawn: %v", err), Location: ctx.ArgLocation(0)}}
 	}
 
 	pid := cmd.Process.Pid
@@ -879,28 +1228,28 @@ func builtinSpawn(args []Value, scope *Scope) Result {
 	return Result{Status: pid}
 }
 
-func builtinWait(args []Value, scope *Scope) Result {
+func builtinWait(args []Value, ctx *Context) Result {
 	if len(args) != 1 {
 		return Result{Error: &BoxError{Message: "wait: requires exactly one argument (PID)"}}
 	}
 
 	pid, err := strconv.Atoi(args[0].String())
 	if err != nil {
-		return Result{Error: &BoxError{Message: "wait: invalid PID"}}
+		return Result{Error: &BoxError{Message: "wait: invalid PID", Location: ctx.ArgLocation(0)}}
 	}
 
 	procMutex.Lock()
 	cmd, ok := spawnedProcs[pid]
 	procMutex.Unlock()
 	if !ok {
-		return Result{Error: &BoxError{Message: fmt.Sprintf("wait: unknown pid %d", pid)}}
+		return Result{Error: &BoxError{Message: fmt.Sprintf("wait: unknown pid %d", pid), Location: ctx.ArgLocation(0)}}
 	}
 
 	err = cmd.Wait()
 	exitCode := 0
 	if err != nil {
 		if exitErr, ok := err.(*exec.ExitError); ok {
-			exitCode = exitErr.ExitCode()
+			exitCode = exitStatus(exitErr)
 		} else {
 			procMutex.Lock()
 			delete(spawnedProcs, pid)
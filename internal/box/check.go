@@ -0,0 +1,882 @@
+package box
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Static checks. Check walks a parsed program without running it and
+// reports what would fail or is likely wrong:
+//
+//	undefined-command   a verb or function that does not exist
+//	arity               a call with too few or too many arguments
+//	undefined-variable  a variable set nowhere, or not on every path
+//	undefined-data      a data block or field that does not exist
+//	misplaced-verb      break/continue outside a loop, return/result
+//	                    outside a function
+//	unreachable         code after exit, return, break or continue
+//	unused              functions and data blocks nothing refers to
+//	constant-data       'data set' on a -c block
+//	hidden              an imported -h function or data block
+//	invalid-condition   an if or while header that cannot be parsed
+//	invalid-for         a for header without its variables and 'in'
+//
+// A function reads its caller's variables, so inside one a variable set
+// anywhere else in the file is assumed to come from the caller, and one
+// set nowhere is only a warning: a caller in another file may set it.
+
+// Diagnostic is a problem Check found. Errors would fail when the script
+// runs; warnings point at code that is likely wrong.
+type Diagnostic struct {
+	BoxError
+	Rule     string `json:"rule"`     // Which check found it, such as arity
+	Severity string `json:"severity"` // "error" or "warning"
+}
+
+// IsError reports whether the diagnostic would fail at run time
+func (d *Diagnostic) IsError() bool {
+	return d.Severity == "error"
+}
+
+// Check analyses program and returns its diagnostics in source order.
+// verbs names every verb the script may call, core and host-registered.
+func Check(program *Program, verbs []string) []Diagnostic {
+	c := &checker{
+		program:  program,
+		verbs:    make(map[string]bool, len(verbs)),
+		assigned: make(map[*Block]map[string]bool),
+		called:   make(map[string]bool),
+		dataUsed: make(map[string]bool),
+		dataSet:  make(map[string]map[string]bool),
+	}
+	for _, verb := range verbs {
+		c.verbs[verb] = true
+	}
+
+	// Variables each function and [main] can set, for the caller rule
+	if program.Main != nil {
+		c.assigned[program.Main] = assignments(program.Main.Body, nil)
+	}
+	for _, fn := range program.Functions {
+		names := assignments(fn.Body, nil)
+		for _, param := range fn.Params() {
+			names[param.Name] = true
+		}
+		c.assigned[fn] = names
+	}
+
+	if program.Main != nil {
+		f := &flow{defined: make(map[string]bool)}
+		c.body(program.Main.Body, f)
+	}
+	for _, fn := range c.functions() {
+		f := &flow{fn: fn, defined: make(map[string]bool)}
+		for _, param := range fn.Params() {
+			f.defined[param.Name] = true
+		}
+		c.body(fn.Body, f)
+	}
+
+	c.unused()
+
+	slices.SortStableFunc(c.diags, func(a, b Diagnostic) int {
+		if a.Location.Line != b.Location.Line {
+			return a.Location.Line - b.Location.Line
+		}
+		return a.Location.Column - b.Location.Column
+	})
+	return c.diags
+}
+
+type checker struct {
+	program  *Program
+	verbs    map[string]bool
+	assigned map[*Block]map[string]bool // Variables each block may set
+	called   map[string]bool            // Functions called from elsewhere
+	dataUsed map[string]bool            // Data blocks referred to
+	dataSet  map[string]map[string]bool // Fields added by 'data set'
+	diags    []Diagnostic
+}
+
+// flow is what the walk knows at a point in a block
+type flow struct {
+	fn      *Block          // Function being checked, nil in [main]
+	defined map[string]bool // Variables set on every path so far
+	loops   int             // Enclosing for and while loops
+	sub     *Location       // Where the $(...) being checked is written
+}
+
+// branch copies the flow for a path that may not be taken
+func (f *flow) branch() *flow {
+	defined := make(map[string]bool, len(f.defined))
+	for name := range f.defined {
+		defined[name] = true
+	}
+	return &flow{fn: f.fn, defined: defined, loops: f.loops, sub: f.sub}
+}
+
+// functions returns the program's functions in source order
+func (c *checker) functions() []*Block {
+	var fns []*Block
+	for _, fn := range c.program.Functions {
+		fns = append(fns, fn)
+	}
+	slices.SortFunc(fns, func(a, b *Block) int { return a.Line - b.Line })
+	return fns
+}
+
+func (c *checker) report(rule, severity string, err BoxError) {
+	// A string naming a variable twice is reported once
+	for _, diag := range c.diags {
+		if diag.Location == err.Location && diag.Message == err.Message {
+			return
+		}
+	}
+	c.diags = append(c.diags, Diagnostic{BoxError: err, Rule: rule, Severity: severity})
+}
+
+// at places a position in the checked file, or at the $(...) the walk is
+// inside, whose own positions mean nothing in the file
+func (c *checker) at(loc Location, f *flow) Location {
+	if f.sub != nil {
+		return *f.sub
+	}
+	loc.Filename = c.program.Filename
+	return loc
+}
+
+// body walks a list of statements. It reports whether they always halt,
+// through exit, return, break or continue.
+func (c *checker) body(items []interface{}, f *flow) bool {
+	halted, reported := false, false
+	for _, item := range items {
+		// The first unreachable statement is reported; it and the rest are
+		// still checked
+		if halted && !reported {
+			c.report("unreachable", "warning", BoxError{
+				Message:  "unreachable code",
+				Location: c.at(statementLocation(item), f),
+				Help:     "The statement before always leaves this block",
+			})
+			reported = true
+		}
+		switch v := item.(type) {
+		case Cmd:
+			halted = c.command(&v, f) || halted
+		case Pipeline:
+			for i := range v.Commands {
+				c.command(&v.Commands[i], f)
+			}
+		case Block:
+			halted = c.control(&v, f) || halted
+		}
+	}
+	return halted
+}
+
+// statementLocation returns where a statement starts
+func statementLocation(item interface{}) Location {
+	switch v := item.(type) {
+	case Cmd:
+		return Location{Line: v.Line, Column: v.Column, Length: utf8.RuneCountInString(v.Verb)}
+	case Pipeline:
+		if len(v.Commands) > 0 {
+			return statementLocation(v.Commands[0])
+		}
+	case Block:
+		return Location{Line: v.Line, Column: v.Column, Length: utf8.RuneCountInString(v.Label)}
+	}
+	return Location{}
+}
+
+// command checks a command and its fallback. It reports whether the
+// command always halts.
+func (c *checker) command(cmd *Cmd, f *flow) bool {
+	for i, arg := range cmd.Args {
+		c.expr(arg, c.at(argPos(cmd, i), f), false, f)
+	}
+	for _, redirect := range cmd.Redirects {
+		if redirect.Expr != nil {
+			c.expr(redirect.Expr, c.at(redirect.Pos, f), false, f)
+		}
+	}
+
+	verb := Location{Line: cmd.Line, Column: cmd.Column, Length: utf8.RuneCountInString(cmd.Verb)}
+	c.call(cmd.Verb, cmd.Args, c.at(verb, f), f)
+
+	halts := false
+	name := cmd.Verb
+	if _, shadowed := c.program.Functions[c.unqualify(name)]; shadowed {
+		name = "" // A function, whatever its name
+	}
+	switch name {
+	case "set":
+		if name, ok := literal(cmd.Args, 0); ok {
+			f.defined[name] = true
+		}
+	case "export":
+		// Assigns the caller's variable, which is ours in [main]
+		if name, ok := literal(cmd.Args, 0); ok && f.fn == nil {
+			f.defined[name] = true
+		}
+	case "prompt":
+		f.defined["reply"] = true
+	case "data":
+		if path, ok := literal(cmd.Args, 1); ok && isWord(cmd.Args[0], "set") {
+			c.dataWrite(path, c.at(argPos(cmd, 1), f))
+		}
+	case "break", "continue":
+		if f.loops == 0 {
+			c.report("misplaced-verb", "error", BoxError{
+				Message:  fmt.Sprintf("%s outside a loop", cmd.Verb),
+				Location: c.at(verb, f),
+				Help:     fmt.Sprintf("'%s' only works inside for and while", cmd.Verb),
+			})
+		}
+		halts = true
+	case "return", "result":
+		if f.fn == nil {
+			c.report("misplaced-verb", "error", BoxError{
+				Message:  fmt.Sprintf("%s outside a function", cmd.Verb),
+				Location: c.at(verb, f),
+				Help:     "Use 'exit' to end the script",
+			})
+		}
+		halts = cmd.Verb == "return"
+	case "exit":
+		halts = true
+	}
+
+	if cmd.Fallback != nil {
+		c.command(cmd.Fallback, f)
+	}
+	return halts
+}
+
+// argPos returns where argument i of a command is written
+func argPos(cmd *Cmd, i int) Location {
+	if i < len(cmd.ArgPos) {
+		return cmd.ArgPos[i]
+	}
+	return Location{Line: cmd.Line, Column: cmd.Column}
+}
+
+// literal returns argument i when it is written as plain text
+func literal(args []Expr, i int) (string, bool) {
+	if i >= len(args) {
+		return "", false
+	}
+	lit, ok := args[i].(*LiteralExpr)
+	if !ok {
+		return "", false
+	}
+	return lit.Value, true
+}
+
+// call checks that a command name resolves and, for functions, that the
+// arguments fit the header
+func (c *checker) call(name string, args []Expr, at Location, f *flow) {
+	if name == "" || strings.ContainsAny(name, "$`\"'") {
+		return // Computed at run time
+	}
+
+	// The script's own functions come first, shadowing verbs of the same
+	// name as they do at run time
+	if fn, ok := c.program.Functions[c.unqualify(name)]; ok {
+		name = c.unqualify(name)
+		if fn != f.fn {
+			c.called[name] = true
+		}
+		c.arity(fn, name, len(args), at)
+		c.returns(fn, f)
+		return
+	}
+	if c.verbs[name] {
+		return
+	}
+
+	name = c.unqualify(name)
+
+	if namespace, fnName, ok := strings.Cut(name, "."); ok {
+		blocks, ok := c.program.Namespaces[namespace]
+		if !ok {
+			c.report("undefined-command", "error", BoxError{
+				Message:  fmt.Sprintf("namespace '%s' not found", namespace),
+				Location: at,
+				Help:     c.suggestCommand(name, fmt.Sprintf("Import the file that defines it with 'import %s'", namespace)),
+			})
+			return
+		}
+		fn, ok := blocks[fnName]
+		if !ok || fn.Type != FuncBlock {
+			c.report("undefined-command", "error", BoxError{
+				Message:  fmt.Sprintf("function '%s' not found in namespace '%s'", fnName, namespace),
+				Location: at,
+				Help:     c.suggestCommand(name, ""),
+			})
+			return
+		}
+		if fn.HasModifier("-h") {
+			c.report("hidden", "error", BoxError{
+				Message:  fmt.Sprintf("function '%s' is hidden in namespace '%s'", fnName, namespace),
+				Location: at,
+				Help:     "Functions marked -h can only be called inside the file that defines them",
+			})
+			return
+		}
+		c.arity(fn, name, len(args), at)
+		c.returns(fn, f)
+		return
+	}
+
+	c.report("undefined-command", "error", BoxError{
+		Message:  fmt.Sprintf("unknown command: %s", name),
+		Location: at,
+		Help:     c.suggestCommand(name, fmt.Sprintf("'%s' is not a built-in verb. Use 'run %s' for external programs.", name, name)),
+	})
+}
+
+// unqualify strips the file's own namespace, which its functions may use
+// for each other once it is imported
+func (c *checker) unqualify(name string) string {
+	self := strings.TrimSuffix(filepath.Base(c.program.Filename), ".box")
+	if rest, ok := strings.CutPrefix(name, self+"."); ok {
+		if _, imported := c.program.Namespaces[self]; !imported {
+			return rest
+		}
+	}
+	return name
+}
+
+// arity checks a call's argument count against the function header, the
+// way binding the parameters does at run time
+func (c *checker) arity(fn *Block, name string, n int, at Location) {
+	params := fn.Params()
+	if len(params) == 0 {
+		return
+	}
+
+	usage := fmt.Sprintf("Usage: %s %s", name, fn.Signature())
+	if !params[len(params)-1].Variadic && n > len(params) {
+		c.report("arity", "error", BoxError{
+			Message:  fmt.Sprintf("function '%s' takes %d argument(s), got %d", name, len(params), n),
+			Location: at,
+			Help:     usage,
+		})
+		return
+	}
+	for _, param := range params[min(n, len(params)):] {
+		if !param.HasDefault && !param.Variadic {
+			c.report("arity", "error", BoxError{
+				Message:  fmt.Sprintf("function '%s' missing argument '%s'", name, param.Name),
+				Location: at,
+				Help:     usage,
+			})
+			return
+		}
+	}
+}
+
+// returns records what a call leaves in the caller: its result and the
+// variables it exports
+func (c *checker) returns(fn *Block, f *flow) {
+	f.defined["_result"] = true
+	for name := range exports(fn.Body) {
+		f.defined[name] = true
+	}
+}
+
+// suggestCommand returns help naming the closest callable name
+func (c *checker) suggestCommand(name, fallback string) string {
+	var names []string
+	for verb := range c.verbs {
+		names = append(names, verb)
+	}
+	for fn := range c.program.Functions {
+		names = append(names, fn)
+	}
+	for namespace, blocks := range c.program.Namespaces {
+		for fnName, block := range blocks {
+			if block.Type == FuncBlock && !block.HasModifier("-h") {
+				names = append(names, namespace+"."+fnName)
+			}
+		}
+	}
+	slices.Sort(names)
+	if suggestion := Suggest(name, names); suggestion != "" {
+		return fmt.Sprintf("Did you mean '%s'?", suggestion)
+	}
+	return fallback
+}
+
+// control checks if, for and while. It reports whether every path through
+// the structure halts.
+func (c *checker) control(block *Block, f *flow) bool {
+	switch block.Label {
+	case "if", "elif":
+		return c.ifChain(block, f)
+	case "for":
+		c.forLoop(block, f)
+	case "while":
+		c.condition(block, f)
+		loop := f.branch()
+		loop.loops++
+		c.body(block.Body, loop)
+	case "else":
+		return c.body(block.Body, f)
+	}
+	return false
+}
+
+// ifChain checks an if or elif and the branches after it. Afterwards the
+// variables set on every branch that carries on are defined.
+func (c *checker) ifChain(block *Block, f *flow) bool {
+	c.condition(block, f)
+
+	body := block.Body
+	var chain *Block
+	if n := len(body); n > 0 {
+		if next, ok := body[n-1].(Block); ok && (next.Label == "elif" || next.Label == "else") {
+			chain = &next
+			body = body[:n-1]
+		}
+	}
+
+	then := f.branch()
+	thenHalts := c.body(body, then)
+	other := f.branch()
+	otherHalts := false
+	if chain != nil {
+		otherHalts = c.control(chain, other)
+	}
+
+	switch {
+	case thenHalts && otherHalts:
+		return true
+	case thenHalts:
+		f.defined = other.defined
+	case otherHalts:
+		f.defined = then.defined
+	default:
+		f.defined = make(map[string]bool)
+		for name := range then.defined {
+			if other.defined[name] {
+				f.defined[name] = true
+			}
+		}
+	}
+	return false
+}
+
+// forLoop checks a for header and body. The loop may not run, so nothing
+// it sets is defined afterwards.
+func (c *checker) forLoop(block *Block, f *flow) {
+	loop := f.branch()
+	loop.loops++
+	in := forIn(block.Exprs)
+	if in < 0 {
+		header := Location{Line: block.Line, Column: block.Column, Length: len(block.Label)}
+		c.report("invalid-for", "error", *forSyntaxError(c.at(header, f)))
+		c.body(block.Body, loop)
+		return
+	}
+
+	list, pos := block.Exprs[in+1:], block.ExprPos[in+1:]
+	if name, ok := literal(list, 0); ok && list[0].(*LiteralExpr).Quote == 0 && forProducers[name] {
+		c.call(name, list[1:], c.at(pos[0], f), f)
+		list, pos = list[1:], pos[1:]
+	}
+	for i, expr := range list {
+		c.expr(expr, c.at(pos[i], f), false, f)
+	}
+
+	for _, name := range block.Args[:in] {
+		loop.defined[name] = true
+	}
+	c.body(block.Body, loop)
+}
+
+// condition checks the commands of an if, elif or while header
+func (c *checker) condition(block *Block, f *flow) {
+	parser := &conditionParser{block: block}
+	cond, err := parser.parseOr()
+	if err != nil {
+		boxErr := *err.(*BoxError)
+		if boxErr.Location.Line == 0 {
+			boxErr.Location = Location{Line: block.Line, Column: block.Column}
+		}
+		boxErr.Location = c.at(boxErr.Location, f)
+		c.report("invalid-condition", "error", boxErr)
+		return
+	}
+	c.conditionTerm(cond, f)
+}
+
+func (c *checker) conditionTerm(cond *condition, f *flow) {
+	if cond.op != "cmd" {
+		c.conditionTerm(cond.left, f)
+		if cond.right != nil {
+			c.conditionTerm(cond.right, f)
+		}
+		return
+	}
+
+	// A lone variable tests whether it is set
+	if v, ok := cond.args[0].(*VariableExpr); ok && len(cond.args) == 1 {
+		if strings.Contains(v.Name, ".") {
+			c.dataRead(v.Name, c.at(cond.pos[0], f))
+		} else {
+			c.variableParts(v, c.at(cond.pos[0], f), f)
+		}
+		return
+	}
+
+	args, pos := cond.args, cond.pos
+	if name, ok := literal(args, 0); ok {
+		c.call(name, args[1:], c.at(pos[0], f), f)
+		args, pos = args[1:], pos[1:]
+	}
+	for i, arg := range args {
+		c.expr(arg, c.at(pos[i], f), false, f)
+	}
+}
+
+// expr checks the variables, data lookups and substitutions in an
+// expression. Lenient expressions, such as strings, expand an unset
+// variable to nothing instead of failing.
+func (c *checker) expr(expr Expr, at Location, lenient bool, f *flow) {
+	switch v := expr.(type) {
+	case *VariableExpr:
+		c.variable(v, at, lenient, f)
+	case *InterpExpr:
+		for _, part := range v.Parts {
+			c.expr(part, at, true, f)
+		}
+	case *BlockLookupExpr:
+		c.dataRead(v.Path, at)
+	case *CommandSubExpr:
+		c.substitution(v.Command, at, f)
+	}
+}
+
+func (c *checker) variable(v *VariableExpr, at Location, lenient bool, f *flow) {
+	if c.variableParts(v, at, f) {
+		return
+	}
+
+	name := v.Name
+	switch {
+	case name == "":
+		return
+	case strings.Contains(name, "."):
+		c.dataRead(name, at)
+		return
+	case f.defined[name] || specialVariable(name):
+		return
+	}
+
+	// A function may read its caller's variables
+	if f.fn != nil {
+		for block, names := range c.assigned {
+			if block != f.fn && names[name] {
+				return
+			}
+		}
+	}
+	scope := f.fn
+	if scope == nil {
+		scope = c.program.Main
+	}
+	here := c.assigned[scope][name]
+
+	switch {
+	case here && !lenient:
+		c.report("undefined-variable", "warning", BoxError{
+			Message:  fmt.Sprintf("variable '%s' may be used before it is set", name),
+			Location: at,
+			Help:     fmt.Sprintf("'%s' is not set on every path that reaches here", name),
+		})
+	case here:
+	case lenient:
+		c.report("undefined-variable", "warning", BoxError{
+			Message:  fmt.Sprintf("undefined variable: %s", name),
+			Location: at,
+			Help:     c.suggestVariable(name, f, fmt.Sprintf("'$%s' is set nowhere, so it expands to nothing here", name)),
+		})
+	case f.fn != nil:
+		c.report("undefined-variable", "warning", BoxError{
+			Message:  fmt.Sprintf("undefined variable: %s", name),
+			Location: at,
+			Help:     c.suggestVariable(name, f, fmt.Sprintf("'$%s' is set nowhere in this file, so a caller must set it", name)),
+		})
+	default:
+		c.report("undefined-variable", "error", BoxError{
+			Message:  fmt.Sprintf("undefined variable: %s", name),
+			Location: at,
+			Help:     c.suggestVariable(name, f, fmt.Sprintf("Variable '$%s' is not defined. Check spelling or use 'set %s value' to define it.", name, name)),
+		})
+	}
+}
+
+// variableParts checks the index and modifier of a variable. It reports
+// whether the modifier handles the variable being unset.
+func (c *checker) variableParts(v *VariableExpr, at Location, f *flow) bool {
+	if v.Index != nil {
+		c.expr(parseInterpolation(*v.Index, 0, false), at, true, f)
+	}
+	op, arg := splitModifier(v.Modifier)
+	if arg != "" {
+		c.expr(parseInterpolation(arg, 0, false), at, true, f)
+	}
+	return op == "-" || op == ":-" || op == "?" || op == ":?"
+}
+
+// specialVariable reports whether the interpreter sets a variable itself
+func specialVariable(name string) bool {
+	if _, err := strconv.Atoi(name); err == nil {
+		return true // $0, $1, ...
+	}
+	switch name {
+	case "status", "argv", "reply", "_result":
+		return true
+	}
+	return strings.HasPrefix(name, "_") && strings.HasSuffix(name, "_result")
+}
+
+// suggestVariable returns help naming the closest variable known here
+func (c *checker) suggestVariable(name string, f *flow, fallback string) string {
+	known := make(map[string]bool)
+	for defined := range f.defined {
+		known[defined] = true
+	}
+	for _, names := range c.assigned {
+		for assigned := range names {
+			known[assigned] = true
+		}
+	}
+	var names []string
+	for known := range known {
+		names = append(names, known)
+	}
+	slices.Sort(names)
+	if suggestion := Suggest(name, names); suggestion != "" {
+		return fmt.Sprintf("Did you mean '$%s'?", suggestion)
+	}
+	return fallback
+}
+
+// dataBlock resolves block or namespace.block, reporting a missing or
+// hidden one
+func (c *checker) dataBlock(name string, at Location) (*Block, bool) {
+	name = c.unqualify(name)
+	if namespace, blockName, ok := strings.Cut(name, "."); ok {
+		if blocks, ok := c.program.Namespaces[namespace]; ok {
+			block, ok := blocks[blockName]
+			if ok && block.Type == DataBlock {
+				if block.HasModifier("-h") {
+					c.report("hidden", "error", BoxError{
+						Message:  fmt.Sprintf("data block '%s' is hidden in namespace '%s'", blockName, namespace),
+						Location: at,
+						Help:     "Blocks marked -h can only be used inside the file that defines them",
+					})
+					return nil, false
+				}
+				return block, true
+			}
+		}
+	} else if block, ok := c.program.Data[name]; ok {
+		c.dataUsed[name] = true
+		return block, true
+	}
+
+	var names []string
+	for data := range c.program.Data {
+		names = append(names, data)
+	}
+	for namespace, blocks := range c.program.Namespaces {
+		for blockName, block := range blocks {
+			if block.Type == DataBlock && !block.HasModifier("-h") {
+				names = append(names, namespace+"."+blockName)
+			}
+		}
+	}
+	slices.Sort(names)
+	help := fmt.Sprintf("No [data %s] block is defined.", name)
+	if suggestion := Suggest(name, names); suggestion != "" {
+		help = fmt.Sprintf("Did you mean '%s'?", suggestion)
+	}
+	c.report("undefined-data", "error", BoxError{
+		Message:  fmt.Sprintf("undefined data block: %s", name),
+		Location: at,
+		Help:     help,
+	})
+	return nil, false
+}
+
+// dataRead checks a block.field or namespace.block.field lookup
+func (c *checker) dataRead(path string, at Location) {
+	dot := strings.LastIndex(path, ".")
+	blockName, field := path[:dot], path[dot+1:]
+	block, ok := c.dataBlock(blockName, at)
+	if !ok {
+		return
+	}
+
+	fields := dataFields(block)
+	if slices.Contains(fields, field) || c.dataSet[blockName][field] {
+		return
+	}
+	help := fmt.Sprintf("[data %s] has no field '%s'.", blockName, field)
+	if suggestion := Suggest(field, fields); suggestion != "" {
+		help = fmt.Sprintf("Did you mean '%s.%s'?", blockName, suggestion)
+	}
+	c.report("undefined-data", "error", BoxError{
+		Message:  fmt.Sprintf("undefined data field: %s", path),
+		Location: at,
+		Help:     help,
+	})
+}
+
+// dataWrite checks the block of a 'data set block.field' can change
+func (c *checker) dataWrite(path string, at Location) {
+	dot := strings.LastIndex(path, ".")
+	if dot <= 0 {
+		return // Reported when it runs
+	}
+	blockName, field := path[:dot], path[dot+1:]
+	block, ok := c.dataBlock(blockName, at)
+	if !ok {
+		return
+	}
+	if block.HasModifier("-c") {
+		c.report("constant-data", "error", BoxError{
+			Message:  fmt.Sprintf("data set: cannot modify constant data block '%s'", blockName),
+			Location: at,
+			Help:     fmt.Sprintf("'%s' is declared with -c; remove the modifier to allow changes", blockName),
+		})
+		return
+	}
+	if c.dataSet[blockName] == nil {
+		c.dataSet[blockName] = make(map[string]bool)
+	}
+	c.dataSet[blockName][field] = true
+}
+
+// dataFields returns the fields a data block defines
+func dataFields(block *Block) []string {
+	var fields []string
+	for _, item := range block.Body {
+		if cmd, ok := item.(Cmd); ok && len(cmd.Args) > 0 {
+			fields = append(fields, cmd.Verb)
+		}
+	}
+	return fields
+}
+
+// substitution checks the commands inside a $(...). They run in a copy of
+// the scope, so what they set stays inside.
+func (c *checker) substitution(command string, at Location, f *flow) {
+	parser, _ := NewParticleParser(substitutionFile)
+	program, err := parser.ParseString(command)
+	if err != nil || program.Main == nil {
+		return // Reported when it runs
+	}
+	inner := f.branch()
+	inner.sub = &at
+	c.body(program.Main.Body, inner)
+}
+
+// unused reports functions and data blocks nothing refers to. Functions
+// invoked from the command line are used by definition, and a file with
+// no code of its own is a library whose blocks are for importers.
+func (c *checker) unused() {
+	if c.program.Main == nil {
+		return
+	}
+	for _, fn := range c.functions() {
+		if c.called[fn.Label] || fn.HasModifier("-i") {
+			continue
+		}
+		c.report("unused", "warning", BoxError{
+			Message:  fmt.Sprintf("unused function '%s'", fn.Label),
+			Location: Location{Filename: c.program.Filename, Line: fn.Line, Column: fn.Column},
+			Help:     "Nothing calls it; remove it or mark it -i to call it from the command line",
+		})
+	}
+	for name, block := range c.program.Data {
+		if c.dataUsed[name] {
+			continue
+		}
+		c.report("unused", "warning", BoxError{
+			Message:  fmt.Sprintf("unused data block '%s'", name),
+			Location: Location{Filename: c.program.Filename, Line: block.Line, Column: block.Column},
+			Help:     "Nothing reads or sets its fields",
+		})
+	}
+}
+
+// assignments returns the variables a block may set, in any branch
+func assignments(items []interface{}, names map[string]bool) map[string]bool {
+	if names == nil {
+		names = make(map[string]bool)
+	}
+	var visit func(cmd *Cmd)
+	visit = func(cmd *Cmd) {
+		switch cmd.Verb {
+		case "set", "export":
+			if name, ok := literal(cmd.Args, 0); ok {
+				names[name] = true
+			}
+		case "prompt":
+			names["reply"] = true
+		}
+		if cmd.Fallback != nil {
+			visit(cmd.Fallback)
+		}
+	}
+	for _, item := range items {
+		switch v := item.(type) {
+		case Cmd:
+			visit(&v)
+		case Pipeline:
+			for i := range v.Commands {
+				visit(&v.Commands[i])
+			}
+		case Block:
+			if v.Label == "for" {
+				for _, name := range v.Args {
+					if name == "in" {
+						break
+					}
+					names[name] = true
+				}
+			}
+			assignments(v.Body, names)
+		}
+	}
+	return names
+}
+
+// exports returns the variables a function body exports to its caller
+func exports(items []interface{}) map[string]bool {
+	names := make(map[string]bool)
+	var visit func(items []interface{})
+	visit = func(items []interface{}) {
+		for _, item := range items {
+			switch v := item.(type) {
+			case Cmd:
+				if name, ok := literal(v.Args, 0); ok && v.Verb == "export" {
+					names[name] = true
+				}
+			case Block:
+				visit(v.Body)
+			}
+		}
+	}
+	visit(items)
+	return names
+}
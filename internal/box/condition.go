@@ -0,0 +1,205 @@
+package box
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Conditions of if, elif and while are commands combined with 'not', 'and'
+// and 'or', binding in that order:
+//
+//	if not exists build.box
+//	while $queue and not match ${queue[0]} "stop"
+//	if ${argv[1]} or exists default.box
+//
+// A command holds when it exits 0 and a lone variable holds when it has a
+// non-empty element. A command that exits non-zero or fails with an error
+// just makes the condition false; it never triggers fail-fast. Only a
+// command that does not exist is an error.
+
+// condition is a parsed condition: a command, or an operator applied to
+// one or two conditions
+type condition struct {
+	op          string // "cmd", "not", "and" or "or"
+	args        []Expr
+	pos         []Location
+	left, right *condition
+}
+
+// conditionParser turns the expressions of a control header into a
+// condition
+type conditionParser struct {
+	block *Block
+	pos   int
+}
+
+// peek returns the next header word if it is a bare word, which is how
+// the operators are written; a quoted "and" is an ordinary argument
+func (p *conditionParser) peek() string {
+	if p.pos < len(p.block.Exprs) {
+		if lit, ok := p.block.Exprs[p.pos].(*LiteralExpr); ok && lit.Quote == 0 {
+			return lit.Value
+		}
+	}
+	return ""
+}
+
+func (p *conditionParser) parseOr() (*condition, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &condition{op: "or", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *conditionParser) parseAnd() (*condition, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" {
+		p.pos++
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &condition{op: "and", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *conditionParser) parseNot() (*condition, error) {
+	if p.peek() == "not" {
+		p.pos++
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &condition{op: "not", left: operand}, nil
+	}
+
+	start := p.pos
+	for p.pos < len(p.block.Exprs) && p.peek() != "and" && p.peek() != "or" {
+		p.pos++
+	}
+	if p.pos == start {
+		at := p.location(start)
+		if len(p.block.Exprs) == 0 {
+			return nil, &BoxError{Message: fmt.Sprintf("%s: missing condition", p.block.Label), Location: at}
+		}
+		return nil, &BoxError{Message: fmt.Sprintf("%s: missing command in condition", p.block.Label), Location: at}
+	}
+	return &condition{
+		op:   "cmd",
+		args: p.block.Exprs[start:p.pos],
+		pos:  p.block.ExprPos[start:p.pos],
+	}, nil
+}
+
+// location returns where header word i starts, or the end of the header
+// when the words have run out
+func (p *conditionParser) location(i int) Location {
+	if i < len(p.block.ExprPos) {
+		return p.block.ExprPos[i]
+	}
+	if n := len(p.block.ExprPos); n > 0 {
+		last := p.block.ExprPos[n-1]
+		last.Column += last.Length
+		last.Length = 0
+		return last
+	}
+	return Location{Line: p.block.Line, Column: p.block.Column}
+}
+
+// evalCondition evaluates the condition in a control block's header. It is
+// evaluated afresh every time, so while loops see updated variables.
+func (e *Evaluator) evalCondition(block *Block) (bool, error) {
+	parser := &conditionParser{block: block}
+	cond, err := parser.parseOr()
+	if err != nil {
+		if boxErr := err.(*BoxError); boxErr.Location.Filename == "" {
+			boxErr.Location.Filename = e.filename
+		}
+		return false, err
+	}
+	return e.testCondition(cond)
+}
+
+func (e *Evaluator) testCondition(cond *condition) (bool, error) {
+	switch cond.op {
+	case "not":
+		ok, err := e.testCondition(cond.left)
+		return !ok, err
+	case "and", "or":
+		ok, err := e.testCondition(cond.left)
+		if err != nil || ok == (cond.op == "or") {
+			return ok, err
+		}
+		return e.testCondition(cond.right)
+	}
+
+	// A lone variable tests whether it holds anything
+	if len(cond.args) == 1 {
+		if v, ok := cond.args[0].(*VariableExpr); ok {
+			if _, ok := e.scope.Get(v.Name); !ok && !strings.Contains(v.Name, ".") {
+				return false, nil
+			}
+		}
+		switch cond.args[0].(type) {
+		case *VariableExpr, *BlockLookupExpr:
+			val, err := e.evalExpression(cond.args[0])
+			if err != nil {
+				return false, locate(err, cond.pos[0])
+			}
+			for _, item := range val {
+				if item != "" {
+					return true, nil
+				}
+			}
+			return false, nil
+		}
+	}
+
+	verb, err := e.evalExpression(cond.args[0])
+	if err != nil {
+		return false, locate(err, cond.pos[0])
+	}
+
+	cmd := &Cmd{
+		Verb:        verb.String(),
+		Args:        cond.args[1:],
+		ArgPos:      cond.pos[1:],
+		ErrorPolicy: FailFast,
+		Line:        cond.pos[0].Line,
+		Column:      cond.pos[0].Column,
+	}
+	// Errors in the header's own words abort, like in any command
+	var args []Value
+	for i, arg := range cmd.Args {
+		val, err := e.evalExpression(arg)
+		if err != nil {
+			return false, locate(err, e.argLocation(cmd, i))
+		}
+		args = append(args, val)
+	}
+	result := e.runCommand(cmd, args)
+	if result.Error != nil {
+		if !slices.Contains(e.commandNames(), cmd.Verb) {
+			return false, locate(result.Error, cond.pos[0]) // Nothing to call
+		}
+		// A command that fails with an error is false like any other
+		// failure
+		e.updateStatus(Result{Status: max(result.Status, 1)})
+		return false, nil
+	}
+	return result.Status == 0, nil
+}
@@ -7,16 +7,59 @@ import (
 )
 
 type Location struct {
-	Filename string
-	Line     int
-	Column   int
+	Filename string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Length   int    `json:"length,omitempty"` // Columns the offending text spans, 0 when unknown
 }
 
 type BoxError struct {
-	Message  string
-	Location Location
-	Help     string
-	Code     string
+	Message  string   `json:"message"`
+	Location Location `json:"location"`
+	Help     string   `json:"help,omitempty"`
+	Code     string   `json:"code,omitempty"`
+	Stack    []Frame  `json:"stack,omitempty"` // Function calls the error passed through, innermost first
+}
+
+// Frame is one function call on the stack: the function and where it was
+// executing, the call it made or the error itself for the innermost frame
+type Frame struct {
+	Function  string   `json:"function"`
+	Namespace string   `json:"namespace,omitempty"` // Set for functions called through an import
+	Location  Location `json:"location"`
+}
+
+// Name returns the function as it is called, namespace.function for
+// imported ones
+func (f Frame) Name() string {
+	if f.Namespace != "" {
+		return f.Namespace + "." + f.Function
+	}
+	return f.Function
+}
+
+// ErrorList holds the errors found in one pass, such as every parse error
+// in a file, in source order
+type ErrorList []*BoxError
+
+func (l ErrorList) Error() string {
+	messages := make([]string, len(l))
+	for i, err := range l {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Errors returns the errors err carries: each of an ErrorList, a BoxError
+// on its own, or none for other errors
+func Errors(err error) []*BoxError {
+	switch err := err.(type) {
+	case ErrorList:
+		return err
+	case *BoxError:
+		return []*BoxError{err}
+	}
+	return nil
 }
 
 func (e *BoxError) Error() string {
@@ -26,114 +69,216 @@ func (e *BoxError) Error() string {
 	return e.Message
 }
 
+// locate places an error that has no position of its own at at. Stack
+// frames that were running inside a $(...) are placed there too.
+func locate(err error, at Location) error {
+	boxErr, ok := err.(*BoxError)
+	if !ok {
+		return err
+	}
+	if boxErr.Location.Line == 0 {
+		boxErr.Location = at
+	}
+	for i := range boxErr.Stack {
+		if boxErr.Stack[i].Location.Filename == substitutionFile {
+			boxErr.Stack[i].Location = at
+		}
+	}
+	return err
+}
+
+// palette holds the ANSI escapes FormatError styles its parts with. The
+// zero palette leaves the output plain.
+type palette struct {
+	error, warning, help, frame, reset string
+}
+
+var colors = palette{
+	error:   "\033[1;31m",
+	warning: "\033[1;33m",
+	help:    "\033[34m",
+	frame:   "\033[2m",
+	reset:   "\033[0m",
+}
+
+// paint wraps s in the escape, or returns it unchanged without colour
+func (p palette) paint(style, s string) string {
+	if style == "" {
+		return s
+	}
+	return style + s + p.reset
+}
+
+// FormatError renders an error with its source context as plain text
 func FormatError(err *BoxError) string {
+	return formatError(err, palette{})
+}
+
+// FormatErrorColor renders an error like FormatError, with the message and
+// pointer in red and the help in blue for a terminal
+func FormatErrorColor(err *BoxError) string {
+	return formatError(err, colors)
+}
+
+// FormatDiagnostic renders a check diagnostic as plain text. Errors look
+// as they do when the script runs; warnings are marked with ⚠.
+func FormatDiagnostic(d *Diagnostic) string {
+	return formatDiagnostic(d, palette{})
+}
+
+// FormatDiagnosticColor renders a diagnostic like FormatDiagnostic, with
+// warnings in yellow for a terminal
+func FormatDiagnosticColor(d *Diagnostic) string {
+	return formatDiagnostic(d, colors)
+}
+
+func formatDiagnostic(d *Diagnostic, p palette) string {
+	if d.IsError() {
+		return formatError(&d.BoxError, p)
+	}
+	p.error = p.warning
+	return formatErrorMarked(&d.BoxError, p, "⚠")
+}
+
+func formatError(err *BoxError, p palette) string {
+	return formatErrorMarked(err, p, "✗")
+}
+
+// formatErrorMarked renders an error headed by mark, ✗ for errors
+func formatErrorMarked(err *BoxError, p palette, mark string) string {
 	var b strings.Builder
-	
-	b.WriteString("✗ ")
-	b.WriteString(err.Message)
+
+	b.WriteString(p.paint(p.error, mark+" "+err.Message))
 	b.WriteString("\n")
-	
+
 	if err.Location.Filename != "" {
-		b.WriteString(fmt.Sprintf("  ╭─[%s:%d:%d]\n", err.Location.Filename, err.Location.Line, err.Location.Column))
-		
+		if err.Location.Line > 0 {
+			b.WriteString(p.paint(p.frame, fmt.Sprintf("  ╭─[%s:%d:%d]", err.Location.Filename, err.Location.Line, err.Location.Column)))
+		} else {
+			b.WriteString(p.paint(p.frame, fmt.Sprintf("  ╭─[%s]", err.Location.Filename)))
+		}
+		b.WriteString("\n")
+
 		// Try to read source context
 		sourceLines := readSourceContext(err.Location.Filename, err.Location.Line)
 		if len(sourceLines) > 0 {
 			b.WriteString("  │\n")
-			
+
 			// Show context lines (up to 2 before, target line, up to 1 after)
 			startLine := err.Location.Line - 2
 			if startLine < 1 {
 				startLine = 1
 			}
-			
+
 			for i, line := range sourceLines {
 				lineNum := startLine + i
+				b.WriteString(fmt.Sprintf("%3d│ %s\n", lineNum, line))
 				if lineNum == err.Location.Line {
-					// Highlight error line
-					b.WriteString(fmt.Sprintf("%3d│ %s\n", lineNum, line))
-					b.WriteString("  │ ")
-					
-					// Add pointer to column
-					for j := 0; j < err.Location.Column-1; j++ {
-						if j < len(line) && line[j] == '\t' {
-							b.WriteString("\t")
-						} else {
-							b.WriteString(" ")
-						}
-					}
-					b.WriteString("─┬─ here\n")
-					b.WriteString("  │ ")
-					for j := 0; j < err.Location.Column-1; j++ {
-						if j < len(line) && line[j] == '\t' {
-							b.WriteString("\t")
-						} else {
-							b.WriteString(" ")
-						}
-					}
-					b.WriteString(" ╰─ ")
-					b.WriteString(err.Message)
-					b.WriteString("\n")
-				} else {
-					// Context line
-					b.WriteString(fmt.Sprintf("%3d│ %s\n", lineNum, line))
+					// Underline the error under the line
+					writePointer(&b, line, err.Location, err.Message, p)
 				}
 			}
 		} else if err.Code != "" {
 			// Fallback to provided code
 			b.WriteString("  │\n")
 			b.WriteString(fmt.Sprintf("%3d│ %s\n", err.Location.Line, err.Code))
-			b.WriteString("  │ ")
-			
-			// Add pointer to column
-			for i := 0; i < err.Location.Column-1; i++ {
-				b.WriteString(" ")
-			}
-			b.WriteString("─┬─ here\n")
-			b.WriteString("  │ ")
-			for i := 0; i < err.Location.Column-1; i++ {
-				b.WriteString(" ")
-			}
-			b.WriteString(" ╰─ ")
-			b.WriteString(err.Message)
-			b.WriteString("\n")
+			writePointer(&b, err.Code, err.Location, err.Message, p)
 		}
-		
+
 		b.WriteString("  │\n")
-		
+
+		if len(err.Stack) > 0 {
+			writeStack(&b, err.Stack)
+			b.WriteString("  │\n")
+		}
+
 		if err.Help != "" {
-			b.WriteString("  │ 💡 Help: ")
-			b.WriteString(err.Help)
+			b.WriteString("  │ ")
+			b.WriteString(p.paint(p.help, "💡 Help: "+err.Help))
 			b.WriteString("\n")
 			b.WriteString("  │\n")
 		}
+	} else if err.Help != "" {
+		b.WriteString("  ")
+		b.WriteString(p.paint(p.help, "💡 Help: "+err.Help))
+		b.WriteString("\n")
 	}
-	
+
 	return b.String()
 }
 
+// writeStack renders a traceback, innermost call first
+func writeStack(b *strings.Builder, stack []Frame) {
+	// Deep recursion would bury the snippet; show both ends of the stack
+	const keep = 10
+	omitted := 0
+	if len(stack) > 2*keep {
+		omitted = len(stack) - 2*keep
+		stack = append(stack[:keep:keep], stack[len(stack)-keep:]...)
+	}
+
+	b.WriteString("  │ Call stack:\n")
+	for i, frame := range stack {
+		if omitted > 0 && i == keep {
+			b.WriteString(fmt.Sprintf("  │   ... %d more\n", omitted))
+		}
+		b.WriteString(fmt.Sprintf("  │   at %s (%s:%d:%d)\n", frame.Name(), frame.Location.Filename, frame.Location.Line, frame.Location.Column))
+	}
+}
+
+// writePointer underlines the span at loc in line and labels it with the
+// message. Tabs before the column are kept so the pointer lines up.
+func writePointer(b *strings.Builder, line string, loc Location, message string, p palette) {
+	var indent strings.Builder
+	for i, r := range []rune(line) {
+		if i >= loc.Column-1 {
+			break
+		}
+		if r == '\t' {
+			indent.WriteRune('\t')
+		} else {
+			indent.WriteRune(' ')
+		}
+	}
+	for i := len([]rune(line)); i < loc.Column-1; i++ {
+		indent.WriteRune(' ')
+	}
+
+	// The ┬ sits under the first column of the span, as a lone ─┬─ does
+	// when the length is unknown
+	underline := "┬" + strings.Repeat("─", max(loc.Length-1, 1))
+	b.WriteString("  │ ")
+	b.WriteString(indent.String())
+	b.WriteString(p.paint(p.error, "─"+underline+" here"))
+	b.WriteString("\n")
+	b.WriteString("  │ ")
+	b.WriteString(indent.String())
+	b.WriteString(p.paint(p.error, " ╰─ "+message))
+	b.WriteString("\n")
+}
+
 // readSourceContext reads lines around the error location from the source file
 func readSourceContext(filename string, targetLine int) []string {
 	content, err := os.ReadFile(filename)
 	if err != nil {
 		return nil
 	}
-	
+
 	lines := strings.Split(string(content), "\n")
 	if targetLine < 1 || targetLine > len(lines) {
 		return nil
 	}
-	
+
 	// Return up to 5 lines of context (2 before, target, 2 after)
 	start := targetLine - 3 // 1-based to 0-based, then -2 for context
 	if start < 0 {
 		start = 0
 	}
-	
+
 	end := targetLine + 2 // 1-based + 1 for context + 1 for exclusive end
 	if end > len(lines) {
 		end = len(lines)
 	}
-	
+
 	return lines[start:end]
-}
\ No newline at end of file
+}
@@ -4,9 +4,15 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"maps"
 	"os"
+	"path/filepath"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"unicode/utf8"
 )
 
 type Value []string
@@ -29,6 +35,12 @@ type Scope struct {
 	Namespaces       map[string]map[string]*Block // Imported namespaces
 	CurrentNamespace string                       // Current namespace context for function calls
 	Parent           *Scope
+
+	// function marks the scope of a function call, which holds the value
+	// its 'result' verb returns to the caller
+	function  bool
+	result    Value
+	hasResult bool
 }
 
 func NewScope() *Scope {
@@ -54,6 +66,62 @@ func (s *Scope) Set(name string, value Value) {
 	s.Variables[name] = value
 }
 
+// LookupData finds a data block in this scope or its parents
+func (s *Scope) LookupData(name string) (map[string]Value, bool) {
+	if block, ok := s.Data[name]; ok {
+		return block, true
+	}
+	if s.Parent != nil {
+		return s.Parent.LookupData(name)
+	}
+	return nil, false
+}
+
+// variableNames returns the sorted names of the variables visible from
+// this scope
+func (s *Scope) variableNames() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for scope := s; scope != nil; scope = scope.Parent {
+		for name := range scope.Variables {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// dataNames returns the sorted names of the data blocks visible from this
+// scope
+func (s *Scope) dataNames() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for scope := s; scope != nil; scope = scope.Parent {
+		for name := range scope.Data {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// callScope returns the scope of the innermost function call, or nil at
+// the top level
+func (s *Scope) callScope() *Scope {
+	for scope := s; scope != nil; scope = scope.Parent {
+		if scope.function {
+			return scope
+		}
+	}
+	return nil
+}
+
 func (s *Scope) Child() *Scope {
 	return &Scope{
 		Variables:  make(map[string]Value),
@@ -79,18 +147,54 @@ type Result struct {
 	Halt     bool     // Kept for backward compatibility
 	HaltType HaltType // More specific halt reason
 	Error    error
+
+	// Value is the list a command returns to $(...): a verb's result or
+	// what a function passed to 'result'. Nil when it returns none.
+	Value Value
 }
 
 type Evaluator struct {
 	scope    *Scope
 	builtins map[string]BuiltinFunc
 	filename string
+	streams  Streams
+
+	// ownBuiltins is set once builtins is a private copy that host
+	// verbs have been registered in
+	ownBuiltins bool
+
+	// constants names the data blocks declared -c, which can no longer
+	// change once loaded
+	constants map[string]bool
+
+	// imported holds the files whose imports have been loaded, so the
+	// REPL importing one again is a no-op
+	imported map[string]bool
+
+	// strict makes undefined variables and data fields an error inside
+	// strings too, where they would otherwise be empty
+	strict bool
+
+	// stack holds the function calls in progress, outermost first; each
+	// frame's location is where that function was called from
+	stack []Frame
+
+	// stage is the scope of the pipeline stage this evaluator runs in, if
+	// any. Stages run concurrently, so 'data set' there changes a copy of
+	// the block kept in this scope instead of the shared one.
+	stage *Scope
+
+	// Host settings, see host.go
+	env  *environment
+	dir  string
+	root string
 }
 
 func NewEvaluator(scope *Scope) *Evaluator {
 	e := &Evaluator{
 		scope:    scope,
 		builtins: builtins,
+		streams:  processStreams(),
 	}
 	return e
 }
@@ -100,12 +204,158 @@ func NewEvaluatorWithFilename(scope *Scope, filename string) *Evaluator {
 		scope:    scope,
 		builtins: builtins,
 		filename: filename,
+		streams:  processStreams(),
 	}
 	return e
 }
 
+// processStreams returns the process's own stdin, stdout and stderr
+func processStreams() Streams {
+	return Streams{Stdin: os.Stdin, Stdout: os.Stdout, Stderr: os.Stderr}
+}
+
+// SetStreams replaces the streams commands read from and write to, so an
+// embedding host can supply its own readers and writers. Nil streams keep
+// their current value.
+func (e *Evaluator) SetStreams(streams Streams) {
+	if streams.Stdin != nil {
+		e.streams.Stdin = streams.Stdin
+	}
+	if streams.Stdout != nil {
+		e.streams.Stdout = streams.Stdout
+	}
+	if streams.Stderr != nil {
+		e.streams.Stderr = streams.Stderr
+	}
+}
+
+// Streams returns the streams commands currently read from and write to
+func (e *Evaluator) Streams() Streams {
+	return e.streams
+}
+
+// fork returns an evaluator that runs in a child scope with its own
+// streams. Pipeline stages and command substitutions run in forks so they
+// can be redirected, and run concurrently, without touching the parent.
+func (e *Evaluator) fork(streams Streams) *Evaluator {
+	scope := e.scope.Child()
+	scope.CurrentNamespace = e.scope.CurrentNamespace
+
+	return &Evaluator{
+		scope:     scope,
+		builtins:  e.builtins,
+		filename:  e.filename,
+		streams:   streams,
+		constants: e.constants,
+		strict:    e.strict,
+		stack:     slices.Clip(e.stack),
+		stage:     e.stage,
+		env:       e.env,
+		dir:       e.dir,
+		root:      e.root,
+	}
+}
+
 func (e *Evaluator) Eval(program *Program, args []string) Result {
-	// Set command line arguments
+	e.SetArgs(args)
+
+	// Initialize status variable
+	e.scope.Set("status", Value{"0"})
+
+	if result := e.load(program); result.Error != nil {
+		return result
+	}
+
+	// Check for CLI dispatch to -i functions
+	if len(args) > 0 {
+		if fn, exists := program.Functions[args[0]]; exists && fn.HasModifier("-i") && !fn.HasModifier("-h") {
+			return e.callFunction(fn, cliArgs(args[1:]), Location{})
+		}
+		if err := e.unknownCommand(program, args[0]); err != nil {
+			return Result{Error: err}
+		}
+	}
+
+	// Execute main block if it exists
+	if program.Main != nil {
+		if program.Main.HasModifier("-s") {
+			e.strict = true
+		}
+		result := e.evalBlock(program.Main)
+		if result.Error != nil || result.Halt {
+			return result
+		}
+	}
+
+	return Result{Status: 0}
+}
+
+// EvalChunk evaluates a program fragment against the evaluator's existing
+// state. Functions, data and imports are added to the scope and any
+// top-level commands run immediately; this is how the REPL feeds each
+// complete input to a long-lived evaluator.
+func (e *Evaluator) EvalChunk(program *Program) Result {
+	if result := e.load(program); result.Error != nil {
+		return result
+	}
+
+	if program.Main != nil {
+		return e.evalBlock(program.Main)
+	}
+
+	return Result{Status: 0}
+}
+
+// Invoke loads a program and calls one of its -i functions directly, the
+// way 'box script name args...' does from the command line.
+func (e *Evaluator) Invoke(program *Program, name string, args []string) Result {
+	e.SetArgs(append([]string{name}, args...))
+	e.scope.Set("status", Value{"0"})
+
+	if result := e.load(program); result.Error != nil {
+		return result
+	}
+
+	fn, exists := program.Functions[name]
+	if !exists {
+		return Result{Error: &BoxError{Message: fmt.Sprintf("unknown function: %s", name)}}
+	}
+	if fn.HasModifier("-h") {
+		return Result{Error: &BoxError{Message: fmt.Sprintf("function %s is hidden", name)}}
+	}
+	if !fn.HasModifier("-i") {
+		return Result{Error: &BoxError{
+			Message: fmt.Sprintf("function %s is not interactive", name),
+			Help:    "Add -i to the function header to allow calling it directly",
+		}}
+	}
+
+	return e.callFunction(fn, cliArgs(args), Location{})
+}
+
+// cliArgs turns command-line arguments into single-element values
+func cliArgs(args []string) []Value {
+	values := make([]Value, len(args))
+	for i, arg := range args {
+		values[i] = Value{arg}
+	}
+	return values
+}
+
+// SetFilename sets the script name used in error locations
+func (e *Evaluator) SetFilename(filename string) {
+	e.filename = filename
+}
+
+// SetStrict turns strict mode on or off, as the 'strict' verb does. In
+// strict mode an undefined variable or data field is an error wherever it
+// is used, including inside strings.
+func (e *Evaluator) SetStrict(strict bool) {
+	e.strict = strict
+}
+
+// SetArgs binds the script arguments to $argv and the positional variables.
+func (e *Evaluator) SetArgs(args []string) {
 	e.scope.Set("argv", Value(args))
 	if len(args) > 0 {
 		e.scope.Set("0", Value{args[0]})
@@ -113,20 +363,51 @@ func (e *Evaluator) Eval(program *Program, args []string) Result {
 	for i, arg := range args {
 		e.scope.Set(strconv.Itoa(i+1), Value{arg})
 	}
+}
 
-	// Initialize status variable
-	e.scope.Set("status", Value{"0"})
+// Scope returns the scope the evaluator is currently running in.
+func (e *Evaluator) Scope() *Scope {
+	return e.scope
+}
+
+// BuiltinNames returns the sorted names of every builtin verb available to
+// the evaluator.
+func (e *Evaluator) BuiltinNames() []string {
+	names := make([]string, 0, len(e.builtins))
+	for name := range e.builtins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
 
+// load registers a program's imports, functions and data blocks in the
+// evaluator's scope without running anything.
+func (e *Evaluator) load(program *Program) Result {
 	// Populate namespaces from imports
 	for namespace, blocks := range program.Namespaces {
+		if e.hostNamespace(namespace) {
+			return Result{Error: &BoxError{
+				Message: fmt.Sprintf("import: namespace '%s' is already provided by the host", namespace),
+				Help:    "Rename the imported file; its namespace comes from the file name",
+			}}
+		}
 		e.scope.Namespaces[namespace] = blocks
 	}
 
 	// Load imported data blocks into namespaced scope
 	for _, imp := range program.Imports {
+		file, err := filepath.Abs(imp.Program.Filename)
+		if err != nil {
+			file = imp.Program.Filename
+		}
+		if e.imported[file] {
+			continue
+		}
+
 		// Create evaluator for imported program to load its data
 		importScope := NewScope()
-		importEvaluator := NewEvaluator(importScope)
+		importEvaluator := NewEvaluatorWithFilename(importScope, imp.Program.Filename)
 
 		// Load data blocks from imported program
 		for i, block := range imp.Program.Blocks {
@@ -141,11 +422,31 @@ func (e *Evaluator) Eval(program *Program, args []string) Result {
 		// Copy loaded data to main scope with namespace prefix
 		for blockName, dataMap := range importScope.Data {
 			namespacedName := imp.Namespace + "." + blockName
+			if e.constants[namespacedName] {
+				return Result{Error: &BoxError{
+					Message: fmt.Sprintf("import: cannot redefine constant data block '%s'", namespacedName),
+					Location: Location{
+						Filename: e.filename,
+						Line:     imp.Line,
+						Column:   imp.Column,
+						Length:   utf8.RuneCountInString(imp.Path),
+					},
+					Help: "Blocks declared with -c are immutable once loaded",
+				}}
+			}
 			e.scope.Data[namespacedName] = dataMap
+			if importEvaluator.constants[blockName] {
+				e.markConstant(namespacedName)
+			}
+		}
+
+		if e.imported == nil {
+			e.imported = make(map[string]bool)
 		}
+		e.imported[file] = true
 	}
 
-	// First pass: collect functions and data blocks
+	// Collect functions and data blocks
 	for i, block := range program.Blocks {
 		if block.Type == FuncBlock {
 			e.scope.Functions[block.Label] = &program.Blocks[i] // Use address from slice
@@ -157,29 +458,18 @@ func (e *Evaluator) Eval(program *Program, args []string) Result {
 		}
 	}
 
-	// Check for CLI dispatch to -i functions
-	if len(args) > 0 {
-		if fn, exists := program.Functions[args[0]]; exists {
-			for _, mod := range fn.Modifiers {
-				if mod.Flag == "-i" {
-					return e.callFunction(fn, args[1:])
-				}
-			}
-		}
-	}
-
-	// Execute main block if it exists
-	if program.Main != nil {
-		result := e.evalBlock(program.Main)
-		if result.Error != nil || result.Halt {
-			return result
-		}
-	}
-
 	return Result{Status: 0}
 }
 
 func (e *Evaluator) loadDataBlock(block *Block) Result {
+	if e.constants[block.Label] {
+		return Result{Error: &BoxError{
+			Message:  fmt.Sprintf("cannot redefine constant data block '%s'", block.Label),
+			Location: Location{Filename: e.filename, Line: block.Line, Column: block.Column},
+			Help:     "Blocks declared with -c are immutable once loaded",
+		}}
+	}
+
 	if e.scope.Data[block.Label] == nil {
 		e.scope.Data[block.Label] = make(map[string]Value)
 	}
@@ -191,10 +481,10 @@ func (e *Evaluator) loadDataBlock(block *Block) Result {
 			if len(cmd.Args) > 0 {
 				key := cmd.Verb
 				var values []string
-				for _, arg := range cmd.Args {
+				for i, arg := range cmd.Args {
 					val, err := e.evalExpression(arg)
 					if err != nil {
-						return Result{Error: err}
+						return Result{Error: locate(err, e.argLocation(&cmd, i))}
 					}
 					values = append(values, val.List()...)
 				}
@@ -203,9 +493,21 @@ func (e *Evaluator) loadDataBlock(block *Block) Result {
 		}
 	}
 
+	if block.HasModifier("-c") {
+		e.markConstant(block.Label)
+	}
+
 	return Result{Status: 0}
 }
 
+// markConstant records that a data block may no longer change
+func (e *Evaluator) markConstant(name string) {
+	if e.constants == nil {
+		e.constants = make(map[string]bool)
+	}
+	e.constants[name] = true
+}
+
 func (e *Evaluator) evalBlock(block *Block) Result {
 	for _, item := range block.Body {
 		switch v := item.(type) {
@@ -253,33 +555,13 @@ func (e *Evaluator) evalControlStructure(block *Block) Result {
 }
 
 func (e *Evaluator) evalIf(block *Block) Result {
-	// Execute condition (the arguments of the if statement)
-	if len(block.Args) == 0 {
-		return Result{Error: &BoxError{Message: "if: missing condition"}}
-	}
-
-	// Create a simple condition command
-	conditionCmd := &Cmd{
-		Verb:        block.Args[0],
-		Args:        []Expr{},
-		ErrorPolicy: FailFast,
-	}
-
-	// Add remaining args as arguments to the condition
-	for i := 1; i < len(block.Args); i++ {
-		arg := block.Args[i]
-		if strings.HasPrefix(arg, "$") {
-			name := strings.TrimPrefix(arg, "$")
-			conditionCmd.Args = append(conditionCmd.Args, &VariableExpr{Name: name})
-		} else {
-			conditionCmd.Args = append(conditionCmd.Args, &LiteralExpr{Value: arg})
-		}
+	ok, err := e.evalCondition(block)
+	if err != nil {
+		return Result{Error: err}
 	}
 
-	condResult := e.evalCommand(conditionCmd)
-
-	// If condition succeeds (status 0), execute if body
-	if condResult.Status == 0 {
+	// If the condition holds, execute if body
+	if ok {
 		for _, item := range block.Body {
 			if nestedBlock, ok := item.(Block); ok && (nestedBlock.Label == "else" || nestedBlock.Label == "elif") {
 				break // Skip else/elif blocks
@@ -325,7 +607,7 @@ func (e *Evaluator) evalIf(block *Block) Result {
 				return e.evalIf(&elifBlock)
 			}
 		}
-		
+
 		// Execute else block if condition failed and no elif matched
 		for _, item := range block.Body {
 			if elseBlock, ok := item.(Block); ok && elseBlock.Label == "else" {
@@ -337,17 +619,55 @@ func (e *Evaluator) evalIf(block *Block) Result {
 	return Result{Status: 0}
 }
 
+// forIn returns where 'in' is in a for header: after one loop variable,
+// or an index and a variable. It returns -1 when the header is not
+// 'for var in list...' or 'for index var in list...'.
+func forIn(exprs []Expr) int {
+	in := 1
+	if len(exprs) > 2 && !isWord(exprs[1], "in") && isWord(exprs[2], "in") {
+		in = 2
+	}
+	if len(exprs) <= in || !isWord(exprs[in], "in") {
+		return -1
+	}
+	for _, name := range exprs[:in] {
+		lit, ok := name.(*LiteralExpr)
+		if !ok || lit.Quote != 0 || strings.ContainsAny(lit.Value, "$.[]") {
+			return -1
+		}
+	}
+	return in
+}
+
+// forSyntaxError reports a for header forIn rejects
+func forSyntaxError(at Location) *BoxError {
+	return &BoxError{
+		Message:  "for: invalid syntax, expected 'for var in list'",
+		Location: at,
+		Help:     "Use 'for item in list...' or 'for index item in list...'",
+	}
+}
+
 func (e *Evaluator) evalFor(block *Block) Result {
-	// Simple for loop implementation
-	// for var in list...
-	if len(block.Args) < 3 || block.Args[1] != "in" {
-		return Result{Error: &BoxError{Message: "for: invalid syntax, expected 'for var in list'"}}
+	in := forIn(block.Exprs)
+	if in < 0 {
+		return Result{Error: forSyntaxError(Location{Filename: e.filename, Line: block.Line, Column: block.Column})}
 	}
+	var indexName string
+	if in == 2 {
+		indexName = block.Args[0]
+	}
+	varName := block.Args[in-1]
 
-	varName := block.Args[0]
-	items := block.Args[2:]
+	items, err := e.forItems(block.Exprs[in+1:], block.ExprPos[in+1:])
+	if err != nil {
+		return Result{Error: err}
+	}
 
-	for _, item := range items {
+	for i, item := range items {
+		if indexName != "" {
+			e.scope.Set(indexName, Value{strconv.Itoa(i)})
+		}
 		e.scope.Set(varName, Value{item})
 
 		for _, bodyItem := range block.Body {
@@ -417,25 +737,97 @@ func (e *Evaluator) evalFor(block *Block) Result {
 	return Result{Status: 0}
 }
 
-func (e *Evaluator) evalWhile(block *Block) Result {
-	for {
-		// Execute condition
-		if len(block.Args) == 0 {
-			break
+// forProducers are the verbs a for list can start with to iterate over
+// what they produce. Any other word, a verb or function name included, is
+// an item; use $(...) to iterate over another command.
+var forProducers = map[string]bool{"glob": true, "range": true}
+
+// forItems evaluates the list of a for loop. Whole-list expressions add
+// every element. When the list starts with a bare 'glob' or 'range', that
+// verb runs and its result value, or else its output lines, are the items.
+func (e *Evaluator) forItems(exprs []Expr, pos []Location) ([]string, error) {
+	if len(exprs) > 0 {
+		if lit, ok := exprs[0].(*LiteralExpr); ok && lit.Quote == 0 && forProducers[lit.Value] {
+			cmd := &Cmd{
+				Verb:        lit.Value,
+				Args:        exprs[1:],
+				ArgPos:      pos[1:],
+				ErrorPolicy: FailFast,
+				Line:        pos[0].Line,
+				Column:      pos[0].Column,
+			}
+			value, output, err := e.capture(func(child *Evaluator) Result {
+				return child.evalCommand(cmd)
+			})
+			if err != nil {
+				return nil, err
+			}
+			if value != nil {
+				return value, nil
+			}
+			if output = strings.TrimSpace(output); output == "" {
+				return nil, nil
+			}
+			return strings.Split(output, "\n"), nil
 		}
+	}
 
-		conditionCmd := &Cmd{
-			Verb:        block.Args[0],
-			Args:        []Expr{},
-			ErrorPolicy: FailFast,
+	var items []string
+	for i, expr := range exprs {
+		val, err := e.evalExpression(expr)
+		if err != nil {
+			return nil, locate(err, pos[i])
 		}
+		items = append(items, val.List()...)
+	}
+	return items, nil
+}
 
-		for i := 1; i < len(block.Args); i++ {
-			conditionCmd.Args = append(conditionCmd.Args, &LiteralExpr{Value: block.Args[i]})
+// commandNames returns every name a command can call from here: verbs,
+// functions, the current file's functions and namespace.function for
+// imports, leaving out hidden functions of other files
+func (e *Evaluator) commandNames() []string {
+	var names []string
+	for name := range e.builtins {
+		names = append(names, name)
+	}
+	root := e.getRootScope()
+	for name := range root.Functions {
+		names = append(names, name)
+	}
+	for namespace, blocks := range root.Namespaces {
+		for name, block := range blocks {
+			if block.Type != FuncBlock {
+				continue
+			}
+			if namespace == e.scope.CurrentNamespace {
+				names = append(names, name)
+			} else if block.HasModifier("-h") {
+				continue
+			}
+			names = append(names, namespace+"."+name)
 		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// suggestCommand returns help for a command name that does not exist,
+// naming the closest one that does
+func (e *Evaluator) suggestCommand(name, fallback string) string {
+	if suggestion := Suggest(name, e.commandNames()); suggestion != "" {
+		return fmt.Sprintf("Did you mean '%s'?", suggestion)
+	}
+	return fallback
+}
 
-		condResult := e.evalCommand(conditionCmd)
-		if condResult.Status != 0 {
+func (e *Evaluator) evalWhile(block *Block) Result {
+	for {
+		ok, err := e.evalCondition(block)
+		if err != nil {
+			return Result{Error: err}
+		}
+		if !ok {
 			break
 		}
 
@@ -507,11 +899,13 @@ func (e *Evaluator) evalWhile(block *Block) Result {
 	return Result{Status: 0}
 }
 
-func (e *Evaluator) callFunction(fn *Block, args []string) Result {
-	return e.callFunctionWithNamespace(fn, args, "")
+func (e *Evaluator) callFunction(fn *Block, args []Value, call Location) Result {
+	return e.callFunctionWithNamespace(fn, args, "", call)
 }
 
-func (e *Evaluator) callFunctionWithNamespace(fn *Block, args []string, namespace string) Result {
+// callFunctionWithNamespace runs a function in a new scope. call is where
+// it was called from and locates argument errors.
+func (e *Evaluator) callFunctionWithNamespace(fn *Block, args []Value, namespace string, call Location) Result {
 	// Create new scope for function call
 	childScope := e.scope.Child()
 	// Copy parent's data to child scope but NOT functions to avoid recursion
@@ -522,44 +916,40 @@ func (e *Evaluator) callFunctionWithNamespace(fn *Block, args []string, namespac
 
 	// Set the current namespace context
 	childScope.CurrentNamespace = namespace
+	childScope.function = true
 
-	oldScope := e.scope
-	e.scope = childScope
-	defer func() { e.scope = oldScope }()
-
-	// Set function arguments
-	for i, argName := range fn.Args {
-		if strings.Contains(argName, "=") {
-			// Handle default values
-			parts := strings.SplitN(argName, "=", 2)
-			name := parts[0]
-			defaultVal := parts[1]
-
-			if i < len(args) {
-				e.scope.Set(name, Value{args[i]})
-			} else {
-				e.scope.Set(name, Value{defaultVal})
-			}
-		} else {
-			// Regular argument
-			if i < len(args) {
-				e.scope.Set(argName, Value{args[i]})
-			}
+	if err := bindParams(childScope, fn, args); err != nil {
+		err.Location = call
+		if len(e.stack) > 0 {
+			err.Stack = e.traceback(call)
 		}
+		return Result{Error: err}
 	}
 
-	// Set remaining args as numbered parameters
-	for i := len(fn.Args); i < len(args); i++ {
-		e.scope.Set(strconv.Itoa(i+1), Value{args[i]})
+	oldScope, oldStrict, oldFilename := e.scope, e.strict, e.filename
+	e.scope = childScope
+	e.strict = e.strict || fn.HasModifier("-s")
+	if fn.Filename != "" {
+		// Imported functions report errors in their own file
+		e.filename = fn.Filename
 	}
+	e.stack = append(e.stack, Frame{Function: fn.Label, Namespace: namespace, Location: call})
+	defer func() {
+		e.scope, e.strict, e.filename = oldScope, oldStrict, oldFilename
+		e.stack = e.stack[:len(e.stack)-1]
+	}()
 
 	result := e.evalBlock(fn)
 
-	// Propagate all variables back to parent scope
-	if oldScope != nil {
-		for name, value := range e.scope.Variables {
-			oldScope.Set(name, value)
-		}
+	// The innermost call an error escapes records the stack
+	if boxErr, ok := result.Error.(*BoxError); ok && boxErr.Stack == nil {
+		boxErr.Stack = e.traceback(boxErr.Location)
+	}
+
+	// Variables stay local; only an explicit result reaches the caller
+	if childScope.hasResult {
+		oldScope.Set("_result", childScope.result)
+		result.Value = childScope.result
 	}
 
 	// Handle return from function properly
@@ -573,9 +963,107 @@ func (e *Evaluator) callFunctionWithNamespace(fn *Block, args []string, namespac
 	return result
 }
 
+// traceback resolves the call stack for an error at at: every function
+// in progress with the place it had reached, innermost first, ending with
+// the top-level code that made the first call
+func (e *Evaluator) traceback(at Location) []Frame {
+	frames := make([]Frame, 0, len(e.stack)+1)
+	for i := len(e.stack) - 1; i >= 0; i-- {
+		frames = append(frames, Frame{Function: e.stack[i].Function, Namespace: e.stack[i].Namespace, Location: at})
+		at = e.stack[i].Location
+	}
+	if at.Line != 0 {
+		frames = append(frames, Frame{Function: "[main]", Location: at})
+	}
+	return frames
+}
+
+// Param is a function parameter declared in an [fn] header: name,
+// name=default, or a variadic name... that takes the remaining arguments
+type Param struct {
+	Name       string
+	Default    string
+	HasDefault bool
+	Variadic   bool
+}
+
+// Params returns the parameters declared in a function header
+func (b *Block) Params() []Param {
+	params := make([]Param, 0, len(b.Args))
+	for _, arg := range b.Args {
+		var param Param
+		if name, def, ok := strings.Cut(arg, "="); ok {
+			param = Param{Name: name, Default: unquoteDefault(def), HasDefault: true}
+		} else if name, ok := strings.CutSuffix(arg, "..."); ok {
+			param = Param{Name: name, Variadic: true}
+		} else {
+			param = Param{Name: arg}
+		}
+		params = append(params, param)
+	}
+	return params
+}
+
+// unquoteDefault strips the quotes from a default such as width="40"
+func unquoteDefault(def string) string {
+	if len(def) >= 2 && (def[0] == '"' || def[0] == '\'') && def[len(def)-1] == def[0] {
+		return def[1 : len(def)-1]
+	}
+	return def
+}
+
+// bindParams binds call arguments to a function's parameters in scope.
+// List arguments stay lists and a variadic parameter collects the rest.
+// A function that declares no parameters takes any arguments as $1, $2, ...
+func bindParams(scope *Scope, fn *Block, args []Value) *BoxError {
+	params := fn.Params()
+	if len(params) == 0 {
+		for i, arg := range args {
+			scope.Set(strconv.Itoa(i+1), arg)
+		}
+		return nil
+	}
+
+	usage := fmt.Sprintf("Usage: %s %s", fn.Label, fn.Signature())
+	variadic := params[len(params)-1].Variadic
+	if !variadic && len(args) > len(params) {
+		return &BoxError{
+			Message: fmt.Sprintf("function '%s' takes %d argument(s), got %d", fn.Label, len(params), len(args)),
+			Help:    usage,
+		}
+	}
+
+	for i, param := range params {
+		switch {
+		case param.Variadic:
+			var rest []string
+			for _, arg := range args[min(i, len(args)):] {
+				rest = append(rest, arg.List()...)
+			}
+			scope.Set(param.Name, Value(rest))
+		case i < len(args):
+			scope.Set(param.Name, args[i])
+		case param.HasDefault:
+			scope.Set(param.Name, Value{param.Default})
+		default:
+			return &BoxError{
+				Message: fmt.Sprintf("function '%s' missing argument '%s'", fn.Label, param.Name),
+				Help:    usage,
+			}
+		}
+	}
+	return nil
+}
+
 // handleNonLocalFunction handles namespaced function calls and builtin commands
 func (e *Evaluator) handleNonLocalFunction(cmd *Cmd, args []Value) Result {
-	if strings.Contains(cmd.Verb, ".") {
+	if builtin, ok := e.builtins[cmd.Verb]; ok {
+		// Builtins, including namespaced verbs registered by the host
+		ctx := e.context()
+		ctx.Location = e.location(cmd)
+		ctx.cmd = cmd
+		return builtin(args, ctx)
+	} else if strings.Contains(cmd.Verb, ".") {
 		// Handle namespaced function calls like "util.helper"
 		parts := strings.Split(cmd.Verb, ".")
 		if len(parts) == 2 {
@@ -584,23 +1072,29 @@ func (e *Evaluator) handleNonLocalFunction(cmd *Cmd, args []Value) Result {
 
 			if namespaceBlocks, exists := e.getRootScope().Namespaces[namespace]; exists {
 				if fn, exists := namespaceBlocks[functionName]; exists {
-					var strArgs []string
-					for _, arg := range args {
-						strArgs = append(strArgs, arg.String())
+					if fn.HasModifier("-h") && e.scope.CurrentNamespace != namespace {
+						return Result{Error: &BoxError{
+							Message:  fmt.Sprintf("function '%s' is hidden in namespace '%s'", functionName, namespace),
+							Location: e.location(cmd),
+							Help:     "Functions marked -h can only be called inside the file that defines them",
+						}}
 					}
-					return e.callFunctionWithNamespace(fn, strArgs, namespace)
+					return e.callFunctionWithNamespace(fn, args, namespace, e.location(cmd))
 				} else {
-					return Result{Error: &BoxError{Message: fmt.Sprintf("function '%s' not found in namespace '%s'", functionName, namespace)}}
+					return Result{Error: &BoxError{
+						Message: fmt.Sprintf("function '%s' not found in namespace '%s'", functionName, namespace),
+						Help:    e.suggestCommand(cmd.Verb, ""),
+					}}
 				}
 			} else {
-				return Result{Error: &BoxError{Message: fmt.Sprintf("namespace '%s' not found", namespace)}}
+				return Result{Error: &BoxError{
+					Message: fmt.Sprintf("namespace '%s' not found", namespace),
+					Help:    e.suggestCommand(cmd.Verb, fmt.Sprintf("Import the file that defines it with 'import %s'", namespace)),
+				}}
 			}
 		} else {
 			return Result{Error: &BoxError{Message: fmt.Sprintf("invalid namespaced function call: %s", cmd.Verb)}}
 		}
-	} else if builtin, ok := e.builtins[cmd.Verb]; ok {
-		// Check for builtin
-		return builtin(args, e.scope)
 	} else {
 		// Unknown command - fail with helpful error
 		return Result{Error: &BoxError{
@@ -610,7 +1104,7 @@ func (e *Evaluator) handleNonLocalFunction(cmd *Cmd, args []Value) Result {
 				Line:     cmd.Line,
 				Column:   cmd.Column,
 			},
-			Help: fmt.Sprintf("'%s' is not a built-in verb. Box only supports internal commands.", cmd.Verb),
+			Help: e.suggestCommand(cmd.Verb, fmt.Sprintf("'%s' is not a built-in verb. Use 'run %s' for external programs.", cmd.Verb, cmd.Verb)),
 		}}
 	}
 }
@@ -618,72 +1112,42 @@ func (e *Evaluator) handleNonLocalFunction(cmd *Cmd, args []Value) Result {
 func (e *Evaluator) evalCommand(cmd *Cmd) Result {
 	// Evaluate arguments
 	var args []Value
-	for _, arg := range cmd.Args {
+	for i, arg := range cmd.Args {
 		val, err := e.evalExpression(arg)
 		if err != nil {
-			result := Result{Error: err}
+			result := Result{Error: locate(err, e.argLocation(cmd, i))}
 			e.updateStatus(result)
 			return result
 		}
 		args = append(args, val)
 	}
+	return e.runCommand(cmd, args)
+}
 
-	// Handle simple output redirections (>, >>, 2>)
-	origStdout := os.Stdout
-	origStderr := os.Stderr
-	var stdoutFile *os.File
-	var stderrFile *os.File
-
-	for _, r := range cmd.Redirects {
-		switch r.Type {
-		case ">":
-			f, err := os.OpenFile(r.Target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
-			if err != nil {
-				res := Result{Error: &BoxError{Message: fmt.Sprintf("redirect: %v", err)}}
-				e.updateStatus(res)
-				return res
-			}
-			os.Stdout = f
-			stdoutFile = f
-		case ">>":
-			f, err := os.OpenFile(r.Target, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-			if err != nil {
-				res := Result{Error: &BoxError{Message: fmt.Sprintf("redirect: %v", err)}}
-				e.updateStatus(res)
-				return res
-			}
-			os.Stdout = f
-			stdoutFile = f
-		case "2>":
-			f, err := os.OpenFile(r.Target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
-			if err != nil {
-				res := Result{Error: &BoxError{Message: fmt.Sprintf("redirect: %v", err)}}
-				e.updateStatus(res)
-				return res
-			}
-			os.Stderr = f
-			stderrFile = f
-		}
+// runCommand runs a command whose arguments are evaluated, applying its
+// redirects and error policy
+func (e *Evaluator) runCommand(cmd *Cmd, args []Value) Result {
+	// Redirections only change this evaluator's streams for the duration
+	// of the command, so functions called from here inherit them
+	streams, closeRedirects, err := e.openRedirects(cmd.Redirects)
+	if err != nil {
+		res := Result{Error: locate(err, e.location(cmd))}
+		e.updateStatus(res)
+		return res
 	}
+	origStreams := e.streams
+	e.streams = streams
 
 	var result Result
 
 	// Check for function call first - look in root scope only to avoid recursion
 	if fn, exists := e.getRootScope().Functions[cmd.Verb]; exists {
-		var strArgs []string
-		for _, arg := range args {
-			strArgs = append(strArgs, arg.String())
-		}
-		result = e.callFunction(fn, strArgs)
+		result = e.callFunction(fn, args, e.location(cmd))
 	} else if e.scope.CurrentNamespace != "" {
 		// Check for function in current namespace context
 		if namespaceBlocks, exists := e.getRootScope().Namespaces[e.scope.CurrentNamespace]; exists {
 			if fn, exists := namespaceBlocks[cmd.Verb]; exists {
-				var strArgs []string
-				for _, arg := range args {
-					strArgs = append(strArgs, arg.String())
-				}
-				result = e.callFunction(fn, strArgs)
+				result = e.callFunctionWithNamespace(fn, args, e.scope.CurrentNamespace, e.location(cmd))
 			} else {
 				result = e.handleNonLocalFunction(cmd, args)
 			}
@@ -694,14 +1158,14 @@ func (e *Evaluator) evalCommand(cmd *Cmd) Result {
 		result = e.handleNonLocalFunction(cmd, args)
 	}
 
-	// Restore stdout/stderr after command execution
-	if stdoutFile != nil {
-		stdoutFile.Close()
-		os.Stdout = origStdout
-	}
-	if stderrFile != nil {
-		stderrFile.Close()
-		os.Stderr = origStderr
+	// Restore streams after command execution
+	e.streams = origStreams
+	closeRedirects()
+
+	// Errors from verbs that did not say where they happened are placed
+	// at the command
+	if result.Error != nil {
+		result.Error = locate(result.Error, e.location(cmd))
 	}
 
 	// Update status after command execution
@@ -736,10 +1200,87 @@ func (e *Evaluator) evalCommand(cmd *Cmd) Result {
 	return result
 }
 
+// openRedirects applies redirections (>, >>, 2>) on top of the evaluator's
+// streams. The returned function closes any files that were opened.
+func (e *Evaluator) openRedirects(redirects []Redirect) (Streams, func(), error) {
+	streams := e.streams
+	var files []*os.File
+	closeAll := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+
+	for _, r := range redirects {
+		flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		if r.Type == ">>" {
+			flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		}
+
+		var target string
+		var err error
+		if r.Expr != nil {
+			var val Value
+			val, err = e.evalExpression(r.Expr)
+			target = val.String()
+		} else {
+			target, err = e.interpolate(r.Target)
+		}
+		if err != nil {
+			closeAll()
+			return e.streams, nil, locate(err, e.at(r.Pos))
+		}
+		path, err := e.context().Path(target)
+		if err != nil {
+			closeAll()
+			return e.streams, nil, &BoxError{Message: fmt.Sprintf("redirect: %v", err), Location: e.at(r.Pos)}
+		}
+		f, err := os.OpenFile(path, flags, 0644)
+		if err != nil {
+			closeAll()
+			return e.streams, nil, &BoxError{Message: fmt.Sprintf("redirect: %v", err), Location: e.at(r.Pos)}
+		}
+		files = append(files, f)
+
+		if r.Type == "2>" {
+			streams.Stderr = f
+		} else {
+			streams.Stdout = f
+		}
+	}
+
+	return streams, closeAll, nil
+}
+
 func (e *Evaluator) updateStatus(result Result) {
 	e.scope.Set("status", Value{strconv.Itoa(result.Status)})
 }
 
+// location returns where a command is in the script being run, spanning
+// its verb
+func (e *Evaluator) location(cmd *Cmd) Location {
+	return Location{Filename: e.filename, Line: cmd.Line, Column: cmd.Column, Length: utf8.RuneCountInString(cmd.Verb)}
+}
+
+// argLocation returns where argument i of a command is written, or the
+// command's location when the parser did not record it
+func (e *Evaluator) argLocation(cmd *Cmd, i int) Location {
+	if i < len(cmd.ArgPos) {
+		return e.at(cmd.ArgPos[i])
+	}
+	return e.location(cmd)
+}
+
+// at places a parsed position in the file being run. Unknown positions
+// stay unknown, so locate can fill them in later.
+func (e *Evaluator) at(pos Location) Location {
+	if pos.Line == 0 {
+		return Location{}
+	}
+	pos.Filename = e.filename
+	return pos
+}
+
 func (e *Evaluator) getRootScope() *Scope {
 	scope := e.scope
 	for scope.Parent != nil {
@@ -748,284 +1289,72 @@ func (e *Evaluator) getRootScope() *Scope {
 	return scope
 }
 
-func (e *Evaluator) expandVariables(text string) string {
-	// Handle command substitution $(...) patterns first
-	result := text
-
-	// Handle $(...) patterns
-	for {
-		start := strings.Index(result, "$(")
-		if start == -1 {
-			break
-		}
-
-		// Find matching closing parenthesis
-		depth := 1
-		end := start + 2
-		for end < len(result) && depth > 0 {
-			if result[end] == '(' {
-				depth++
-			} else if result[end] == ')' {
-				depth--
-			}
-			if depth > 0 {
-				end++
-			}
-		}
-
-		if depth == 0 {
-			commandStr := result[start+2 : end]
-
-			// Execute command substitution
-			value, err := e.executeCommandSubstitution(commandStr)
-			var replacement string
-			if err == nil {
-				replacement = value.String()
+// lookupData finds a data block by name, either block or namespace.block,
+// and returns it with the name it is stored under. Inside an imported
+// function an unqualified name also finds the blocks of its own file, and
+// hidden blocks are only visible from that file.
+func (e *Evaluator) lookupData(name string) (string, map[string]Value, error) {
+	if dot := strings.Index(name, "."); dot != -1 {
+		namespace, blockName := name[:dot], name[dot+1:]
+		if e.isHidden(namespace, blockName) && e.scope.CurrentNamespace != namespace {
+			return "", nil, &BoxError{
+				Message: fmt.Sprintf("data block '%s' is hidden in namespace '%s'", blockName, namespace),
+				Help:    "Blocks marked -h can only be used inside the file that defines them",
 			}
-
-			result = result[:start] + replacement + result[end+1:]
-		} else {
-			break // Unmatched parentheses
 		}
 	}
 
-	// Handle ${...} patterns
-	for {
-		start := strings.Index(result, "${")
-		if start == -1 {
-			break
-		}
-
-		end := strings.Index(result[start:], "}")
-		if end == -1 {
-			break
-		}
-		end += start
-
-		varPath := result[start+2 : end]
-		var replacement string
-
-		if strings.Contains(varPath, ".") {
-			// Header lookup like ${config.name} or namespaced ${namespace.block.field}
-			parts := strings.Split(varPath, ".")
-			if len(parts) >= 2 {
-				if len(parts) == 2 {
-					// Simple case: ${block.field}
-					blockName := parts[0]
-					fieldName := parts[1]
-
-					scope := e.scope
-					for scope != nil {
-						if block, ok := scope.Data[blockName]; ok {
-							if val, ok := block[fieldName]; ok {
-								replacement = val.String()
-								break
-							}
-						}
-						scope = scope.Parent
-					}
-				} else if len(parts) == 3 {
-					// Namespaced case: ${namespace.block.field}
-					namespace := parts[0]
-					blockName := parts[1]
-					fieldName := parts[2]
-
-					// Look for namespaced data block
-					namespacedBlockName := namespace + "." + blockName
-					scope := e.scope
-					for scope != nil {
-						if block, ok := scope.Data[namespacedBlockName]; ok {
-							if val, ok := block[fieldName]; ok {
-								replacement = val.String()
-								break
-							}
-						}
-						scope = scope.Parent
-					}
-				}
-			}
-		} else {
-			// Regular variable like ${var} or ${var[*]} or ${var[index]}
-			if strings.Contains(varPath, "[") && strings.Contains(varPath, "]") {
-				// Handle array syntax ${var[*]} or ${var[2]}
-				bracketStart := strings.Index(varPath, "[")
-				bracketEnd := strings.Index(varPath, "]")
-				if bracketStart < bracketEnd {
-					varName := varPath[:bracketStart]
-					indexStr := varPath[bracketStart+1 : bracketEnd]
-
-					if val, ok := e.scope.Get(varName); ok {
-						if indexStr == "*" {
-							// Return all elements joined with spaces
-							replacement = strings.Join(val.List(), " ")
-						} else if idx, err := strconv.Atoi(indexStr); err == nil {
-							// Return specific index
-							if idx >= 0 && idx < len(val.List()) {
-								replacement = val.List()[idx]
-							}
-						}
-					}
-				}
-			} else {
-				// Simple variable like ${var}
-				if val, ok := e.scope.Get(varPath); ok {
-					replacement = val.String()
-				}
-			}
-		}
-
-		result = result[:start] + replacement + result[end+1:]
+	if block, ok := e.scope.LookupData(name); ok {
+		return name, block, nil
 	}
-
-	// Handle $var patterns (simpler case)
-	for {
-		start := strings.Index(result, "$")
-		if start == -1 {
-			break
-		}
-
-		// Find end of variable name
-		end := start + 1
-		for end < len(result) && (result[end] >= 'a' && result[end] <= 'z' ||
-			result[end] >= 'A' && result[end] <= 'Z' ||
-			result[end] >= '0' && result[end] <= '9' ||
-			result[end] == '_') {
-			end++
+	if e.scope.CurrentNamespace != "" {
+		own := e.scope.CurrentNamespace + "." + name
+		if block, ok := e.scope.LookupData(own); ok {
+			return own, block, nil
 		}
+	}
+	return "", nil, nil
+}
 
-		if end > start+1 {
-			varName := result[start+1 : end]
-			var replacement string
-
-			if val, ok := e.scope.Get(varName); ok {
-				replacement = val.String()
-			}
+// writableData returns the data block lookupData found under name, ready
+// for 'data set'. In a pipeline stage that is the stage's own copy, made
+// on the first write, so concurrent stages never write a shared block.
+func (e *Evaluator) writableData(name string, block map[string]Value) map[string]Value {
+	if e.stage == nil {
+		return block
+	}
+	if own, ok := e.stage.Data[name]; ok {
+		return own
+	}
+	own := maps.Clone(block)
+	e.stage.Data[name] = own
+	return own
+}
 
-			result = result[:start] + replacement + result[end:]
-		} else {
-			break
+// isHidden reports whether an imported function or data block is marked -h
+func (e *Evaluator) isHidden(namespace, name string) bool {
+	if blocks, ok := e.getRootScope().Namespaces[namespace]; ok {
+		if block, ok := blocks[name]; ok {
+			return block.HasModifier("-h")
 		}
 	}
-
-	return result
+	return false
 }
 
 func (e *Evaluator) evalExpression(expr Expr) (Value, error) {
 	switch v := expr.(type) {
 	case *LiteralExpr:
-		// Check if this literal contains variable expansions
-		expanded := e.expandVariables(v.Value)
-		return Value{expanded}, nil
+		return Value{v.Value}, nil
 
-	case *VariableExpr:
-		// Handle data block lookups like lock.installed_to or package.lock.installed_to
-		if strings.Contains(v.Name, ".") {
-			parts := strings.Split(v.Name, ".")
-			if len(parts) >= 2 {
-				if len(parts) == 2 {
-					// Simple case: block.field
-					blockName := parts[0]
-					fieldName := parts[1]
-
-					scope := e.scope
-					for scope != nil {
-						if block, ok := scope.Data[blockName]; ok {
-							if val, ok := block[fieldName]; ok {
-								// Apply index if present
-								if v.Index != nil {
-									expandedIndex := e.expandVariables(*v.Index)
-									if expandedIndex == "*" {
-										return val, nil
-									}
-									idx, err := strconv.Atoi(expandedIndex)
-									if err != nil {
-										return Value{}, &BoxError{
-											Message: fmt.Sprintf("invalid array index: %s", expandedIndex),
-										}
-									}
-									if idx < 0 || idx >= len(val) {
-										return Value{}, nil
-									}
-									return Value{val[idx]}, nil
-								}
-								return val, nil
-							}
-						}
-						scope = scope.Parent
-					}
-				} else if len(parts) == 3 {
-					// Namespaced case: namespace.block.field
-					namespace := parts[0]
-					blockName := parts[1]
-					fieldName := parts[2]
-
-					// Look for namespaced data block
-					namespacedBlockName := namespace + "." + blockName
-					scope := e.scope
-					for scope != nil {
-						if block, ok := scope.Data[namespacedBlockName]; ok {
-							if val, ok := block[fieldName]; ok {
-								// Apply index if present
-								if v.Index != nil {
-									expandedIndex := e.expandVariables(*v.Index)
-									if expandedIndex == "*" {
-										return val, nil
-									}
-									idx, err := strconv.Atoi(expandedIndex)
-									if err != nil {
-										return Value{}, &BoxError{
-											Message: fmt.Sprintf("invalid array index: %s", expandedIndex),
-										}
-									}
-									if idx < 0 || idx >= len(val) {
-										return Value{}, nil
-									}
-									return Value{val[idx]}, nil
-								}
-								return val, nil
-							}
-						}
-						scope = scope.Parent
-					}
-				}
-			}
-		}
-
-		// Fall back to regular variable lookup
-		val, ok := e.scope.Get(v.Name)
-		if !ok {
-			return Value{}, &BoxError{
-				Message: fmt.Sprintf("undefined variable: %s", v.Name),
-				Location: Location{
-					Filename: e.filename,
-					// Note: We don't have line/column info here as expressions don't carry location
-				},
-				Help: fmt.Sprintf("Variable '$%s' is not defined. Check spelling or use 'set %s value' to define it.", v.Name, v.Name),
-			}
-		}
-
-		if v.Index != nil {
-			expandedIndex := e.expandVariables(*v.Index)
-			if expandedIndex == "*" {
-				return val, nil
-			}
-			idx, err := strconv.Atoi(expandedIndex)
-			if err != nil {
-				return Value{}, &BoxError{
-					Message: fmt.Sprintf("invalid array index: %s", expandedIndex),
-				}
-			}
-			if idx < 0 || idx >= len(val) {
-				return Value{}, nil
-			}
-			return Value{val[idx]}, nil
+	case *InterpExpr:
+		text, err := e.evalInterp(v)
+		if err != nil {
+			return Value{}, err
 		}
+		return Value{text}, nil
 
-		// Return first element for $var
-		if len(val) > 0 {
-			return Value{val[0]}, nil
-		}
-		return Value{}, nil
+	case *VariableExpr:
+		return e.evalVariable(v, false)
 
 	case *BlockLookupExpr:
 		parts := strings.Split(v.Path, ".")
@@ -1035,24 +1364,16 @@ func (e *Evaluator) evalExpression(expr Expr) (Value, error) {
 			}
 		}
 
-		blockName := parts[0]
-		fieldName := parts[1]
-
-		// Look in current scope and parent scopes
-		scope := e.scope
-		for scope != nil {
-			if block, ok := scope.Data[blockName]; ok {
-				if val, ok := block[fieldName]; ok {
-					return val, nil
-				}
-			}
-			scope = scope.Parent
+		_, block, err := e.lookupData(strings.Join(parts[:len(parts)-1], "."))
+		if err != nil {
+			return Value{}, err
 		}
-
-		return Value{}, &BoxError{
-			Message: fmt.Sprintf("undefined header field: %s", v.Path),
+		if val, ok := block[parts[len(parts)-1]]; ok {
+			return val, nil
 		}
 
+		return Value{}, e.undefined(v.Path)
+
 	case *CommandSubExpr:
 		// Execute the command and capture its output
 		result, err := e.executeCommandSubstitution(v.Command)
@@ -1071,7 +1392,7 @@ func (e *Evaluator) evalExpression(expr Expr) (Value, error) {
 // executeCommandSubstitution parses and executes a command substitution
 func (e *Evaluator) executeCommandSubstitution(commandStr string) (Value, error) {
 	// Parse the command string as a mini Box program
-	parser, err := NewParticleParser("command-substitution")
+	parser, err := NewParticleParser(substitutionFile)
 	if err != nil {
 		return Value{}, &BoxError{
 			Message: fmt.Sprintf("command substitution parser error: %v", err),
@@ -1080,9 +1401,7 @@ func (e *Evaluator) executeCommandSubstitution(commandStr string) (Value, error)
 
 	program, err := parser.ParseString(commandStr)
 	if err != nil {
-		return Value{}, &BoxError{
-			Message: fmt.Sprintf("command substitution parse error: %v", err),
-		}
+		return Value{}, substitutionError("command substitution parse error", err)
 	}
 
 	// Execute the program and capture its output
@@ -1090,8 +1409,58 @@ func (e *Evaluator) executeCommandSubstitution(commandStr string) (Value, error)
 		return Value{""}, nil
 	}
 
-	// Create a child scope for the command substitution
-	childScope := e.scope.Child()
+	// A single command that returns a value, such as a verb like len or a
+	// function using 'result', yields that value; anything else yields its
+	// output lines.
+	value, output, err := e.capture(func(child *Evaluator) Result {
+		child.filename = substitutionFile
+		if cmd, ok := program.Main.Body[0].(Cmd); ok && len(program.Main.Body) == 1 {
+			return child.evalCommand(&cmd)
+		}
+		return child.evalBlock(program.Main)
+	})
+	if err != nil {
+		return Value{}, substitutionError("command substitution execution error", err)
+	}
+	if value != nil {
+		return value, nil
+	}
+
+	// Process output - split by lines and trim
+	outputStr := strings.TrimSpace(output)
+	if outputStr == "" {
+		return Value{""}, nil
+	}
+
+	lines := strings.Split(outputStr, "\n")
+	return Value(lines), nil
+}
+
+// substitutionFile names the text of a $(...) while it is parsed
+const substitutionFile = "command-substitution"
+
+// substitutionError wraps an error from inside $(...). Positions within
+// the substituted text mean nothing in the script, so such errors are left
+// unlocated for the enclosing argument to claim; errors from the functions
+// it called keep their place.
+func substitutionError(prefix string, err error) error {
+	if errs := Errors(err); len(errs) > 0 {
+		boxErr := errs[0]
+		wrapped := &BoxError{Message: prefix + ": " + boxErr.Message, Help: boxErr.Help, Stack: boxErr.Stack}
+		if boxErr.Location.Filename != substitutionFile {
+			wrapped.Location = boxErr.Location
+		}
+		return wrapped
+	}
+	return &BoxError{Message: fmt.Sprintf("%s: %v", prefix, err)}
+}
+
+// capture runs a command in a fork whose stdout is captured. It returns the
+// command's result value, or nil and the output when it has none.
+func (e *Evaluator) capture(run func(child *Evaluator) Result) (Value, string, error) {
+	var buf bytes.Buffer
+	childEvaluator := e.fork(Streams{Stdin: e.streams.Stdin, Stdout: &buf, Stderr: e.streams.Stderr})
+	childScope := childEvaluator.scope
 
 	// Copy parent variables to child scope
 	for name, value := range e.scope.Variables {
@@ -1110,53 +1479,15 @@ func (e *Evaluator) executeCommandSubstitution(commandStr string) (Value, error)
 		childScope.Namespaces[name] = blocks
 	}
 
-	childEvaluator := NewEvaluator(childScope)
-
-	// Capture stdout without forwarding to the parent
-	originalStdout := os.Stdout
-
-	r, w, err := os.Pipe()
-	if err != nil {
-		return Value{}, &BoxError{
-			Message: fmt.Sprintf("command substitution pipe error: %v", err),
-		}
-	}
-
-	os.Stdout = w
-
-	var buf bytes.Buffer
-	done := make(chan struct{})
-	go func() {
-		io.Copy(&buf, r)
-		close(done)
-	}()
-
-	// Execute the command
-	result := childEvaluator.evalBlock(program.Main)
-
-	// Close write end and restore stdout
-	w.Close()
-	os.Stdout = originalStdout
-	<-done
-	r.Close()
-
+	result := run(childEvaluator)
 	if result.Error != nil {
-		return Value{}, &BoxError{
-			Message: fmt.Sprintf("command substitution execution error: %v", result.Error),
-		}
+		return nil, "", result.Error
 	}
-
-	// Process output - split by lines and trim
-	outputStr := strings.TrimSpace(buf.String())
-	if outputStr == "" {
-		return Value{""}, nil
-	}
-
-	lines := strings.Split(outputStr, "\n")
-	return Value(lines), nil
+	return result.Value, buf.String(), nil
 }
 
-// evalPipeline executes a pipeline of commands and collects exit codes into $status
+// evalPipeline runs every stage of a pipeline concurrently, each with its
+// own stdin/stdout, and collects the exit codes in order into $status
 func (e *Evaluator) evalPipeline(pipeline *Pipeline) Result {
 	if len(pipeline.Commands) == 0 {
 		return Result{Status: 0}
@@ -1169,91 +1500,91 @@ func (e *Evaluator) evalPipeline(pipeline *Pipeline) Result {
 		return result
 	}
 
-	// Create pipes between commands
-	var pipes []*os.File
+	// Create n-1 OS pipes for n commands so external programs get real
+	// file descriptors and stream without buffering in the interpreter
 	var readers []*os.File
-
-	// Create n-1 pipes for n commands
+	var writers []*os.File
 	for i := 0; i < len(pipeline.Commands)-1; i++ {
 		r, w, err := os.Pipe()
 		if err != nil {
+			for j := range readers {
+				readers[j].Close()
+				writers[j].Close()
+			}
 			return Result{Error: &BoxError{
 				Message: fmt.Sprintf("pipeline: failed to create pipe: %v", err),
 			}}
 		}
 		readers = append(readers, r)
-		pipes = append(pipes, w)
+		writers = append(writers, w)
 	}
 
-	// Save original stdin/stdout
-	originalStdin := os.Stdin
-	originalStdout := os.Stdout
+	results := make([]Result, len(pipeline.Commands))
+	var wg sync.WaitGroup
 
-	// Collect exit codes for each command in pipeline
-	var exitCodes []string
-	var lastResult Result
+	// Every stage shares stderr, so serialise writes to it
+	stderr := &lockedWriter{w: e.streams.Stderr}
 
-	// Execute commands in pipeline
-	for i, cmd := range pipeline.Commands {
-		// Set up stdin for this command
+	for i := range pipeline.Commands {
+		// Stages run in forks so they get their own streams and keep
+		// variables they set local to the stage
+		streams := Streams{Stdin: e.streams.Stdin, Stdout: e.streams.Stdout, Stderr: stderr}
 		if i > 0 {
-			os.Stdin = readers[i-1]
+			streams.Stdin = readers[i-1]
 		}
-
-		// Set up stdout for this command
 		if i < len(pipeline.Commands)-1 {
-			os.Stdout = pipes[i]
-		} else {
-			// Last command outputs to original stdout
-			os.Stdout = originalStdout
-		}
-
-		// Execute the command
-		result := e.evalCommand(&cmd)
-		lastResult = result
-
-		// Collect exit code (spec: "Each element is a decimal integer")
-		exitCodes = append(exitCodes, strconv.Itoa(result.Status))
-
-		// Close the write end of the pipe for this command
-		if i < len(pipeline.Commands)-1 {
-			pipes[i].Close()
+			streams.Stdout = writers[i]
 		}
-
-		// Continue pipeline execution even if commands fail (collect all exit codes)
-		// Only stop on critical errors
-		if result.Error != nil {
-			// Restore original stdin/stdout
-			os.Stdin = originalStdin
-			os.Stdout = originalStdout
-
-			// Close remaining pipes
-			for j := i; j < len(pipes); j++ {
-				pipes[j].Close()
+		stage := e.fork(streams)
+		stage.stage = stage.scope
+
+		wg.Add(1)
+		go func(i int, stage *Evaluator) {
+			defer wg.Done()
+			results[i] = stage.evalCommand(&pipeline.Commands[i])
+
+			// Closing our ends lets the next stage see EOF and the
+			// previous one see a broken pipe instead of blocking forever
+			if i < len(writers) {
+				writers[i].Close()
 			}
-			for j := i; j < len(readers); j++ {
-				readers[j].Close()
+			if i > 0 {
+				readers[i-1].Close()
 			}
-
-			// Set collected exit codes in $status before returning error
-			e.scope.Set("status", Value(exitCodes))
-			return result
-		}
+		}(i, stage)
 	}
 
-	// Restore original stdin/stdout
-	os.Stdin = originalStdin
-	os.Stdout = originalStdout
+	wg.Wait()
 
-	// Close all remaining readers
-	for _, r := range readers {
-		r.Close()
+	// Collect exit codes (spec: "Each element is a decimal integer")
+	var exitCodes []string
+	for _, result := range results {
+		exitCodes = append(exitCodes, strconv.Itoa(result.Status))
 	}
 
 	// Set pipeline exit codes in $status array as per spec
 	// "$status = (exit1 exit2 exit3)"
 	e.scope.Set("status", Value(exitCodes))
 
+	// A stage that failed outright is reported ahead of the exit codes
+	for _, result := range results {
+		if result.Error != nil {
+			return result
+		}
+	}
+
 	// Return the status of the last command in the pipeline
-	return lastResult
+	return results[len(results)-1]
+}
+
+// lockedWriter serialises writes from concurrent pipeline stages
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
 }
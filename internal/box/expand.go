@@ -0,0 +1,308 @@
+package box
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Parameter expansion. Inside ${...} a variable or data path can take an
+// index, a length prefix and one modifier:
+//
+//	${x[2]} ${x[-1]}    element, negative counts from the end
+//	${x[1:3]} ${x[:-1]} slice, end exclusive
+//	${#x} ${#x[*]}      length of the first element, number of elements
+//	${f%.c} ${f%%.*}    strip the shortest/longest matching suffix
+//	${f#*/} ${f##*/}    strip the shortest/longest matching prefix
+//	${x:-default}       default when unset or empty (${x-default}: unset)
+//	${x:?message}       error when unset or empty (${x?message}: unset)
+//
+// Patterns are globs whose * also matches '/'. Modifiers apply to every
+// selected element, so ${srcs[*]%.c} strips each one. The same code runs
+// for arguments and for interpolation inside strings.
+
+// evalVariable evaluates a variable expression. In a lenient context, such
+// as interpolation, an unset variable is empty instead of an error unless
+// strict mode is on.
+func (e *Evaluator) evalVariable(v *VariableExpr, lenient bool) (Value, error) {
+	if v.Name == "" {
+		return Value{}, &BoxError{Message: fmt.Sprintf("invalid expansion: %s", v.String())}
+	}
+
+	val, defined, err := e.lookupVariable(v.Name)
+	if err != nil {
+		return Value{}, err
+	}
+
+	op, arg := splitModifier(v.Modifier)
+	if !defined && op == "" && (!lenient || e.strict) {
+		return Value{}, e.undefined(v.Name)
+	}
+
+	// Select elements: $x is the first one, data fields the whole list
+	switch {
+	case v.Index != nil:
+		if val, err = e.indexValue(val, *v.Index); err != nil {
+			return Value{}, err
+		}
+	case !strings.Contains(v.Name, ".") && len(val) > 0:
+		val = Value{val[0]}
+	}
+
+	if v.Length {
+		if v.Modifier != "" {
+			return Value{}, &BoxError{Message: fmt.Sprintf("invalid expansion: %s: length cannot take a modifier", v.String())}
+		}
+		if v.Index != nil && !isSingleIndex(*v.Index) {
+			return Value{strconv.Itoa(len(val))}, nil
+		}
+		return Value{strconv.Itoa(utf8.RuneCountInString(val.String()))}, nil
+	}
+
+	if op == "" {
+		if v.Modifier != "" {
+			return Value{}, &BoxError{
+				Message: fmt.Sprintf("invalid expansion: %s", v.String()),
+				Help:    "Modifiers are %, %%, #, ##, :-, -, :? and ?",
+			}
+		}
+		return val, nil
+	}
+
+	arg, err = e.interpolate(arg)
+	if err != nil {
+		return Value{}, err
+	}
+
+	switch op {
+	case "-", ":-":
+		if !defined || (op == ":-" && isEmpty(val)) {
+			return Value{arg}, nil
+		}
+		return val, nil
+	case "?", ":?":
+		if !defined || (op == ":?" && isEmpty(val)) {
+			if arg == "" {
+				arg = "parameter not set"
+			}
+			return Value{}, &BoxError{
+				Message:  fmt.Sprintf("%s: %s", v.Name, arg),
+				Location: Location{Filename: e.filename},
+			}
+		}
+		return val, nil
+	}
+
+	pattern, err := globRegexp(arg)
+	if err != nil {
+		return Value{}, &BoxError{Message: fmt.Sprintf("invalid pattern in %s: %v", v.String(), err)}
+	}
+	stripped := make(Value, len(val))
+	for i, item := range val {
+		stripped[i] = strip(item, op, pattern)
+	}
+	return stripped, nil
+}
+
+// lookupVariable finds a variable, or a data field written block.field or
+// namespace.block.field
+func (e *Evaluator) lookupVariable(name string) (Value, bool, error) {
+	if strings.Contains(name, ".") {
+		parts := strings.Split(name, ".")
+		if len(parts) == 2 || len(parts) == 3 {
+			_, block, err := e.lookupData(strings.Join(parts[:len(parts)-1], "."))
+			if err != nil {
+				return Value{}, false, err
+			}
+			if val, ok := block[parts[len(parts)-1]]; ok {
+				return val, true, nil
+			}
+		}
+	}
+
+	val, ok := e.scope.Get(name)
+	return val, ok, nil
+}
+
+// undefined returns the error for an unset variable or a missing data
+// field, with the closest name in scope as a suggestion
+func (e *Evaluator) undefined(name string) *BoxError {
+	err := &BoxError{Location: Location{Filename: e.filename}}
+
+	if dot := strings.LastIndex(name, "."); dot != -1 {
+		blockName, field := name[:dot], name[dot+1:]
+		_, block, _ := e.lookupData(blockName)
+		if block == nil {
+			err.Message = fmt.Sprintf("undefined data block: %s", blockName)
+			err.Help = fmt.Sprintf("No [data %s] block is defined.", blockName)
+			if suggestion := Suggest(blockName, e.scope.dataNames()); suggestion != "" {
+				err.Help = fmt.Sprintf("Did you mean '%s.%s'?", suggestion, field)
+			}
+			return err
+		}
+
+		fields := make([]string, 0, len(block))
+		for key := range block {
+			fields = append(fields, key)
+		}
+		slices.Sort(fields)
+		err.Message = fmt.Sprintf("undefined data field: %s", name)
+		err.Help = fmt.Sprintf("[data %s] has no field '%s'.", blockName, field)
+		if suggestion := Suggest(field, fields); suggestion != "" {
+			err.Help = fmt.Sprintf("Did you mean '%s.%s'?", blockName, suggestion)
+		}
+		return err
+	}
+
+	err.Message = fmt.Sprintf("undefined variable: %s", name)
+	err.Help = fmt.Sprintf("Variable '$%s' is not defined. Check spelling or use 'set %s value' to define it.", name, name)
+	if suggestion := Suggest(name, e.scope.variableNames()); suggestion != "" {
+		err.Help = fmt.Sprintf("Did you mean '$%s'?", suggestion)
+	}
+	return err
+}
+
+// indexValue applies an index expression to a list: *, a number that
+// counts from the end when negative, or a start:end slice
+func (e *Evaluator) indexValue(val Value, index string) (Value, error) {
+	expandedIndex, err := e.interpolate(index)
+	if err != nil {
+		return Value{}, err
+	}
+	if expandedIndex == "*" {
+		return val, nil
+	}
+
+	if from, to, ok := strings.Cut(expandedIndex, ":"); ok {
+		start, err := sliceBound(from, 0, len(val))
+		if err != nil {
+			return Value{}, err
+		}
+		end, err := sliceBound(to, len(val), len(val))
+		if err != nil {
+			return Value{}, err
+		}
+		if start >= end {
+			return Value{}, nil
+		}
+		return append(Value{}, val[start:end]...), nil
+	}
+
+	idx, err := strconv.Atoi(expandedIndex)
+	if err != nil {
+		return Value{}, &BoxError{
+			Message: fmt.Sprintf("invalid array index: %s", expandedIndex),
+		}
+	}
+	if idx < 0 {
+		idx += len(val)
+	}
+	if idx < 0 || idx >= len(val) {
+		return Value{}, nil
+	}
+	return Value{val[idx]}, nil
+}
+
+// sliceBound parses one side of a slice, clamped to the list
+func sliceBound(bound string, empty, length int) (int, error) {
+	if bound == "" {
+		return empty, nil
+	}
+	n, err := strconv.Atoi(bound)
+	if err != nil {
+		return 0, &BoxError{Message: fmt.Sprintf("invalid slice bound: %s", bound)}
+	}
+	if n < 0 {
+		n += length
+	}
+	return min(max(n, 0), length), nil
+}
+
+// isSingleIndex reports whether an index selects one element rather than
+// the whole list or a slice
+func isSingleIndex(index string) bool {
+	return index != "*" && !strings.Contains(index, ":")
+}
+
+// splitModifier splits a modifier such as %.c or :-default into its
+// operator and argument. The operator is empty when there is none.
+func splitModifier(modifier string) (string, string) {
+	for _, op := range []string{"%%", "##", ":-", ":?", "%", "#", "-", "?"} {
+		if arg, ok := strings.CutPrefix(modifier, op); ok {
+			return op, arg
+		}
+	}
+	return "", modifier
+}
+
+func isEmpty(val Value) bool {
+	for _, item := range val {
+		if item != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// strip removes the shortest (% and #) or longest (%% and ##) suffix or
+// prefix of s that matches pattern
+func strip(s, op string, pattern *regexp.Regexp) string {
+	// Candidate cut points, shortest match first
+	var cuts []int
+	for i := 0; i <= len(s); i++ {
+		if i == len(s) || utf8.RuneStart(s[i]) {
+			cuts = append(cuts, i)
+		}
+	}
+	if op == "%" || op == "##" {
+		slices.Reverse(cuts)
+	}
+
+	for _, i := range cuts {
+		switch op {
+		case "%", "%%":
+			if pattern.MatchString(s[i:]) {
+				return s[:i]
+			}
+		case "#", "##":
+			if pattern.MatchString(s[:i]) {
+				return s[i:]
+			}
+		}
+	}
+	return s
+}
+
+// globRegexp compiles a glob pattern (*, ? and [...] classes) into an
+// anchored regular expression
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			b.WriteString("(?s:.*)")
+		case '?':
+			b.WriteString("(?s:.)")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end == -1 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
@@ -0,0 +1,282 @@
+package box
+
+import (
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// Canonical formatting. Format prints a parsed program back as source:
+// two spaces of indentation per level of block and control structure,
+// one space between words, [data] values lined up in a column, and
+// single-quoted text that expands nothing in double quotes. Comments stay
+// where they were, and so does a blank line between statements; blank
+// lines at the start and end of a body go.
+
+const indent = "  "
+
+// Format returns program as canonical source. The program must come from
+// the parser, which keeps the text and comments the output is built from.
+func Format(program *Program) string {
+	type topItem struct {
+		line  int
+		print func()
+	}
+
+	pr := &printer{comments: program.Comments}
+	var items []topItem
+	for _, imp := range program.Imports {
+		items = append(items, topItem{imp.Line, func() {
+			pr.line(0, imp.Line, imp.Line, "import "+imp.Path)
+		}})
+	}
+	for i := range program.Blocks {
+		block := &program.Blocks[i]
+		if block.Line == 0 {
+			continue // The implicit main, printed from TopLevel
+		}
+		items = append(items, topItem{block.Line, func() { pr.block(block, 0) }})
+	}
+	for _, item := range program.TopLevel {
+		items = append(items, topItem{statementLocation(item).Line, func() { pr.statement(item, 0) }})
+	}
+	slices.SortStableFunc(items, func(a, b topItem) int { return a.line - b.line })
+
+	for _, item := range items {
+		item.print()
+	}
+	pr.commentsBefore(int(^uint(0)>>1), 0)
+	return pr.b.String()
+}
+
+// FormatSource parses source, without reading the files it imports, and
+// returns it formatted
+func FormatSource(filename, source string) (string, error) {
+	parser, err := NewParticleParser(filename)
+	if err != nil {
+		return "", err
+	}
+	parser.SetResolveImports(false)
+	program, err := parser.ParseString(source)
+	if err != nil {
+		return "", err
+	}
+	return Format(program), nil
+}
+
+type printer struct {
+	b        strings.Builder
+	comments []Comment // Comments not printed yet
+	last     int       // Source line of the last line printed
+	open     bool      // At the start of a body, where blank lines go
+}
+
+// line prints text at depth, after the comments above it. at and end are
+// the source lines text starts and ends on; comments after it on its last
+// line follow it.
+func (pr *printer) line(depth, at, end int, text string) {
+	pr.commentsBefore(at, depth)
+	pr.gap(at)
+	pr.b.WriteString(strings.Repeat(indent, depth))
+	pr.b.WriteString(text)
+	for len(pr.comments) > 0 && pr.comments[0].Line == end {
+		pr.b.WriteString(" " + commentText(pr.comments[0]))
+		pr.comments = pr.comments[1:]
+	}
+	pr.b.WriteString("\n")
+	pr.last = end
+	pr.open = false
+}
+
+// commentsBefore prints the comments on lines before line at depth
+func (pr *printer) commentsBefore(line, depth int) {
+	for len(pr.comments) > 0 && pr.comments[0].Line < line {
+		c := pr.comments[0]
+		pr.comments = pr.comments[1:]
+		pr.gap(c.Line)
+		pr.b.WriteString(strings.Repeat(indent, depth) + commentText(c) + "\n")
+		pr.last = c.Line
+		pr.open = false
+	}
+}
+
+// gap keeps one blank line where the source has any before line
+func (pr *printer) gap(line int) {
+	if !pr.open && pr.last > 0 && line > pr.last+1 {
+		pr.b.WriteString("\n")
+	}
+}
+
+func commentText(c Comment) string {
+	return strings.TrimRight(c.Text, " \t\r")
+}
+
+// block prints a [main], [fn], [data] or other block
+func (pr *printer) block(block *Block, depth int) {
+	pr.line(depth, block.Line, block.Line, header(block))
+	pr.open = true
+	if block.Type == DataBlock {
+		pr.data(block, depth+1)
+	} else {
+		pr.body(block.Body, depth+1)
+	}
+	pr.end(block.EndLine, depth)
+}
+
+// end closes a body, keeping the comments at its foot inside it
+func (pr *printer) end(line, depth int) {
+	pr.commentsBefore(line, depth+1)
+	pr.open = true
+	pr.line(depth, line, line, "end")
+}
+
+// header returns a block header with single spaces between its words
+func header(block *Block) string {
+	var words []string
+	switch block.Type {
+	case MainBlock:
+		words = append(words, "main")
+	case FuncBlock:
+		words = append(words, "fn")
+	case DataBlock:
+		words = append(words, "data")
+	default:
+		// The header words after the name are kept as they are
+		words = append(words, block.Label)
+		words = append(words, block.Args...)
+		return "[" + strings.Join(words, " ") + "]"
+	}
+	for _, mod := range block.Modifiers {
+		words = append(words, mod.Flag)
+	}
+	if block.Type != MainBlock {
+		words = append(words, block.Label)
+	}
+	if block.Type == FuncBlock {
+		words = append(words, block.Args...)
+	}
+	return "[" + strings.Join(words, " ") + "]"
+}
+
+// data prints the entries of a data block with their values in a column
+func (pr *printer) data(block *Block, depth int) {
+	width := 0
+	for _, item := range block.Body {
+		if cmd, ok := item.(Cmd); ok {
+			width = max(width, utf8.RuneCountInString(cmd.Verb))
+		}
+	}
+
+	for _, item := range block.Body {
+		cmd, ok := item.(Cmd)
+		if !ok {
+			pr.statement(item, depth)
+			continue
+		}
+		words := commandWords(&cmd)
+		if len(words) > 1 {
+			words[0] += strings.Repeat(" ", width-utf8.RuneCountInString(cmd.Verb)+1)
+		}
+		pr.line(depth, cmd.Line, commandEnd(&cmd), strings.Join(words, " "))
+	}
+}
+
+func (pr *printer) body(items []interface{}, depth int) {
+	for _, item := range items {
+		pr.statement(item, depth)
+	}
+}
+
+// statement prints a command, pipeline or control structure
+func (pr *printer) statement(item interface{}, depth int) {
+	switch v := item.(type) {
+	case Cmd:
+		pr.line(depth, v.Line, commandEnd(&v), strings.Join(commandWords(&v), " "))
+	case Pipeline:
+		stages := make([]string, len(v.Commands))
+		end := 0
+		for i := range v.Commands {
+			stages[i] = strings.Join(commandWords(&v.Commands[i]), " ")
+			end = max(end, commandEnd(&v.Commands[i]))
+		}
+		pr.line(depth, statementLocation(v).Line, end, strings.Join(stages, " | "))
+	case Block:
+		pr.control(&v, depth)
+	}
+}
+
+// control prints if, while and for, and the elif and else branches that
+// share the if's 'end'
+func (pr *printer) control(block *Block, depth int) {
+	end := block.EndLine
+	for {
+		words := []string{block.Label}
+		for _, text := range block.ExprText {
+			words = append(words, quote(text))
+		}
+		pr.line(depth, block.Line, block.Line, strings.Join(words, " "))
+		pr.open = true
+
+		body := block.Body
+		var next *Block
+		if n := len(body); n > 0 && (block.Label == "if" || block.Label == "elif") {
+			if chain, ok := body[n-1].(Block); ok && (chain.Label == "elif" || chain.Label == "else") {
+				next = &chain
+				body = body[:n-1]
+			}
+		}
+		pr.body(body, depth+1)
+		if next == nil {
+			break
+		}
+		pr.commentsBefore(next.Line, depth+1)
+		pr.open = true
+		block = next
+	}
+	pr.end(end, depth)
+}
+
+// commandWords returns the words of a command as they are printed:
+// arguments, then redirects, then the error policy and fallback
+func commandWords(cmd *Cmd) []string {
+	words := []string{cmd.Verb}
+	for _, text := range cmd.ArgText {
+		words = append(words, quote(text))
+	}
+	for _, redirect := range cmd.Redirects {
+		words = append(words, redirect.Type, quote(redirect.Text))
+	}
+	switch cmd.ErrorPolicy {
+	case IgnoreError:
+		words = append(words, "?")
+	case FallbackOnError, TryFallbackHalt:
+		op := "?"
+		if cmd.ErrorPolicy == TryFallbackHalt {
+			op = "!"
+		}
+		words = append(words, op)
+		if cmd.Fallback != nil {
+			words = append(words, commandWords(cmd.Fallback)...)
+		}
+	}
+	return words
+}
+
+// commandEnd returns the line a command ends on, later than it starts
+// when a string in it spans lines
+func commandEnd(cmd *Cmd) int {
+	return cmd.Line + strings.Count(strings.Join(commandWords(cmd), " "), "\n")
+}
+
+// quote rewrites a single-quoted word in double quotes when nothing in it
+// would expand or need escaping there
+func quote(word string) string {
+	if len(word) < 2 || word[0] != '\'' || word[len(word)-1] != '\'' || strings.Count(word, "'") != 2 {
+		return word
+	}
+	inner := word[1 : len(word)-1]
+	if strings.ContainsAny(inner, "\"\\$`") {
+		return word
+	}
+	return `"` + inner + `"`
+}
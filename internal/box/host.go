@@ -0,0 +1,301 @@
+package box
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Host settings let an embedding application run scripts with their own
+// environment, working directory and filesystem root instead of the
+// process-wide ones. The CLI leaves them unset.
+
+// environment is a private set of environment variables shared by an
+// evaluator and its forks
+type environment struct {
+	mu   sync.RWMutex
+	vars map[string]string
+}
+
+// SetEnv gives the evaluator its own environment. Verbs read and set
+// variables in it and external commands receive it instead of the process
+// environment.
+func (e *Evaluator) SetEnv(vars map[string]string) {
+	env := &environment{vars: make(map[string]string, len(vars))}
+	for key, value := range vars {
+		env.vars[key] = value
+	}
+	e.env = env
+}
+
+// SetDir sets the directory relative paths are resolved against and
+// external commands run in. Without one the process working directory is
+// used and 'cd' changes it. When a root is set, dir is a path inside it.
+func (e *Evaluator) SetDir(dir string) {
+	e.dir = dir
+}
+
+// SetRoot confines every path a verb touches to the directory root: '/'
+// in a script refers to root and neither '..' nor a symbolic link can
+// lead above it. External programs started with 'run' are not confined.
+func (e *Evaluator) SetRoot(root string) error {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("root %s is not a directory", root)
+	}
+	// Paths are checked against the root by prefix, so it must be the
+	// real directory and not a link to it
+	if abs, err = filepath.EvalSymlinks(abs); err != nil {
+		return err
+	}
+
+	e.root = abs
+	if e.dir == "" {
+		e.dir = "/"
+	}
+	return nil
+}
+
+// context builds the Context a verb runs with
+func (e *Evaluator) context() *Context {
+	return &Context{Scope: e.scope, Streams: e.streams, eval: e}
+}
+
+// maxLinks bounds the symbolic links followed while resolving one path,
+// as the kernel does
+const maxLinks = 40
+
+// Path resolves a path given to a verb into a real filesystem path,
+// honouring the evaluator's working directory and root. Under a root,
+// symbolic links are followed here rather than by the system, so none can
+// lead out of it.
+func (c *Context) Path(path string) (string, error) {
+	return c.resolve(path, true)
+}
+
+// resolve is Path for verbs that act on a link itself, such as 'delete',
+// when follow is false: the last element of the path is not followed.
+func (c *Context) resolve(path string, follow bool) (string, error) {
+	e := c.eval
+	if e == nil {
+		return path, nil
+	}
+
+	if e.root != "" {
+		virtual := path
+		if !filepath.IsAbs(virtual) {
+			virtual = filepath.Join(e.dir, virtual)
+		}
+		return e.inRoot(virtual, follow)
+	}
+
+	if e.dir != "" && !filepath.IsAbs(path) {
+		return filepath.Join(e.dir, path), nil
+	}
+	return path, nil
+}
+
+// inRoot maps virtual, a path as a confined script sees it, into the root.
+// Links met on the way are followed as they would be after a chroot: an
+// absolute target starts again at the root and '..' stops there.
+func (e *Evaluator) inRoot(virtual string, follow bool) (string, error) {
+	// Cleaning an absolute path removes any '..' that would escape
+	pending := strings.Split(filepath.Clean("/"+virtual), "/")
+	resolved := "/"
+	links := 0
+	for len(pending) > 0 {
+		part := pending[0]
+		pending = pending[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		if len(pending) == 0 && !follow {
+			resolved = next
+			break
+		}
+		info, err := os.Lstat(filepath.Join(e.root, next))
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxLinks {
+			return "", &os.PathError{Op: "resolve", Path: virtual, Err: syscall.ELOOP}
+		}
+		target, err := os.Readlink(filepath.Join(e.root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+	return filepath.Join(e.root, resolved), nil
+}
+
+// LinkTarget returns what a new symbolic link at the real path link should
+// store to point at target, which is read relative to the link's directory
+// unless absolute. Under a root, the target is resolved inside it and
+// stored relative to the link, so the link reaches the same file for
+// external programs as for verbs.
+func (c *Context) LinkTarget(target, link string) (string, error) {
+	e := c.eval
+	if e == nil || e.root == "" {
+		return target, nil
+	}
+
+	dir := filepath.Dir(link)
+	virtual := target
+	if !filepath.IsAbs(virtual) {
+		virtual = filepath.Join(c.DisplayPath(dir), virtual)
+	}
+	real, err := e.inRoot(virtual, false)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Rel(dir, real)
+}
+
+// Confined reports whether the real path stays inside the root once the
+// system follows its links. Verbs that let the system walk directories
+// themselves, such as 'glob', use it to drop what lies outside.
+func (c *Context) Confined(path string) bool {
+	e := c.eval
+	if e == nil || e.root == "" {
+		return true
+	}
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(e.root, real)
+	return err == nil && !strings.HasPrefix(rel, "..")
+}
+
+// DisplayPath turns a real path back into the form a script sees, so
+// results such as glob matches can be passed to other verbs.
+func (c *Context) DisplayPath(path string) string {
+	e := c.eval
+	if e == nil {
+		return path
+	}
+
+	if e.root != "" {
+		if rel, err := filepath.Rel(e.root, path); err == nil && !strings.HasPrefix(rel, "..") {
+			return filepath.Join("/", rel)
+		}
+		return path
+	}
+
+	if e.dir != "" {
+		if rel, err := filepath.Rel(e.dir, path); err == nil && !strings.HasPrefix(rel, "..") {
+			return rel
+		}
+	}
+	return path
+}
+
+// Dir returns the real directory external commands should run in, or ""
+// for the process working directory.
+func (c *Context) Dir() string {
+	e := c.eval
+	if e == nil || e.dir == "" {
+		return ""
+	}
+	if e.root != "" {
+		return filepath.Join(e.root, filepath.Clean("/"+e.dir))
+	}
+	return e.dir
+}
+
+// Chdir changes the working directory used by later commands
+func (c *Context) Chdir(dir string) error {
+	e := c.eval
+	real, err := c.Path(dir)
+	if err != nil {
+		return err
+	}
+
+	if e == nil || e.dir == "" {
+		return os.Chdir(real)
+	}
+
+	info, err := os.Stat(real)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s: not a directory", dir)
+	}
+
+	if e.root != "" {
+		e.dir = c.DisplayPath(real)
+	} else {
+		e.dir = real
+	}
+	return nil
+}
+
+// Getenv returns an environment variable
+func (c *Context) Getenv(key string) string {
+	if c.eval == nil || c.eval.env == nil {
+		return os.Getenv(key)
+	}
+
+	env := c.eval.env
+	env.mu.RLock()
+	defer env.mu.RUnlock()
+	return env.vars[key]
+}
+
+// Setenv sets an environment variable
+func (c *Context) Setenv(key, value string) error {
+	if c.eval == nil || c.eval.env == nil {
+		return os.Setenv(key, value)
+	}
+
+	env := c.eval.env
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	env.vars[key] = value
+	return nil
+}
+
+// Environ returns the environment as KEY=VALUE pairs. It returns nil when
+// the process environment is in use, which is what exec.Cmd expects to
+// inherit it.
+func (c *Context) Environ() []string {
+	if c.eval == nil || c.eval.env == nil {
+		return nil
+	}
+
+	env := c.eval.env
+	env.mu.RLock()
+	defer env.mu.RUnlock()
+
+	pairs := make([]string, 0, len(env.vars))
+	for key, value := range env.vars {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return pairs
+}
@@ -0,0 +1,193 @@
+package box
+
+import (
+	"strings"
+)
+
+// InterpExpr is a double-quoted string or a word built from adjacent
+// tokens: literal text interleaved with substitutions. It is parsed once,
+// when the script is, and evaluates to a single string.
+type InterpExpr struct {
+	Parts []Expr // *LiteralExpr text, *VariableExpr and *CommandSubExpr, in order
+	Quote rune   // '"' when written in double quotes
+}
+
+func (e *InterpExpr) String() string {
+	var b strings.Builder
+	for i, part := range e.Parts {
+		switch v := part.(type) {
+		case *LiteralExpr:
+			b.WriteString(strings.ReplaceAll(v.Value, "$", `\$`))
+		case *VariableExpr:
+			// Brace the name when the following text would extend it
+			s := v.String()
+			if !strings.HasPrefix(s, "${") && i+1 < len(e.Parts) {
+				if lit, ok := e.Parts[i+1].(*LiteralExpr); ok && lit.Value != "" && (isNameByte(lit.Value[0]) || lit.Value[0] == '[') {
+					s = "${" + v.Name + "}"
+				}
+			}
+			b.WriteString(s)
+		case *CommandSubExpr:
+			b.WriteString("$(" + v.Command + ")")
+		default:
+			b.WriteString(part.String())
+		}
+	}
+	return b.String()
+}
+
+// parseInterpolation splits text into literal parts and substitutions:
+//
+//	$name $name[i] $1   variable, first element or indexed
+//	${...}              expansion with the forms described in expand.go
+//	$(...)              command substitution
+//	\$                  a literal $
+//
+// A $ that starts none of these is literal, as is an unterminated ${ or
+// $(. With escapes set, the double-quote escapes \n \t \r \\ and \" are
+// processed too. Text without substitutions comes back as a *LiteralExpr.
+func parseInterpolation(text string, quote rune, escapes bool) Expr {
+	var parts []Expr
+	var literal strings.Builder
+	flush := func() {
+		if literal.Len() > 0 {
+			parts = append(parts, &LiteralExpr{Value: literal.String(), Quote: quote})
+			literal.Reset()
+		}
+	}
+
+	for i := 0; i < len(text); {
+		c := text[i]
+
+		if c == '\\' && i+1 < len(text) {
+			next := text[i+1]
+			switch {
+			case next == '$':
+				literal.WriteByte('$')
+			case escapes && next == 'n':
+				literal.WriteByte('\n')
+			case escapes && next == 't':
+				literal.WriteByte('\t')
+			case escapes && next == 'r':
+				literal.WriteByte('\r')
+			case escapes && (next == '\\' || next == '"'):
+				literal.WriteByte(next)
+			default:
+				// Unknown escape sequence, keep as-is
+				literal.WriteString(text[i : i+2])
+			}
+			i += 2
+			continue
+		}
+
+		if c != '$' || i+1 == len(text) {
+			literal.WriteByte(c)
+			i++
+			continue
+		}
+
+		var sub Expr
+		end := i + 1
+		switch next := text[i+1]; {
+		case next == '(':
+			if close := matchingClose(text, i+1, '(', ')'); close != -1 {
+				sub = &CommandSubExpr{Command: text[i+2 : close]}
+				end = close + 1
+			}
+		case next == '{':
+			if close := matchingClose(text, i+1, '{', '}'); close != -1 {
+				sub = parseVariable(text[i : close+1])
+				end = close + 1
+			}
+		case next >= '0' && next <= '9':
+			for end < len(text) && text[end] >= '0' && text[end] <= '9' {
+				end++
+			}
+			sub = &VariableExpr{Name: text[i+1 : end]}
+		case next == '_' || next >= 'a' && next <= 'z' || next >= 'A' && next <= 'Z':
+			for end < len(text) && isNameByte(text[end]) && text[end] != '.' {
+				end++
+			}
+			if end < len(text) && text[end] == '[' {
+				if close := strings.IndexByte(text[end:], ']'); close != -1 {
+					end += close + 1
+				}
+			}
+			sub = parseVariable(text[i:end])
+		}
+
+		if sub == nil {
+			literal.WriteByte(c)
+			i++
+			continue
+		}
+		flush()
+		parts = append(parts, sub)
+		i = end
+	}
+	flush()
+
+	switch {
+	case len(parts) == 0:
+		return &LiteralExpr{Quote: quote}
+	case len(parts) == 1:
+		if lit, ok := parts[0].(*LiteralExpr); ok {
+			return lit
+		}
+	}
+	return &InterpExpr{Parts: parts, Quote: quote}
+}
+
+// matchingClose returns the index of the bracket closing the one at open,
+// or -1 when it is unterminated
+func matchingClose(text string, open int, opening, closing byte) int {
+	depth := 0
+	for i := open; i < len(text); i++ {
+		switch text[i] {
+		case opening:
+			depth++
+		case closing:
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// evalInterp evaluates each part and joins them into one string. Lists are
+// joined with spaces; unset variables are empty.
+func (e *Evaluator) evalInterp(expr *InterpExpr) (string, error) {
+	var b strings.Builder
+	for _, part := range expr.Parts {
+		var val Value
+		var err error
+		switch v := part.(type) {
+		case *LiteralExpr:
+			b.WriteString(v.Value)
+			continue
+		case *VariableExpr:
+			val, err = e.evalVariable(v, true)
+		default:
+			val, err = e.evalExpression(part)
+		}
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(strings.Join(val, " "))
+	}
+	return b.String(), nil
+}
+
+// interpolate expands the substitutions in a fragment of text evaluated at
+// run time, such as an index or a modifier's argument
+func (e *Evaluator) interpolate(text string) (string, error) {
+	switch expr := parseInterpolation(text, 0, false).(type) {
+	case *InterpExpr:
+		return e.evalInterp(expr)
+	case *LiteralExpr:
+		return expr.Value, nil
+	}
+	return text, nil
+}
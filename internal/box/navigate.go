@@ -0,0 +1,450 @@
+package box
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// Source navigation, for editors. Definition, Hover and Complete look at
+// the word the cursor is on in the text of its line. Lines count from 1
+// and columns count runes from 1, as in Location.
+
+// Symbol is a function or data block of a program, for an outline
+type Symbol struct {
+	Name     string
+	Kind     string   // "function", "data" or "field"
+	Detail   string   // A function's parameters or a field's value
+	Location Location // Where the header or field is written
+	EndLine  int      // Line of the block's 'end', or the field's own line
+	Children []Symbol // The fields of a data block
+}
+
+// Symbols returns the [fn] and [data] blocks of a program in source order
+func Symbols(program *Program) []Symbol {
+	var symbols []Symbol
+	for i := range program.Blocks {
+		block := &program.Blocks[i]
+		symbol := Symbol{Name: block.Label, Location: blockLocation(block), EndLine: max(block.EndLine, block.Line)}
+		switch block.Type {
+		case FuncBlock:
+			symbol.Kind = "function"
+			symbol.Detail = block.Signature()
+		case DataBlock:
+			symbol.Kind = "data"
+			for _, item := range block.Body {
+				if cmd, ok := item.(Cmd); ok {
+					symbol.Children = append(symbol.Children, Symbol{
+						Name:     cmd.Verb,
+						Kind:     "field",
+						Detail:   strings.Join(cmd.ArgText, " "),
+						Location: Location{Filename: block.Filename, Line: cmd.Line, Column: cmd.Column},
+						EndLine:  cmd.Line,
+					})
+				}
+			}
+		default:
+			continue
+		}
+		symbols = append(symbols, symbol)
+	}
+	slices.SortStableFunc(symbols, func(a, b Symbol) int { return a.Location.Line - b.Location.Line })
+	return symbols
+}
+
+// Definition returns where the function, data block, field or import the
+// cursor is on is defined. An import leads to the start of its file.
+func Definition(program *Program, text string, line, column int) (Location, bool) {
+	if imp := importAt(program, text, line, column); imp != nil {
+		if imp.Program == nil {
+			return Location{}, false
+		}
+		return Location{Filename: imp.Program.Filename, Line: 1, Column: 1}, true
+	}
+
+	ref, ok := referenceAt(text, column)
+	if !ok {
+		return Location{}, false
+	}
+	target, ok := resolve(program, ref)
+	switch {
+	case !ok:
+		return Location{}, false
+	case target.imp != nil:
+		if target.imp.Program == nil {
+			return Location{}, false
+		}
+		return Location{Filename: target.imp.Program.Filename, Line: 1, Column: 1}, true
+	case target.field != nil:
+		return Location{Filename: target.block.Filename, Line: target.field.Line, Column: target.field.Column}, true
+	}
+	return blockLocation(target.block), true
+}
+
+// Hover returns markdown describing what the cursor is on: a verb, a
+// function's parameters and doc comment, a data block or field, or an
+// import
+func Hover(program *Program, text string, line, column int) (string, bool) {
+	if imp := importAt(program, text, line, column); imp != nil {
+		return describeImport(imp), true
+	}
+
+	ref, ok := referenceAt(text, column)
+	if !ok {
+		return "", false
+	}
+	if doc, ok := verbDocs[ref.word]; ok && ref.command && !ref.variable {
+		return codeBlock(doc.usage) + doc.purpose, true
+	}
+	target, ok := resolve(program, ref)
+	switch {
+	case !ok:
+		return "", false
+	case target.imp != nil:
+		return describeImport(target.imp), true
+	case target.field != nil:
+		value := strings.Join(target.field.ArgText, " ")
+		return codeBlock(target.name + "." + target.field.Verb + " " + value), true
+	case target.block.Type == FuncBlock:
+		usage := strings.TrimSpace(target.name + " " + target.block.Signature())
+		return codeBlock(usage) + target.block.Doc, true
+	}
+	return codeBlock(header(target.block)) + target.block.Doc, true
+}
+
+// Completion is a word that can be written where the cursor is
+type Completion struct {
+	Label  string
+	Kind   string // "verb", "function", "keyword", "namespace", "variable", "data" or "field"
+	Detail string
+}
+
+// Complete returns what can be written at the cursor, given the text
+// before it on its line, and the column the completed word starts at.
+// After a $ that is variables and data paths; at the start of a command
+// it is verbs, functions and imported namespaces; after a dot it is the
+// members of the namespace or data block before it.
+func Complete(program *Program, verbs []string, text string, line, column int) ([]Completion, int) {
+	runes := []rune(text)
+	column = min(max(column, 1), len(runes)+1)
+	if strings.HasPrefix(strings.TrimSpace(text), "import ") {
+		return nil, column
+	}
+	ref := referenceBefore(runes, column)
+	head, partial := "", ref.word
+	if dot := strings.LastIndex(ref.word, "."); dot != -1 {
+		head, partial = ref.word[:dot], ref.word[dot+1:]
+	}
+
+	var items []Completion
+	switch {
+	case ref.variable && head == "":
+		items = variables(program, line)
+		for name := range program.Data {
+			items = append(items, Completion{Label: name, Kind: "data"})
+		}
+		for namespace, blocks := range program.Namespaces {
+			if len(importedBlocks(blocks, DataBlock)) > 0 {
+				items = append(items, Completion{Label: namespace, Kind: "namespace"})
+			}
+		}
+	case ref.variable || (!ref.command && head != ""):
+		items = dataMembers(program, head)
+	case ref.command && head == "":
+		for _, verb := range verbs {
+			items = append(items, Completion{Label: verb, Kind: "verb", Detail: verbDocs[verb].usage})
+		}
+		for name, fn := range program.Functions {
+			items = append(items, Completion{Label: name, Kind: "function", Detail: fn.Signature()})
+		}
+		for namespace := range program.Namespaces {
+			items = append(items, Completion{Label: namespace, Kind: "namespace"})
+		}
+		for _, keyword := range []string{"if", "elif", "else", "while", "for", "end"} {
+			items = append(items, Completion{Label: keyword, Kind: "keyword"})
+		}
+	case ref.command:
+		for _, fn := range importedBlocks(program.Namespaces[head], FuncBlock) {
+			items = append(items, Completion{Label: fn.Label, Kind: "function", Detail: fn.Signature()})
+		}
+	}
+
+	items = slices.DeleteFunc(items, func(item Completion) bool { return !strings.HasPrefix(item.Label, partial) })
+	slices.SortFunc(items, func(a, b Completion) int { return strings.Compare(a.Label, b.Label) })
+	items = slices.CompactFunc(items, func(a, b Completion) bool { return a.Label == b.Label })
+	return items, column - utf8.RuneCountInString(partial)
+}
+
+// variables returns the variables a script sets anywhere, the parameters
+// of the function line is in, and those the interpreter sets
+func variables(program *Program, line int) []Completion {
+	names := make(map[string]bool)
+	if program.Main != nil {
+		assignments(program.Main.Body, names)
+	}
+	var items []Completion
+	for _, fn := range program.Functions {
+		assignments(fn.Body, names)
+		if fn.Line <= line && line <= fn.EndLine {
+			for _, param := range fn.Params() {
+				items = append(items, Completion{Label: param.Name, Kind: "variable", Detail: "parameter of " + fn.Label})
+			}
+		}
+	}
+	for _, name := range []string{"status", "argv", "_result"} {
+		names[name] = true
+	}
+	for name := range names {
+		items = append(items, Completion{Label: name, Kind: "variable"})
+	}
+	return items
+}
+
+// dataMembers returns the fields of a data block, or the data blocks of
+// an imported namespace
+func dataMembers(program *Program, head string) []Completion {
+	var items []Completion
+	for _, block := range importedBlocks(program.Namespaces[head], DataBlock) {
+		items = append(items, Completion{Label: block.Label, Kind: "data"})
+	}
+	block, ok := program.Data[head]
+	if namespace, name, found := strings.Cut(head, "."); found {
+		block, ok = program.Namespaces[namespace][name]
+		ok = ok && block.Type == DataBlock && !block.HasModifier("-h")
+	}
+	if ok {
+		for _, item := range block.Body {
+			if cmd, isCmd := item.(Cmd); isCmd {
+				items = append(items, Completion{Label: cmd.Verb, Kind: "field", Detail: strings.Join(cmd.ArgText, " ")})
+			}
+		}
+	}
+	return items
+}
+
+// importedBlocks returns the blocks of a namespace of one type that its
+// importers can use, which leaves out the hidden ones
+func importedBlocks(blocks map[string]*Block, blockType BlockType) []*Block {
+	var found []*Block
+	for _, block := range blocks {
+		if block.Type == blockType && !block.HasModifier("-h") {
+			found = append(found, block)
+		}
+	}
+	return found
+}
+
+// reference is the word the cursor is on: a name, a dotted path or a
+// variable
+type reference struct {
+	word     string // Up to the end of the dotted part the cursor is on
+	more     bool   // Whether the path goes on past word
+	variable bool   // Written after $ or ${
+	command  bool   // In the verb position of a command
+}
+
+// referenceAt returns the word the cursor is on in text, cut after the
+// part of a dotted path the cursor is in
+func referenceAt(text string, column int) (reference, bool) {
+	runes := []rune(text)
+	at := column - 1
+	if at < 0 || at > len(runes) {
+		return reference{}, false
+	}
+	if at == len(runes) || !isReferenceRune(runes[at]) {
+		at-- // Just past the end of a word
+	}
+	if at < 0 || !isReferenceRune(runes[at]) {
+		return reference{}, false
+	}
+	end := at
+	for end < len(runes) && isReferenceRune(runes[end]) && runes[end] != '.' {
+		end++
+	}
+	ref := referenceBefore(runes, end+1)
+	ref.more = end < len(runes) && runes[end] == '.'
+	ref.word = strings.Trim(ref.word, ".")
+	return ref, ref.word != ""
+}
+
+// referenceBefore returns the word that ends just before column
+func referenceBefore(runes []rune, column int) reference {
+	end := column - 1
+	start := end
+	for start > 0 && isReferenceRune(runes[start-1]) {
+		start--
+	}
+	ref := reference{word: string(runes[start:end])}
+
+	prefix := runes[:start]
+	if n := len(prefix); n > 0 && prefix[n-1] == '$' {
+		ref.variable = true
+	} else if n > 1 && prefix[n-1] == '{' && prefix[n-2] == '$' {
+		ref.variable = true
+	}
+	before := strings.TrimSpace(string(prefix))
+	switch {
+	case before == "", before == "if", before == "elif", before == "while":
+		ref.command = true
+	default:
+		ref.command = strings.HasSuffix(before, "|") || strings.HasSuffix(before, "?") || strings.HasSuffix(before, "!")
+	}
+	return ref
+}
+
+// isReferenceRune reports whether r can be part of a name or dotted path
+func isReferenceRune(r rune) bool {
+	return r < utf8.RuneSelf && (isNameByte(byte(r)) || r == '-')
+}
+
+// target is what a reference names
+type target struct {
+	name  string  // The block as it is written, namespace.block for an import's
+	block *Block  // A function or data block
+	field *Cmd    // An entry of the data block
+	imp   *Import // An import, when the reference is its namespace
+}
+
+// resolve finds the function, data block, field or import a reference
+// names. A $variable only names data.
+func resolve(program *Program, ref reference) (target, bool) {
+	first, rest, dotted := strings.Cut(ref.word, ".")
+	if !dotted && !ref.more && (ref.variable || !ref.command) {
+		return target{}, false // A variable, or a word that is not a command
+	}
+	if imp, ok := program.ImportMap[first]; ok {
+		if !dotted {
+			return target{name: first, imp: imp}, true
+		}
+		name, field, _ := strings.Cut(rest, ".")
+		block, ok := program.Namespaces[first][name]
+		if !ok || (ref.variable && block.Type != DataBlock) {
+			return target{}, false
+		}
+		return dataTarget(first+"."+name, block, field)
+	}
+
+	if fn, ok := program.Functions[first]; ok && !dotted && !ref.variable {
+		return target{name: first, block: fn}, true
+	}
+	if block, ok := program.Data[first]; ok {
+		return dataTarget(first, block, rest)
+	}
+	return target{}, false
+}
+
+// dataTarget names a block, or the field of a data block when field is
+// set and exists
+func dataTarget(name string, block *Block, field string) (target, bool) {
+	if field == "" {
+		return target{name: name, block: block}, true
+	}
+	if block.Type != DataBlock {
+		return target{}, false
+	}
+	for _, item := range block.Body {
+		if cmd, ok := item.(Cmd); ok && cmd.Verb == field {
+			return target{name: name, block: block, field: &cmd}, true
+		}
+	}
+	return target{}, false
+}
+
+// importAt returns the import written on line when the cursor is on its
+// path
+func importAt(program *Program, text string, line, column int) *Import {
+	words := strings.Fields(text)
+	if len(words) != 2 || words[0] != "import" {
+		return nil
+	}
+	start := utf8.RuneCountInString(text[:strings.LastIndex(text, words[1])]) + 1
+	if column < start || column > start+utf8.RuneCountInString(words[1]) {
+		return nil
+	}
+	for i := range program.Imports {
+		if program.Imports[i].Line == line {
+			return &program.Imports[i]
+		}
+	}
+	return nil
+}
+
+// describeImport summarises an import's namespace for a hover
+func describeImport(imp *Import) string {
+	text := codeBlock("import " + imp.Path)
+	if imp.Program == nil {
+		return text
+	}
+	var names []string
+	for _, fn := range imp.Program.Functions {
+		if !fn.HasModifier("-h") {
+			names = append(names, "`"+imp.Namespace+"."+fn.Label+"`")
+		}
+	}
+	slices.Sort(names)
+	text += fmt.Sprintf("Namespace `%s` from `%s`", imp.Namespace, imp.Program.Filename)
+	if len(names) > 0 {
+		text += ": " + strings.Join(names, ", ")
+	}
+	return text
+}
+
+// codeBlock fences Box source for markdown
+func codeBlock(source string) string {
+	return "```box\n" + source + "\n```\n"
+}
+
+func blockLocation(block *Block) Location {
+	return Location{Filename: block.Filename, Line: block.Line, Column: block.Column}
+}
+
+// verbDoc is how a core verb is called and what it does. Optional
+// arguments are in brackets.
+type verbDoc struct {
+	usage   string
+	purpose string
+}
+
+var verbDocs = map[string]verbDoc{
+	"arith":    {"arith EXPR…", "Evaluate an integer expression (supports `+ - * / % == != < > <= >=`)."},
+	"break":    {"break", "Leave the nearest loop."},
+	"cat":      {"cat [FILE…]", "Output files, or stdin, to stdout."},
+	"cd":       {"cd DIR", "Change directory."},
+	"continue": {"continue", "Skip to the next loop iteration."},
+	"copy":     {"copy SRC DST", "Copy a file; parent directories are created."},
+	"data":     {"data set BLOCK.FIELD VALUE…", "Change a field of a data block declared without -c."},
+	"delete":   {"delete PATH", "Remove files and directories recursively."},
+	"download": {"download URL DEST [HASH]", "Fetch URL to DEST, optionally verifying its SHA-256 hash."},
+	"echo":     {"echo ARG…", "Print the arguments separated by spaces, then a newline."},
+	"env":      {"env [KEY [VALUE]]", "List, get or set environment variables."},
+	"exists":   {"exists PATH", "Exit 0 if PATH exists, else 1."},
+	"exit":     {"exit [STATUS]", "Terminate the script immediately."},
+	"export":   {"export VAR [VALUE…]", "Assign in the caller's scope, or export the local VAR."},
+	"false":    {"false", "Exit 1."},
+	"glob":     {"glob PATTERN", "Store the matching paths in `_glob_result`."},
+	"hash":     {"hash ITEM", "Store the SHA-256 digest in `_hash_result`."},
+	"join":     {"join SEP LIST…", "Join lists with SEP; the result is in `_join_result`."},
+	"len":      {"len LIST", "Store the length in `_len_result`."},
+	"link":     {"link TARGET LINK", "Create a symbolic link."},
+	"match":    {"match ITEM PAT…", "Exit 0 if ITEM matches any pattern."},
+	"mkdir":    {"mkdir DIR", "Create DIR and its parents; does nothing if it exists."},
+	"mktemp":   {"mktemp [PATTERN]", "Create a temporary directory; its path is in `_mktemp_result`."},
+	"move":     {"move SRC DST", "Rename or move; atomic on the same file system."},
+	"prompt":   {"prompt [MSG]", "Print MSG and read one line into `$reply`."},
+	"range":    {"range [START] END [STEP]", "Integers from START (default 0) up to END, exclusive; the list is in `_range_result`."},
+	"result":   {"result VALUE…", "Set the function's return list; the caller reads `$_result`."},
+	"return":   {"return [STATUS]", "Exit the current function."},
+	"run":      {"run CMD ARG…", "Run an external program and propagate its status."},
+	"set":      {"set VAR VALUE…", "Assign a list to a variable."},
+	"sleep":    {"sleep SECONDS", "Suspend for SECONDS; fractions are allowed."},
+	"spawn":    {"spawn CMD ARG…", "Run an external program in the background; its PID is in `$status`."},
+	"strict":   {"strict [on|off]", "Make undefined variables an error everywhere."},
+	"tar":      {"tar SRC ARCHIVE", "Create a tar archive, compressed by the suffix (gz or zst)."},
+	"test":     {"test EXPR", "Exit 0 if EXPR is non-empty."},
+	"touch":    {"touch FILE", "Create FILE or update its timestamp."},
+	"true":     {"true", "Exit 0, as in `while true`."},
+	"untar":    {"untar ARCHIVE DEST", "Extract a tar archive (gz and zst supported)."},
+	"wait":     {"wait PID", "Block until PID exits; its exit code is in `$status`."},
+	"write":    {"write FILE CONTENT", "Write CONTENT to FILE."},
+}
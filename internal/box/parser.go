@@ -1,11 +1,14 @@
 package box
 
 import (
+	"cmp"
 	"context"
 	"fmt"
 	"os"
+	"slices"
 	"strings"
 	"sync"
+	"unicode/utf8"
 
 	"github.com/alecthomas/participle/v2/lexer"
 )
@@ -36,7 +39,9 @@ type BlockModifier struct {
 type Import struct {
 	Path      string   // Original import path (e.g., "utils/helper.box")
 	Namespace string   // Derived namespace (e.g., "helper")
-	Program   *Program // The imported program
+	Program   *Program // The imported program, nil when imports are not resolved
+	Line      int      // Where the import is written
+	Column    int
 }
 
 // Expr interface for compatibility
@@ -47,6 +52,13 @@ type Expr interface {
 // LiteralExpr for compatibility
 type LiteralExpr struct {
 	Value string
+	Quote rune // ' or " for a quoted literal, 0 for a bare word
+}
+
+// isWord reports whether expr is the bare, unquoted word w
+func isWord(expr Expr, w string) bool {
+	lit, ok := expr.(*LiteralExpr)
+	return ok && lit.Quote == 0 && lit.Value == w
 }
 
 func (e *LiteralExpr) String() string {
@@ -54,15 +66,25 @@ func (e *LiteralExpr) String() string {
 }
 
 type VariableExpr struct {
-	Name  string
-	Index *string // nil for $x, non-nil for ${x[*]} or ${x[2]}
+	Name     string
+	Index    *string // nil for $x, non-nil for ${x[*]}, ${x[2]} or ${x[1:3]}
+	Length   bool    // ${#x}
+	Modifier string  // what follows the name and index, such as %.c or :-default
 }
 
 func (e *VariableExpr) String() string {
-	if e.Index == nil {
+	if e.Index == nil && !e.Length && e.Modifier == "" {
 		return "$" + e.Name
 	}
-	return "${" + e.Name + "[" + *e.Index + "]}"
+	s := "${"
+	if e.Length {
+		s += "#"
+	}
+	s += e.Name
+	if e.Index != nil {
+		s += "[" + *e.Index + "]"
+	}
+	return s + e.Modifier + "}"
 }
 
 type BlockLookupExpr struct {
@@ -84,6 +106,8 @@ func (e *CommandSubExpr) String() string {
 type Cmd struct {
 	Verb        string
 	Args        []Expr
+	ArgPos      []Location // Where each of Args is written
+	ArgText     []string   // Each of Args as written, quotes and all
 	Redirects   []Redirect
 	ErrorPolicy ErrorPolicy
 	Fallback    *Cmd
@@ -100,6 +124,9 @@ type Pipeline struct {
 type Redirect struct {
 	Type   string // >, >>, 2>
 	Target string
+	Expr   Expr     // Target as parsed, evaluated when the command runs
+	Pos    Location // Where the target is written
+	Text   string   // Target as written
 }
 
 type Block struct {
@@ -108,11 +135,28 @@ type Block struct {
 	Args      []string
 	Modifiers []BlockModifier
 	Body      []interface{} // mix of Cmd and nested Block
+	Doc       string        // Comment lines directly above the header
+	Filename  string        // File the block was parsed from
+	Exprs     []Expr        // Header of if, elif, while and for, evaluated at run time
+	ExprPos   []Location    // Where each of Exprs starts
+	ExprText  []string      // Each of Exprs as written
 	Line      int
 	Column    int
+	EndLine   int // Line of the closing 'end', 0 when it has none
+}
+
+// HasModifier reports whether the block header carries a flag such as -i
+func (b *Block) HasModifier(flag string) bool {
+	for _, mod := range b.Modifiers {
+		if mod.Flag == flag {
+			return true
+		}
+	}
+	return false
 }
 
 type Program struct {
+	Filename   string
 	Blocks     []Block
 	Functions  map[string]*Block            // Named function blocks
 	Data       map[string]*Block            // Named data blocks
@@ -120,6 +164,16 @@ type Program struct {
 	Imports    []Import                     // List of imports
 	ImportMap  map[string]*Import           // Quick namespace lookup
 	Namespaces map[string]map[string]*Block // Namespaced functions/data
+	TopLevel   []interface{}                // Commands outside any block, which form the implicit main
+	Comments   []Comment                    // Every comment in the file, in order
+}
+
+// Comment is a # comment as written, kept so the program can be printed
+// back with them
+type Comment struct {
+	Text   string // From the # to the end of the line
+	Line   int
+	Column int
 }
 
 // Concurrent parsing structures
@@ -169,6 +223,7 @@ var boxLexer = lexer.MustStateful(lexer.Rules{
 		{`SingleQuote`, `'[^']*'`, nil},
 		{`Pipeline`, `\|`, nil},
 		{`IgnoreError`, `\?`, nil},
+		{`Redirect`, `2>|>>|>`, nil},
 		{`Word`, `[^\s|>?#'"$\[\]`+"`"+`]+`, nil},
 	},
 })
@@ -187,6 +242,7 @@ type Element struct {
 type ImportStmt struct {
 	_    string `"import"`
 	Path string `@Word`
+	Pos  lexer.Position // Where the path is written
 }
 
 type SimpleBlock struct {
@@ -212,7 +268,18 @@ type SimpleExpr struct {
 
 // Parser implementation
 type ParticleParser struct {
-	filename string
+	filename  string
+	source    string
+	lines     []string     // Source lines, for doc comments
+	errs      []parseError // Errors reported so far in this pass
+	noImports bool         // Record imports without reading the files
+}
+
+// parseError is a reported error and the place in this file it sorts by.
+// Errors inside an imported file sort at the import.
+type parseError struct {
+	err *BoxError
+	at  Location
 }
 
 // NewParticleParser creates a new parser using Participle
@@ -222,6 +289,13 @@ func NewParticleParser(filename string) (*ParticleParser, error) {
 	}, nil
 }
 
+// SetResolveImports chooses whether imports are read and parsed, as they
+// are by default. Without, the program records each import's path only,
+// which is all formatting needs.
+func (p *ParticleParser) SetResolveImports(resolve bool) {
+	p.noImports = !resolve
+}
+
 // ParseFile parses a Box file
 func (p *ParticleParser) ParseFile(filename string) (*Program, error) {
 	content, err := os.ReadFile(filename)
@@ -250,13 +324,14 @@ func (p *ParticleParser) ParseStringConcurrent(source string) (*Program, error)
 
 // parseManually handles the parsing manually using the lexer tokens
 func (p *ParticleParser) parseManually(source string) (*Program, error) {
+	p.lines = strings.Split(source, "\n")
+	p.source = source
+	p.errs = nil
+
 	// Create lexer
 	lex, err := boxLexer.LexString(p.filename, source)
 	if err != nil {
-		return nil, &BoxError{
-			Message:  fmt.Sprintf("lexer error: %v", err),
-			Location: Location{p.filename, 0, 0},
-		}
+		return nil, p.lexError(err)
 	}
 
 	// Parse tokens into program structure  
@@ -265,13 +340,14 @@ func (p *ParticleParser) parseManually(source string) (*Program, error) {
 
 // parseConcurrently handles concurrent parsing with streaming and parallel imports
 func (p *ParticleParser) parseConcurrently(source string) (*Program, error) {
+	p.lines = strings.Split(source, "\n")
+	p.source = source
+	p.errs = nil
+
 	// Create lexer
 	lex, err := boxLexer.LexString(p.filename, source)
 	if err != nil {
-		return nil, &BoxError{
-			Message:  fmt.Sprintf("lexer error: %v", err),
-			Location: Location{p.filename, 0, 0},
-		}
+		return nil, p.lexError(err)
 	}
 
 	// Use concurrent token processing
@@ -281,6 +357,7 @@ func (p *ParticleParser) parseConcurrently(source string) (*Program, error) {
 // parseTokens manually parses lexer tokens into a Program
 func (p *ParticleParser) parseTokens(lex lexer.Lexer) (*Program, error) {
 	program := &Program{
+		Filename:   p.filename,
 		Functions:  make(map[string]*Block),
 		Data:       make(map[string]*Block),
 		ImportMap:  make(map[string]*Import),
@@ -289,92 +366,32 @@ func (p *ParticleParser) parseTokens(lex lexer.Lexer) (*Program, error) {
 
 	// Collect all tokens first
 	var tokens []lexer.Token
+	from := 0
 	for {
 		token, err := lex.Next()
 		if err != nil {
-			return nil, err
+			tokens, lex, from = p.relex(err, tokens)
+			if lex == nil {
+				break
+			}
+			continue
 		}
 		if token.EOF() {
 			break
 		}
-		// Skip comments and whitespace
-		if token.Type == boxLexer.Symbols()["Comment"] || token.Type == boxLexer.Symbols()["Whitespace"] {
-			continue
-		}
-		tokens = append(tokens, token)
-	}
-
-	// Parse the token stream
-	var topLevelCommands []interface{}
-	i := 0
-	
-	for i < len(tokens) {
-		token := tokens[i]
-		
-		// Skip newlines at top level
-		if token.Type == boxLexer.Symbols()["Newline"] {
-			i++
+		// Skip whitespace, keeping comments aside
+		if token.Type == boxLexer.Symbols()["Whitespace"] || token.Pos.Offset < from {
 			continue
 		}
-		
-		// Handle import statements
-		if token.Type == boxLexer.Symbols()["Word"] && token.Value == "import" {
-			importStmt, newIndex, err := p.parseImport(tokens, i)
-			if err != nil {
-				return nil, err
-			}
-			
-			// Process the import
-			err = p.processImport(program, importStmt)
-			if err != nil {
-				return nil, err
-			}
-			
-			i = newIndex
+		if token.Type == boxLexer.Symbols()["Comment"] {
+			program.Comments = append(program.Comments, comment(token))
 			continue
 		}
-		
-		// Handle blocks
-		if token.Type == boxLexer.Symbols()["BlockStart"] {
-			block, newIndex, err := p.parseBlock(tokens, i)
-			if err != nil {
-				return nil, err
-			}
-			
-			program.Blocks = append(program.Blocks, *block)
-			
-			// Organize blocks by type
-			switch block.Type {
-			case FuncBlock:
-				program.Functions[block.Label] = block
-			case DataBlock:
-				program.Data[block.Label] = block
-			case MainBlock:
-				program.Main = block
-			}
-			
-			i = newIndex
-		} else {
-			// Handle top-level commands
-			cmd, newIndex, err := p.parseCommand(tokens, i)
-			if err != nil {
-				return nil, err
-			}
-			topLevelCommands = append(topLevelCommands, cmd)
-			i = newIndex
-		}
-	}
-
-	// If there are top-level commands but no [main] block, create implicit main
-	if len(topLevelCommands) > 0 && program.Main == nil {
-		program.Main = &Block{
-			Type: MainBlock,
-			Body: topLevelCommands,
-		}
-		program.Blocks = append(program.Blocks, *program.Main)
+		tokens = append(tokens, token)
 	}
 
-	return program, nil
+	p.parseStatements(tokens, program)
+	return p.result(program)
 }
 
 // Concurrent token streaming implementation
@@ -419,8 +436,8 @@ func (ts *TokenStream) streamTokens(lex lexer.Lexer) {
 				return
 			}
 			
-			// Filter out comments and whitespace during streaming
-			if token.Type == boxLexer.Symbols()["Comment"] || token.Type == boxLexer.Symbols()["Whitespace"] {
+			// Filter out whitespace during streaming
+			if token.Type == boxLexer.Symbols()["Whitespace"] {
 				continue
 			}
 			
@@ -472,6 +489,7 @@ func (p *ParticleParser) parseTokensConcurrent(lex lexer.Lexer) (*Program, error
 	defer tokenStream.Close()
 	
 	program := &Program{
+		Filename:   p.filename,
 		Functions:  make(map[string]*Block),
 		Data:       make(map[string]*Block),
 		ImportMap:  make(map[string]*Import),
@@ -484,13 +502,20 @@ func (p *ParticleParser) parseTokensConcurrent(lex lexer.Lexer) (*Program, error
 
 func (p *ParticleParser) processConcurrentTokens(tokenStream *TokenStream, program *Program) (*Program, error) {
 	var tokens []lexer.Token
-	var topLevelCommands []interface{}
+	from := 0
 	
 	// Collect tokens with concurrent streaming but maintain identical processing order
 	for {
 		token, err := tokenStream.Next()
 		if err != nil {
-			return nil, err
+			var lex lexer.Lexer
+			tokens, lex, from = p.relex(err, tokens)
+			if lex == nil {
+				break
+			}
+			tokenStream.Close()
+			tokenStream = NewTokenStream(context.Background(), lex)
+			continue
 		}
 		
 		// Check for EOF (empty token with no error)
@@ -498,10 +523,27 @@ func (p *ParticleParser) processConcurrentTokens(tokenStream *TokenStream, progr
 			break
 		}
 		
+		if token.Pos.Offset < from {
+			continue
+		}
+		if token.Type == boxLexer.Symbols()["Comment"] {
+			program.Comments = append(program.Comments, comment(token))
+			continue
+		}
 		tokens = append(tokens, token)
 	}
+	tokenStream.Close()
+	
+	p.parseStatements(tokens, program)
+	return p.result(program)
+}
+
+// parseStatements parses the top level of a file into program. Errors are
+// reported and parsing resumes at the next line, so that one pass finds
+// them all.
+func (p *ParticleParser) parseStatements(tokens []lexer.Token, program *Program) {
+	var topLevelCommands []interface{}
 	
-	// Process tokens in exactly the same order as the original sequential version
 	i := 0
 	for i < len(tokens) {
 		token := tokens[i]
@@ -512,29 +554,26 @@ func (p *ParticleParser) processConcurrentTokens(tokenStream *TokenStream, progr
 			continue
 		}
 		
-		// Handle import statements exactly like the original
+		// Handle import statements
 		if token.Type == boxLexer.Symbols()["Word"] && token.Value == "import" {
 			importStmt, newIndex, err := p.parseImport(tokens, i)
 			if err != nil {
-				return nil, err
+				p.report(err)
+				i = nextLine(tokens, i)
+				continue
 			}
 			
-			// Use sequential import processing for compatibility
-			err = p.processImport(program, importStmt)
-			if err != nil {
-				return nil, err
+			if err := p.processImport(program, importStmt); err != nil {
+				p.reportAt(err, p.importLocation(importStmt))
 			}
 			
 			i = newIndex
 			continue
 		}
 		
-		// Handle block statements exactly like the original
+		// Handle block statements
 		if token.Type == boxLexer.Symbols()["BlockStart"] {
-			block, newIndex, err := p.parseBlock(tokens, i)
-			if err != nil {
-				return nil, err
-			}
+			block, newIndex := p.parseBlock(tokens, i)
 			
 			program.Blocks = append(program.Blocks, *block)
 			
@@ -551,17 +590,48 @@ func (p *ParticleParser) processConcurrentTokens(tokenStream *TokenStream, progr
 			continue
 		}
 		
-		// Handle regular commands at top level exactly like the original
+		// An 'end' here has nothing to close
+		if token.Type == boxLexer.Symbols()["BlockEnd"] {
+			p.report(&BoxError{
+				Message:  "unexpected 'end'",
+				Location: p.at(token),
+				Help:     "No block or control structure is open here; remove it or check the 'end's above",
+			})
+			i = nextLine(tokens, i)
+			continue
+		}
+		
+		// Top-level control structures run as part of the implicit main
+		if isControlKeyword(token) {
+			controlBlock, newIndex, closed := p.parseControlStructureTokens(tokens, i)
+			if !closed {
+				p.report(&BoxError{
+					Message:  fmt.Sprintf("unclosed '%s'", token.Value),
+					Location: p.at(token),
+					Help:     fmt.Sprintf("Close the '%s' with 'end'", token.Value),
+				})
+			}
+			topLevelCommands = append(topLevelCommands, *controlBlock)
+			i = newIndex
+			continue
+		}
+		
+		// Handle regular commands at top level
 		cmd, newIndex, err := p.parseCommand(tokens, i)
 		if err != nil {
-			return nil, err
+			p.report(err)
+			i = nextLine(tokens, i)
+			continue
 		}
 		
-		topLevelCommands = append(topLevelCommands, cmd)
+		if cmd != nil {
+			topLevelCommands = append(topLevelCommands, cmd)
+		}
 		i = newIndex
 	}
 	
 	// If there are top-level commands but no main block, create one
+	program.TopLevel = topLevelCommands
 	if len(topLevelCommands) > 0 && program.Main == nil {
 		program.Main = &Block{
 			Type:  MainBlock,
@@ -570,49 +640,161 @@ func (p *ParticleParser) processConcurrentTokens(tokenStream *TokenStream, progr
 		}
 		program.Blocks = append(program.Blocks, *program.Main)
 	}
-	
-	return program, nil
+}
+
+// nextLine returns the index of the first token after the line holding
+// tokens[i]
+func nextLine(tokens []lexer.Token, i int) int {
+	for i < len(tokens) && tokens[i].Type != boxLexer.Symbols()["Newline"] {
+		i++
+	}
+	return i + 1
+}
+
+// comment records a comment token
+func comment(token lexer.Token) Comment {
+	return Comment{Text: token.Value, Line: token.Pos.Line, Column: token.Pos.Column}
+}
+
+// text returns a run of adjacent tokens as written
+func text(tokens []lexer.Token) string {
+	var b strings.Builder
+	for _, token := range tokens {
+		b.WriteString(token.Value)
+	}
+	return b.String()
+}
+
+// lineStart reports whether tokens[i] is the first on its line. Only there
+// do control keywords and 'end' open and close blocks.
+func lineStart(tokens []lexer.Token, i int) bool {
+	return i == 0 || tokens[i-1].Type == boxLexer.Symbols()["Newline"]
+}
+
+// report records an error and lets parsing carry on
+func (p *ParticleParser) report(err error) {
+	p.reportAt(err, Location{})
+}
+
+// reportAt records an error, sorting errors from other files at at
+func (p *ParticleParser) reportAt(err error, at Location) {
+	errs := Errors(err)
+	if errs == nil {
+		errs = []*BoxError{{Message: err.Error(), Location: Location{Filename: p.filename}}}
+	}
+	for _, boxErr := range errs {
+		pos := at
+		if boxErr.Location.Filename == p.filename || at.Line == 0 {
+			pos = boxErr.Location
+		}
+		p.errs = append(p.errs, parseError{err: boxErr, at: pos})
+	}
+}
+
+// result returns the program, or the errors reported while parsing it in
+// source order: a BoxError when there is one, otherwise an ErrorList
+func (p *ParticleParser) result(program *Program) (*Program, error) {
+	if len(p.errs) == 0 {
+		return program, nil
+	}
+	slices.SortStableFunc(p.errs, func(a, b parseError) int {
+		return cmp.Or(cmp.Compare(a.at.Line, b.at.Line), cmp.Compare(a.at.Column, b.at.Column))
+	})
+	if len(p.errs) == 1 {
+		return nil, p.errs[0].err
+	}
+	list := make(ErrorList, len(p.errs))
+	for i, reported := range p.errs {
+		list[i] = reported.err
+	}
+	return nil, list
+}
+
+// relex reports a lexer failure and lexes the source again from the line
+// after it, so later errors are found in the same pass. Tokens already
+// read from the failing line are dropped with it. The new lexer is nil
+// when there is nothing left; tokens before from are to be skipped.
+func (p *ParticleParser) relex(err error, tokens []lexer.Token) ([]lexer.Token, lexer.Lexer, int) {
+	p.report(p.lexError(err))
+	lexErr, ok := err.(*lexer.Error)
+	if !ok {
+		return tokens, nil, 0
+	}
+
+	for len(tokens) > 0 && tokens[len(tokens)-1].Pos.Line >= lexErr.Pos.Line {
+		tokens = tokens[:len(tokens)-1]
+	}
+
+	offset := min(lexErr.Pos.Offset, len(p.source))
+	next := strings.IndexByte(p.source[offset:], '\n')
+	if next == -1 {
+		return tokens, nil, 0
+	}
+	from := offset + next
+
+	// Blank out what was read so offsets, lines and columns stay put
+	blanked := []byte(p.source)
+	for i := 0; i < from; i++ {
+		if blanked[i] != '\n' {
+			blanked[i] = ' '
+		}
+	}
+	lex, err := boxLexer.LexString(p.filename, string(blanked))
+	if err != nil {
+		return tokens, nil, 0
+	}
+	return tokens, lex, from
 }
 
 // parseImport parses an import statement from tokens
 func (p *ParticleParser) parseImport(tokens []lexer.Token, startIndex int) (*ImportStmt, int, error) {
 	if startIndex >= len(tokens) {
 		return nil, startIndex, &BoxError{
-			Message: "unexpected end of input in import",
-			Location: Location{p.filename, 0, 0},
+			Message:  "unexpected end of input in import",
+			Location: p.end(tokens),
 		}
 	}
 	
 	// Expect "import" token
 	if tokens[startIndex].Value != "import" {
 		return nil, startIndex, &BoxError{
-			Message: "expected 'import'",
-			Location: Location{p.filename, 0, 0},
+			Message:  "expected 'import'",
+			Location: p.at(tokens[startIndex]),
 		}
 	}
 	
 	// Expect path token
-	if startIndex+1 >= len(tokens) {
+	if startIndex+1 >= len(tokens) || tokens[startIndex+1].Type == boxLexer.Symbols()["Newline"] {
 		return nil, startIndex, &BoxError{
-			Message: "expected import path after 'import'",
-			Location: Location{p.filename, 0, 0},
+			Message:  "expected import path after 'import'",
+			Location: p.at(tokens[startIndex]),
 		}
 	}
 	
 	pathToken := tokens[startIndex+1]
 	if pathToken.Type != boxLexer.Symbols()["Word"] {
 		return nil, startIndex, &BoxError{
-			Message: "expected import path",
-			Location: Location{p.filename, 0, 0},
+			Message:  "expected import path",
+			Location: p.at(pathToken),
 		}
 	}
 	
 	importStmt := &ImportStmt{
 		Path: pathToken.Value,
+		Pos:  pathToken.Pos,
 	}
 	
-	// Skip to next statement (consume newline if present)
+	// The path is all there is to an import
 	i := startIndex + 2
+	if i < len(tokens) && tokens[i].Type != boxLexer.Symbols()["Newline"] {
+		return nil, startIndex, &BoxError{
+			Message:  fmt.Sprintf("unexpected '%s' after import path", tokens[i].Value),
+			Location: p.at(tokens[i]),
+			Help:     "Import one file per line",
+		}
+	}
+	
+	// Skip to next statement (consume newline if present)
 	if i < len(tokens) && tokens[i].Type == boxLexer.Symbols()["Newline"] {
 		i++
 	}
@@ -630,6 +812,11 @@ func (p *ParticleParser) processImport(program *Program, importStmt *ImportStmt)
 	}
 	
 	// Construct full file path - try both with and without .box extension
+	if p.noImports {
+		program.Imports = append(program.Imports, Import{Path: importStmt.Path, Namespace: namespace, Line: importStmt.Pos.Line, Column: importStmt.Pos.Column})
+		return nil
+	}
+	
 	var filePath string
 	var content []byte
 	var err error
@@ -652,8 +839,8 @@ func (p *ParticleParser) processImport(program *Program, importStmt *ImportStmt)
 	
 	if err != nil {
 		return &BoxError{
-			Message: fmt.Sprintf("failed to read import file '%s': %v", filePath, err),
-			Location: Location{p.filename, 0, 0},
+			Message:  fmt.Sprintf("failed to read import file '%s': %v", filePath, err),
+			Location: p.importLocation(importStmt),
 		}
 	}
 	
@@ -661,17 +848,14 @@ func (p *ParticleParser) processImport(program *Program, importStmt *ImportStmt)
 	importParser, err := NewParticleParser(filePath)
 	if err != nil {
 		return &BoxError{
-			Message: fmt.Sprintf("failed to create parser for import '%s': %v", filePath, err),
-			Location: Location{p.filename, 0, 0},
+			Message:  fmt.Sprintf("failed to create parser for import '%s': %v", filePath, err),
+			Location: p.importLocation(importStmt),
 		}
 	}
 	
 	importedProgram, err := importParser.ParseString(string(content))
 	if err != nil {
-		return &BoxError{
-			Message: fmt.Sprintf("failed to parse import '%s': %v", filePath, err),
-			Location: Location{p.filename, 0, 0},
-		}
+		return p.importParseError(importStmt, filePath, err)
 	}
 	
 	// Create Import object
@@ -679,6 +863,8 @@ func (p *ParticleParser) processImport(program *Program, importStmt *ImportStmt)
 		Path:      importStmt.Path,
 		Namespace: namespace,
 		Program:   importedProgram,
+		Line:      importStmt.Pos.Line,
+		Column:    importStmt.Pos.Column,
 	}
 	
 	// Add to program
@@ -703,6 +889,34 @@ func (p *ParticleParser) processImport(program *Program, importStmt *ImportStmt)
 	return nil
 }
 
+// importLocation locates an error at an import statement's path
+func (p *ParticleParser) importLocation(stmt *ImportStmt) Location {
+	return Location{
+		Filename: p.filename,
+		Line:     stmt.Pos.Line,
+		Column:   stmt.Pos.Column,
+		Length:   utf8.RuneCountInString(stmt.Path),
+	}
+}
+
+// importParseError reports the parse errors in an imported file. They keep
+// their locations in that file; the help points back at the import.
+func (p *ParticleParser) importParseError(stmt *ImportStmt, filePath string, err error) error {
+	at := p.importLocation(stmt)
+	if errs := Errors(err); len(errs) > 0 && errs[0].Location.Line > 0 {
+		for _, boxErr := range errs {
+			if boxErr.Help == "" {
+				boxErr.Help = fmt.Sprintf("In '%s', imported at %s:%d", filePath, at.Filename, at.Line)
+			}
+		}
+		return err
+	}
+	return &BoxError{
+		Message:  fmt.Sprintf("failed to parse import '%s': %v", filePath, err),
+		Location: at,
+	}
+}
+
 // Parallel import processing structures
 type ImportJob struct {
 	stmt      *ImportStmt
@@ -828,8 +1042,8 @@ func (p *ParticleParser) importWorker(jobs <-chan ImportJob, results chan<- Impo
 		
 		if err != nil {
 			result.err = &BoxError{
-				Message: fmt.Sprintf("failed to read import file '%s': %v", filePath, err),
-				Location: Location{p.filename, 0, 0},
+				Message:  fmt.Sprintf("failed to read import file '%s': %v", filePath, err),
+				Location: p.importLocation(job.stmt),
 			}
 			results <- result
 			continue
@@ -839,8 +1053,8 @@ func (p *ParticleParser) importWorker(jobs <-chan ImportJob, results chan<- Impo
 		importParser, err := NewParticleParser(filePath)
 		if err != nil {
 			result.err = &BoxError{
-				Message: fmt.Sprintf("failed to create parser for import '%s': %v", filePath, err),
-				Location: Location{p.filename, 0, 0},
+				Message:  fmt.Sprintf("failed to create parser for import '%s': %v", filePath, err),
+				Location: p.importLocation(job.stmt),
 			}
 			results <- result
 			continue
@@ -848,10 +1062,7 @@ func (p *ParticleParser) importWorker(jobs <-chan ImportJob, results chan<- Impo
 		
 		importedProgram, err := importParser.ParseString(string(content))
 		if err != nil {
-			result.err = &BoxError{
-				Message: fmt.Sprintf("failed to parse import '%s': %v", filePath, err),
-				Location: Location{p.filename, 0, 0},
-			}
+			result.err = p.importParseError(job.stmt, filePath, err)
 			results <- result
 			continue
 		}
@@ -861,6 +1072,8 @@ func (p *ParticleParser) importWorker(jobs <-chan ImportJob, results chan<- Impo
 			Path:      job.stmt.Path,
 			Namespace: job.namespace,
 			Program:   importedProgram,
+			Line:      job.stmt.Pos.Line,
+			Column:    job.stmt.Pos.Column,
 		}
 		
 		results <- result
@@ -1000,12 +1213,30 @@ func (p *ParticleParser) optimizeCommandArgs(cmd *Cmd) error {
 	return nil
 }
 
-// parseBlock parses a block starting from a BlockStart token
-func (p *ParticleParser) parseBlock(tokens []lexer.Token, startIndex int) (*Block, int, error) {
+// docComment returns the comment lines directly above a block header,
+// without their leading '#'
+func (p *ParticleParser) docComment(line int) string {
+	var doc []string
+	for i := line - 2; i >= 0 && i < len(p.lines); i-- {
+		text := strings.TrimSpace(p.lines[i])
+		if !strings.HasPrefix(text, "#") {
+			break
+		}
+		doc = append([]string{strings.TrimSpace(strings.TrimPrefix(text, "#"))}, doc...)
+	}
+	return strings.Join(doc, "\n")
+}
+
+// parseBlock parses a block starting from a BlockStart token. Errors in
+// the header or a missing 'end' are reported; the block runs to its 'end',
+// or up to the next header when it has none.
+func (p *ParticleParser) parseBlock(tokens []lexer.Token, startIndex int) (*Block, int) {
 	blockToken := tokens[startIndex]
 	
 	block := &Block{
 		Body: []interface{}{},
+		Doc: p.docComment(blockToken.Pos.Line),
+		Filename: p.filename,
 		Line: blockToken.Pos.Line,
 		Column: blockToken.Pos.Column,
 	}
@@ -1016,72 +1247,86 @@ func (p *ParticleParser) parseBlock(tokens []lexer.Token, startIndex int) (*Bloc
 		blockContent = blockContent[1 : len(blockContent)-1]
 	}
 	
-	err := p.parseBlockHeader(block, blockContent)
-	if err != nil {
-		return nil, startIndex, err
+	if err := p.parseBlockHeader(block, blockContent); err != nil {
+		p.report(err)
 	}
 	
-	// Find the matching end token
-	i := startIndex + 1
-	bodyStart := i
-	
 	// Skip newlines after header
+	i := startIndex + 1
 	for i < len(tokens) && tokens[i].Type == boxLexer.Symbols()["Newline"] {
 		i++
 	}
-	bodyStart = i
-	
-	// Find matching end - need to track both block depth and control structure depth
-	blockDepth := 1  // Tracks nested blocks ([main], [fn], etc.)
-	controlDepth := 0  // Tracks nested control structures (if, while, for)
+	bodyStart := i
 	
-	for i < len(tokens) && blockDepth > 0 {
+	// Find the matching end, skipping those that close control structures.
+	// Only function and main blocks hold control structures; data blocks
+	// are plain entries.
+	var controls []lexer.Token
+	var outdented []lexer.Token // Controls closed by an 'end' left of them
+	closed := false
+	for ; i < len(tokens); i++ {
 		token := tokens[i]
+		if !lineStart(tokens, i) {
+			continue
+		}
 		
 		if token.Type == boxLexer.Symbols()["BlockStart"] {
-			blockDepth++
-		} else if token.Type == boxLexer.Symbols()["Word"] && 
-		          (token.Value == "while" || token.Value == "if" || token.Value == "for") &&
-		          (block.Type == FuncBlock || block.Type == MainBlock) {
-			// Only track control structures in function/main blocks, not data blocks
-			controlDepth++
+			// Blocks don't nest, so this header starts the next one
+			break
+		} else if isControlKeyword(token) && (block.Type == FuncBlock || block.Type == MainBlock) {
+			controls = append(controls, token)
 		} else if token.Type == boxLexer.Symbols()["BlockEnd"] {
-			if controlDepth > 0 {
-				// This 'end' closes a control structure, not a block
-				controlDepth--
-			} else {
-				// This 'end' closes a block
-				blockDepth--
+			if len(controls) == 0 {
+				closed = true
+				break
 			}
-		}
-		
-		if blockDepth > 0 {
-			i++
+			if open := controls[len(controls)-1]; token.Pos.Column < open.Pos.Column {
+				outdented = append(outdented, open)
+			}
+			controls = controls[:len(controls)-1]
 		}
 	}
 	
-	if blockDepth > 0 {
-		return nil, startIndex, &BoxError{
-			Message: "unclosed block",
-			Location: Location{p.filename, blockToken.Pos.Line, blockToken.Pos.Column},
+	if !closed {
+		// The block's 'end' may have gone to a control structure: one still
+		// open, or one whose 'end' is indented like the block's would be
+		if len(controls) == 0 && len(outdented) > 0 {
+			controls = outdented[:1]
+		}
+		if len(controls) > 0 {
+			open := controls[len(controls)-1]
+			p.report(&BoxError{
+				Message:  fmt.Sprintf("unclosed '%s'", open.Value),
+				Location: p.at(open),
+				Help:     fmt.Sprintf("Close the '%s' with 'end' before the block's own 'end'", open.Value),
+			})
+		} else {
+			p.report(&BoxError{
+				Message:  "unclosed block",
+				Location: p.at(blockToken),
+				Help:     "Close the block with 'end'",
+			})
 		}
 	}
 	
 	// Parse body tokens
 	if i > bodyStart {
-		bodyTokens := tokens[bodyStart:i]
-		block.Body = p.parseBodyTokens(bodyTokens)
+		block.Body = p.parseBodyTokens(tokens[bodyStart:i])
 	}
 	
-	return block, i + 1, nil // i points to 'end', return i+1 to skip it
+	if closed {
+		block.EndLine = tokens[i].Pos.Line
+		i++ // Skip the 'end'
+	}
+	return block, i
 }
 
 // parseCommand parses a single command starting from the given index
 func (p *ParticleParser) parseCommand(tokens []lexer.Token, startIndex int) (interface{}, int, error) {
 	if startIndex >= len(tokens) {
 		return nil, startIndex, &BoxError{
-			Message: "unexpected end of input",
-			Location: Location{p.filename, 0, 0},
+			Message:  "unexpected end of input",
+			Location: p.end(tokens),
 		}
 	}
 	
@@ -1096,8 +1341,8 @@ func (p *ParticleParser) parseCommand(tokens []lexer.Token, startIndex int) (int
 	
 	if len(cmdTokens) == 0 {
 		return nil, i, &BoxError{
-			Message: "empty command",
-			Location: Location{p.filename, 0, 0},
+			Message:  "empty command",
+			Location: p.at(tokens[startIndex]),
 		}
 	}
 	
@@ -1135,10 +1380,18 @@ func (p *ParticleParser) parseBodyTokens(tokens []lexer.Token) []interface{} {
 		if tokens[i].Type == boxLexer.Symbols()["Word"] && 
 		   (tokens[i].Value == "while" || tokens[i].Value == "if" || tokens[i].Value == "for" || 
 		    tokens[i].Value == "elif" || tokens[i].Value == "else") {
-			// Parse control structure
-			controlBlock, newIndex := p.parseControlStructureTokens(tokens, i)
+			// Parse control structure. Its block has already matched the
+			// 'end's; elif and else run to the end of the enclosing if.
+			controlBlock, newIndex, _ := p.parseControlStructureTokens(tokens, i)
 			result = append(result, *controlBlock)
 			i = newIndex
+		} else if tokens[i].Type == boxLexer.Symbols()["Word"] && tokens[i].Value == "import" {
+			p.report(&BoxError{
+				Message:  "import inside a block",
+				Location: p.at(tokens[i]),
+				Help:     "Move the import to the top level of the file",
+			})
+			i = nextLine(tokens, i)
 		} else {
 			// Parse regular command
 			cmd, newIndex := p.parseCommandFromTokens(tokens, i)
@@ -1152,6 +1405,12 @@ func (p *ParticleParser) parseBodyTokens(tokens []lexer.Token) []interface{} {
 	return result
 }
 
+// isControlKeyword reports whether a token opens a control structure
+func isControlKeyword(token lexer.Token) bool {
+	return token.Type == boxLexer.Symbols()["Word"] &&
+		(token.Value == "while" || token.Value == "if" || token.Value == "for")
+}
+
 // Helper function to get token type name for debugging
 func tokenTypeName(tokenType lexer.TokenType) string {
 	for name, t := range boxLexer.Symbols() {
@@ -1174,16 +1433,31 @@ func (p *ParticleParser) parseCommandTokens(tokens []lexer.Token) interface{} {
 	
 	for _, token := range tokens {
 		if token.Type == boxLexer.Symbols()["Pipeline"] {
-			if len(currentCmd) > 0 {
-				commands = append(commands, currentCmd)
-				currentCmd = []lexer.Token{}
+			if len(currentCmd) == 0 {
+				p.report(&BoxError{
+					Message:  "missing command before '|'",
+					Location: p.at(token),
+					Help:     "A pipeline joins commands: 'cmd1 | cmd2'",
+				})
+				continue
 			}
+			commands = append(commands, currentCmd)
+			currentCmd = []lexer.Token{}
 		} else {
 			currentCmd = append(currentCmd, token)
 		}
 	}
 	if len(currentCmd) > 0 {
 		commands = append(commands, currentCmd)
+	} else if last := tokens[len(tokens)-1]; last.Type == boxLexer.Symbols()["Pipeline"] && len(commands) > 0 {
+		p.report(&BoxError{
+			Message:  "missing command after '|'",
+			Location: p.at(last),
+			Help:     "A pipeline joins commands: 'cmd1 | cmd2'",
+		})
+	}
+	if len(commands) == 0 {
+		return nil
 	}
 	
 	if len(commands) == 1 {
@@ -1214,6 +1488,14 @@ func (p *ParticleParser) createCmd(tokens []lexer.Token) *Cmd {
 		return nil
 	}
 	
+	if policy := errorPolicy(tokens, 0); policy != FailFast || tokens[0].Type == boxLexer.Symbols()["Redirect"] {
+		p.report(&BoxError{
+			Message:  fmt.Sprintf("expected a command before '%s'", tokens[0].Value),
+			Location: p.at(tokens[0]),
+		})
+		return nil
+	}
+	
 	cmd := &Cmd{
 		Verb:        tokens[0].Value,
 		Args:        []Expr{},
@@ -1227,6 +1509,40 @@ func (p *ParticleParser) createCmd(tokens []lexer.Token) *Cmd {
 	argTokens := tokens[1:]
 	i := 0
 	for i < len(argTokens) {
+		// A standalone ? or ! sets the error policy; the rest of the line
+		// is the fallback
+		if policy := errorPolicy(argTokens, i); policy != FailFast {
+			p.setErrorPolicy(cmd, policy, argTokens[i], argTokens[i+1:])
+			break
+		}
+		
+		// Redirections take the following token as their target
+		if argTokens[i].Type == boxLexer.Symbols()["Redirect"] {
+			redirect := Redirect{Type: argTokens[i].Value}
+			at := argTokens[i]
+			i++
+			if i >= len(argTokens) || !isRedirectTarget(argTokens[i]) || errorPolicy(argTokens, i) != FailFast {
+				p.report(&BoxError{
+					Message:  fmt.Sprintf("missing file after '%s'", redirect.Type),
+					Location: p.at(at),
+					Help:     fmt.Sprintf("Name the file to redirect to, as in 'cmd %s out.log'", redirect.Type),
+				})
+				continue
+			}
+			
+			// The target is one word, which may be several adjacent tokens
+			target := []lexer.Token{argTokens[i]}
+			for i++; i < len(argTokens) && isRedirectTarget(argTokens[i]) && adjacent(argTokens[i-1], argTokens[i]); i++ {
+				target = append(target, argTokens[i])
+			}
+			redirect.Expr = p.createCompoundExpr(target)
+			redirect.Target = redirect.Expr.String()
+			redirect.Pos = p.span(target)
+			redirect.Text = text(target)
+			cmd.Redirects = append(cmd.Redirects, redirect)
+			continue
+		}
+		
 		// Collect consecutive non-whitespace tokens into a single argument
 		var argGroup []lexer.Token
 		
@@ -1241,8 +1557,7 @@ func (p *ParticleParser) createCmd(tokens []lexer.Token) *Cmd {
 			
 			// If tokens are adjacent in the source (no space between them),
 			// they should be part of the same argument
-			if currentToken.Pos.Line == nextToken.Pos.Line &&
-				currentToken.Pos.Column+len(currentToken.Value) == nextToken.Pos.Column {
+			if nextToken.Type != boxLexer.Symbols()["Redirect"] && adjacent(currentToken, nextToken) {
 				argGroup = append(argGroup, nextToken)
 				i++
 			} else {
@@ -1256,12 +1571,16 @@ func (p *ParticleParser) createCmd(tokens []lexer.Token) *Cmd {
 			expr := p.createExpr(argGroup[0])
 			if expr != nil {
 				cmd.Args = append(cmd.Args, expr)
+				cmd.ArgPos = append(cmd.ArgPos, p.at(argGroup[0]))
+				cmd.ArgText = append(cmd.ArgText, argGroup[0].Value)
 			}
 		} else {
 			// Multiple adjacent tokens - create a compound expression
 			expr := p.createCompoundExpr(argGroup)
 			if expr != nil {
 				cmd.Args = append(cmd.Args, expr)
+				cmd.ArgPos = append(cmd.ArgPos, p.span(argGroup))
+				cmd.ArgText = append(cmd.ArgText, text(argGroup))
 			}
 		}
 	}
@@ -1269,6 +1588,60 @@ func (p *ParticleParser) createCmd(tokens []lexer.Token) *Cmd {
 	return cmd
 }
 
+// errorPolicy returns the policy a standalone ? or ! at tokens[i] sets, or
+// FailFast for any other token. A ? or ! touching other text is part of a
+// word, as in file?.txt.
+func errorPolicy(tokens []lexer.Token, i int) ErrorPolicy {
+	token := tokens[i]
+	if (i > 0 && adjacent(tokens[i-1], token)) || (i+1 < len(tokens) && adjacent(token, tokens[i+1])) {
+		return FailFast
+	}
+	switch {
+	case token.Type == boxLexer.Symbols()["IgnoreError"]:
+		if i+1 < len(tokens) {
+			return FallbackOnError
+		}
+		return IgnoreError
+	case token.Type == boxLexer.Symbols()["Word"] && token.Value == "!":
+		return TryFallbackHalt
+	}
+	return FailFast
+}
+
+// setErrorPolicy applies a ? or ! to cmd, parsing what follows it as the
+// fallback command
+func (p *ParticleParser) setErrorPolicy(cmd *Cmd, policy ErrorPolicy, op lexer.Token, rest []lexer.Token) {
+	cmd.ErrorPolicy = policy
+	if policy == IgnoreError {
+		return
+	}
+	if len(rest) == 0 {
+		p.report(&BoxError{
+			Message:  "missing fallback command after '!'",
+			Location: p.at(op),
+			Help:     "Write 'cmd ! fallback' to run fallback and stop, or 'cmd ?' to ignore the failure",
+		})
+		return
+	}
+	cmd.Fallback = p.createCmd(rest)
+}
+
+// isRedirectTarget reports whether a token can name a redirection's file
+func isRedirectTarget(token lexer.Token) bool {
+	switch token.Type {
+	case boxLexer.Symbols()["Redirect"], boxLexer.Symbols()["Pipeline"], boxLexer.Symbols()["BlockStart"]:
+		return false
+	}
+	return true
+}
+
+// adjacent reports whether next directly follows current in the source,
+// with no space between them
+func adjacent(current, next lexer.Token) bool {
+	return current.Pos.Line == next.Pos.Line &&
+		current.Pos.Column+utf8.RuneCountInString(current.Value) == next.Pos.Column
+}
+
 // createCompoundExpr creates a single expression from multiple adjacent tokens
 func (p *ParticleParser) createCompoundExpr(tokens []lexer.Token) Expr {
 	if len(tokens) == 0 {
@@ -1278,15 +1651,48 @@ func (p *ParticleParser) createCompoundExpr(tokens []lexer.Token) Expr {
 		return p.createExpr(tokens[0])
 	}
 	
-	// Combine all tokens into a single literal expression that will be
-	// expanded during evaluation. This preserves the variable expansion
-	// behavior while treating adjacent tokens as one argument.
-	var combined strings.Builder
-	for _, token := range tokens {
-		combined.WriteString(token.Value)
+	// Combine the tokens' expressions into one word; quoted parts keep their
+	// own rules, so only double-quoted and bare parts are interpolated
+	var parts []Expr
+	escaped := false
+	for i, token := range tokens {
+		var expr Expr
+		if escaped {
+			// \$ in a bare word makes the following $ token literal
+			expr = &LiteralExpr{Value: token.Value}
+			escaped = false
+		} else if token.Type == boxLexer.Symbols()["Word"] && strings.HasSuffix(token.Value, `\`) &&
+			i+1 < len(tokens) && strings.HasPrefix(tokens[i+1].Value, "$") {
+			expr = &LiteralExpr{Value: strings.TrimSuffix(token.Value, `\`)}
+			escaped = true
+		} else {
+			expr = p.createExpr(token)
+		}
+
+		if interp, ok := expr.(*InterpExpr); ok {
+			parts = append(parts, interp.Parts...)
+		} else {
+			parts = append(parts, expr)
+		}
 	}
-	
-	return &LiteralExpr{Value: combined.String()}
+
+	// Merge neighbouring literal text
+	var merged []Expr
+	for _, part := range parts {
+		if lit, ok := part.(*LiteralExpr); ok && len(merged) > 0 {
+			if prev, ok := merged[len(merged)-1].(*LiteralExpr); ok {
+				merged[len(merged)-1] = &LiteralExpr{Value: prev.Value + lit.Value}
+				continue
+			}
+		}
+		merged = append(merged, part)
+	}
+	if len(merged) == 1 {
+		if lit, ok := merged[0].(*LiteralExpr); ok {
+			return &LiteralExpr{Value: lit.Value}
+		}
+	}
+	return &InterpExpr{Parts: merged}
 }
 
 // createExpr creates an Expr from a token
@@ -1300,18 +1706,17 @@ func (p *ParticleParser) createExpr(token lexer.Token) Expr {
 		if len(value) >= 2 {
 			value = value[1 : len(value)-1]
 		}
-		value = p.processEscapeSequences(value)
-		return &LiteralExpr{Value: value}
+		return parseInterpolation(value, '"', true)
 		
 	case boxLexer.Symbols()["SingleQuote"]:
 		// Remove quotes
 		if len(value) >= 2 {
 			value = value[1 : len(value)-1]
 		}
-		return &LiteralExpr{Value: value}
+		return &LiteralExpr{Value: value, Quote: '\''}
 		
 	case boxLexer.Symbols()["Variable"]:
-		return p.parseVariable(value)
+		return parseVariable(value)
 		
 	case boxLexer.Symbols()["BlockLookup"]:
 		path := value
@@ -1334,29 +1739,43 @@ func (p *ParticleParser) createExpr(token lexer.Token) Expr {
 	}
 }
 
-// parseVariable parses a variable token into a VariableExpr
-func (p *ParticleParser) parseVariable(value string) Expr {
-	name := value
-	if strings.HasPrefix(name, "$") {
-		name = name[1:]
-	}
+// parseVariable parses a variable token into a VariableExpr: $x, $x[i] or
+// ${...} with the expansion syntax described in expand.go
+func parseVariable(value string) Expr {
+	name := strings.TrimPrefix(value, "$")
+	v := &VariableExpr{}
+
 	// Remove {} wrapper if present
 	if strings.HasPrefix(name, "{") && strings.HasSuffix(name, "}") {
 		name = name[1 : len(name)-1]
+		if len(name) > 1 && name[0] == '#' {
+			v.Length = true
+			name = name[1:]
+		}
 	}
-	
+
+	end := 0
+	for end < len(name) && isNameByte(name[end]) {
+		end++
+	}
+	v.Name, name = name[:end], name[end:]
+
 	// Handle array access
-	var index *string
-	if strings.Contains(name, "[") {
-		parts := strings.Split(name, "[")
-		if len(parts) == 2 && strings.HasSuffix(parts[1], "]") {
-			baseName := parts[0]
-			indexStr := strings.TrimSuffix(parts[1], "]")
-			name = baseName
-			index = &indexStr
+	if strings.HasPrefix(name, "[") {
+		if close := strings.Index(name, "]"); close != -1 {
+			index := name[1:close]
+			v.Index = &index
+			name = name[close+1:]
 		}
 	}
-	return &VariableExpr{Name: name, Index: index}
+
+	v.Modifier = name
+	return v
+}
+
+// isNameByte reports whether c can appear in a variable name or data path
+func isNameByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '.'
 }
 
 // parseCommandFromTokens parses a command from a token slice, finding the end
@@ -1382,8 +1801,9 @@ func (p *ParticleParser) parseCommandFromTokens(tokens []lexer.Token, startIndex
 	return p.parseCommandTokens(cmdTokens), i
 }
 
-// parseControlStructureTokens parses control structures manually
-func (p *ParticleParser) parseControlStructureTokens(tokens []lexer.Token, startIndex int) (*Block, int) {
+// parseControlStructureTokens parses control structures manually. It
+// reports whether an 'end' closed the structure.
+func (p *ParticleParser) parseControlStructureTokens(tokens []lexer.Token, startIndex int) (*Block, int, bool) {
 	startToken := tokens[startIndex]
 	
 	block := &Block{
@@ -1395,17 +1815,33 @@ func (p *ParticleParser) parseControlStructureTokens(tokens []lexer.Token, start
 		Column: startToken.Pos.Column,
 	}
 	
-	// Parse arguments until newline
+	// Parse arguments until newline. Adjacent tokens form one argument,
+	// as they do in commands.
 	i := startIndex + 1
+	var group []lexer.Token
+	addArg := func() {
+		if len(group) == 0 {
+			return
+		}
+		if expr := p.createCompoundExpr(group); expr != nil {
+			block.Exprs = append(block.Exprs, expr)
+			block.ExprPos = append(block.ExprPos, p.span(group))
+			block.ExprText = append(block.ExprText, text(group))
+			block.Args = append(block.Args, expr.String())
+		}
+		group = nil
+	}
 	for i < len(tokens) && tokens[i].Type != boxLexer.Symbols()["Newline"] {
 		if tokens[i].Type != boxLexer.Symbols()["Whitespace"] {
-			expr := p.createExpr(tokens[i])
-			if expr != nil {
-				block.Args = append(block.Args, expr.String())
+			if len(group) > 0 && !adjacent(group[len(group)-1], tokens[i]) {
+				addArg()
 			}
+			group = append(group, tokens[i])
 		}
 		i++
 	}
+	addArg()
+	p.checkHeader(block)
 	
 	// Skip newline after control structure header
 	if i < len(tokens) && tokens[i].Type == boxLexer.Symbols()["Newline"] {
@@ -1419,11 +1855,15 @@ func (p *ParticleParser) parseControlStructureTokens(tokens []lexer.Token, start
 	for i < len(tokens) && depth > 0 {
 		token := tokens[i]
 		
-		if token.Type == boxLexer.Symbols()["Word"] && 
-		   (token.Value == "while" || token.Value == "if" || token.Value == "for") {
-			depth++
-		} else if token.Type == boxLexer.Symbols()["BlockEnd"] {
-			depth--
+		if lineStart(tokens, i) {
+			if token.Type == boxLexer.Symbols()["BlockStart"] {
+				// A header ends the implicit main the structure is in
+				break
+			} else if isControlKeyword(token) {
+				depth++
+			} else if token.Type == boxLexer.Symbols()["BlockEnd"] {
+				depth--
+			}
 		}
 		
 		if depth > 0 {
@@ -1438,23 +1878,55 @@ func (p *ParticleParser) parseControlStructureTokens(tokens []lexer.Token, start
 	}
 	
 	// Skip the 'end' token
-	if i < len(tokens) && tokens[i].Type == boxLexer.Symbols()["BlockEnd"] {
-		i++
+	if depth > 0 {
+		return block, i, false
+	}
+	block.EndLine = tokens[i].Pos.Line
+	return block, i + 1, true
+}
+
+// checkHeader reports a control header that could never run: a for
+// without its variables and 'in', or a condition missing a command
+func (p *ParticleParser) checkHeader(block *Block) {
+	at := Location{Filename: p.filename, Line: block.Line, Column: block.Column, Length: len(block.Label)}
+	switch block.Label {
+	case "for":
+		if forIn(block.Exprs) < 0 {
+			p.report(forSyntaxError(at))
+		}
+	case "if", "elif", "while":
+		parser := &conditionParser{block: block}
+		if _, err := parser.parseOr(); err != nil {
+			boxErr := err.(*BoxError)
+			if boxErr.Location.Line == 0 || len(block.Exprs) == 0 {
+				boxErr.Location = at
+			}
+			boxErr.Location.Filename = p.filename
+			p.report(boxErr)
+		}
 	}
-	
-	return block, i
 }
 
 // parseBlockHeader parses the block header content
 func (p *ParticleParser) parseBlockHeader(block *Block, blockContent string) error {
 	parts := strings.Fields(blockContent)
+	header := Location{Filename: p.filename, Line: block.Line, Column: block.Column, Length: utf8.RuneCountInString(blockContent) + 2}
 	if len(parts) == 0 {
 		return &BoxError{
 			Message:  "empty block header",
-			Location: Location{p.filename, 0, 0},
+			Location: header,
 		}
 	}
 
+	// word locates header word i, just inside the opening bracket
+	columns := fieldColumns(blockContent)
+	word := func(i int) Location {
+		if i >= len(parts) {
+			return header
+		}
+		return Location{Filename: p.filename, Line: block.Line, Column: block.Column + 1 + columns[i], Length: utf8.RuneCountInString(parts[i])}
+	}
+
 	blockTypeStr := parts[0]
 	i := 1
 
@@ -1471,7 +1943,7 @@ func (p *ParticleParser) parseBlockHeader(block *Block, blockContent string) err
 		if i < len(parts) {
 			return &BoxError{
 				Message:  "[main] block cannot have arguments",
-				Location: Location{p.filename, 0, 0},
+				Location: word(i),
 			}
 		}
 	case "fn":
@@ -1479,17 +1951,31 @@ func (p *ParticleParser) parseBlockHeader(block *Block, blockContent string) err
 		if i >= len(parts) {
 			return &BoxError{
 				Message:  "[fn] block missing function name",
-				Location: Location{p.filename, 0, 0},
+				Location: header,
 			}
 		}
 		block.Label = parts[i]
 		block.Args = parts[i+1:]
+		for j, param := range block.Params() {
+			if param.Variadic && j != len(block.Args)-1 {
+				return &BoxError{
+					Message:  fmt.Sprintf("variadic parameter '%s...' must be the last parameter", param.Name),
+					Location: word(i + 1 + j),
+				}
+			}
+			if param.Name == "" {
+				return &BoxError{
+					Message:  fmt.Sprintf("invalid parameter '%s' in [fn %s]", block.Args[j], block.Label),
+					Location: word(i + 1 + j),
+				}
+			}
+		}
 	case "data":
 		block.Type = DataBlock
 		if i >= len(parts) {
 			return &BoxError{
 				Message:  "[data] block missing data name",
-				Location: Location{p.filename, 0, 0},
+				Location: header,
 			}
 		}
 		block.Label = parts[i]
@@ -1502,34 +1988,86 @@ func (p *ParticleParser) parseBlockHeader(block *Block, blockContent string) err
 	return nil
 }
 
-// processEscapeSequences processes escape sequences in double-quoted strings
-func (p *ParticleParser) processEscapeSequences(value string) string {
-	result := ""
-	i := 0
-	for i < len(value) {
-		if value[i] == '\\' && i+1 < len(value) {
-			switch value[i+1] {
-			case 'n':
-				result += "\n"
-			case 't':
-				result += "\t"
-			case 'r':
-				result += "\r"
-			case '\\':
-				result += "\\"
-			case '"':
-				result += "\""
-			default:
-				// Unknown escape sequence, keep as-is
-				result += string(value[i]) + string(value[i+1])
-			}
-			i += 2
-		} else {
-			result += string(value[i])
-			i++
+// fieldColumns returns the column offset of each whitespace-separated
+// field in s, matching strings.Fields
+func fieldColumns(s string) []int {
+	var columns []int
+	inField := false
+	for i, r := range []rune(s) {
+		space := r == ' ' || r == '\t'
+		if !space && !inField {
+			columns = append(columns, i)
 		}
+		inField = !space
 	}
-	return result
+	return columns
+}
+
+// at locates an error at a token, spanning its text on the first line
+func (p *ParticleParser) at(token lexer.Token) Location {
+	text, _, _ := strings.Cut(token.Value, "\n")
+	return Location{
+		Filename: p.filename,
+		Line:     token.Pos.Line,
+		Column:   token.Pos.Column,
+		Length:   utf8.RuneCountInString(text),
+	}
+}
+
+// span locates a run of adjacent tokens, such as a compound argument
+func (p *ParticleParser) span(tokens []lexer.Token) Location {
+	at := p.at(tokens[0])
+	last := p.at(tokens[len(tokens)-1])
+	if last.Line == at.Line {
+		at.Length = last.Column + last.Length - at.Column
+	}
+	return at
+}
+
+// end locates an error at the end of the input
+func (p *ParticleParser) end(tokens []lexer.Token) Location {
+	if len(tokens) == 0 {
+		return Location{Filename: p.filename, Line: 1, Column: 1}
+	}
+	at := p.at(tokens[len(tokens)-1])
+	at.Column += at.Length
+	at.Length = 0
+	return at
+}
+
+// lexError turns a lexer failure into a located error
+func (p *ParticleParser) lexError(err error) error {
+	lexErr, ok := err.(*lexer.Error)
+	if !ok {
+		return &BoxError{Message: fmt.Sprintf("lexer error: %v", err), Location: Location{Filename: p.filename}}
+	}
+
+	boxErr := &BoxError{
+		Message:  lexErr.Msg,
+		Location: Location{Filename: p.filename, Line: lexErr.Pos.Line, Column: lexErr.Pos.Column, Length: 1},
+	}
+	rest := p.source[min(lexErr.Pos.Offset, len(p.source)):]
+	switch {
+	case strings.HasPrefix(rest, `"`), strings.HasPrefix(rest, "'"):
+		boxErr.Message = "unterminated string"
+		boxErr.Help = "Close the string with a matching quote"
+	case strings.HasPrefix(rest, "["):
+		boxErr.Message = "unterminated block header"
+		boxErr.Help = "Close the header with ]"
+	case strings.HasPrefix(rest, "`"):
+		boxErr.Message = "unterminated command substitution"
+		boxErr.Help = "Close the substitution with a matching backtick"
+	case strings.HasPrefix(rest, "$(") || strings.HasPrefix(rest, "${"):
+		boxErr.Message = "unterminated substitution"
+		boxErr.Help = "Close $( with ) and ${ with }"
+	case strings.HasPrefix(rest, "]"):
+		boxErr.Message = "unexpected ']'"
+		boxErr.Help = "Block headers are written [name ...] at the start of a line"
+	case strings.HasPrefix(rest, "$"):
+		boxErr.Message = "unexpected '$'"
+		boxErr.Help = "Quote it ('$') for a literal dollar sign"
+	}
+	return boxErr
 }
 
 // DebugToken represents a token for debugging
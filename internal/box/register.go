@@ -0,0 +1,120 @@
+package box
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Host applications extend Box with their own verbs rather than syntax.
+// Registered verbs belong to one evaluator (and its forks); the core table
+// in builtins.go is never modified.
+
+// RegisterBuiltin adds a verb to the evaluator. Core verbs cannot be
+// replaced and a name can only be registered once.
+func (e *Evaluator) RegisterBuiltin(name string, fn BuiltinFunc) error {
+	if err := validVerbName(name); err != nil {
+		return err
+	}
+	if strings.Contains(name, ".") {
+		return fmt.Errorf("verb %q: use RegisterNamespace for namespaced verbs", name)
+	}
+	return e.register(name, fn)
+}
+
+// RegisterNamespace adds a set of verbs called as namespace.verb, such as
+// git.clone. The namespace cannot also be imported by a script.
+func (e *Evaluator) RegisterNamespace(namespace string, verbs map[string]BuiltinFunc) error {
+	if err := validVerbName(namespace); err != nil {
+		return err
+	}
+	if strings.Contains(namespace, ".") {
+		return fmt.Errorf("namespace %q: must not contain '.'", namespace)
+	}
+
+	// Check every verb first so a failed registration leaves nothing behind
+	names := make([]string, 0, len(verbs))
+	for verb := range verbs {
+		if err := validVerbName(verb); err != nil {
+			return err
+		}
+		if strings.Contains(verb, ".") {
+			return fmt.Errorf("verb %q in namespace %s: must not contain '.'", verb, namespace)
+		}
+		name := namespace + "." + verb
+		if _, exists := e.builtins[name]; exists {
+			return fmt.Errorf("verb %s is already registered", name)
+		}
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		if err := e.register(name, verbs[strings.TrimPrefix(name, namespace+".")]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RegisteredBuiltins returns the sorted names of the verbs the host has
+// registered on this evaluator
+func (e *Evaluator) RegisteredBuiltins() []string {
+	var names []string
+	for name := range e.builtins {
+		if _, core := builtins[name]; !core {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// IsCoreBuiltin reports whether name is one of Box's own verbs
+func IsCoreBuiltin(name string) bool {
+	_, exists := builtins[name]
+	return exists
+}
+
+func (e *Evaluator) register(name string, fn BuiltinFunc) error {
+	if fn == nil {
+		return fmt.Errorf("verb %s: nil function", name)
+	}
+	if IsCoreBuiltin(name) {
+		return fmt.Errorf("verb %s: cannot replace a core verb", name)
+	}
+	if _, exists := e.builtins[name]; exists {
+		return fmt.Errorf("verb %s is already registered", name)
+	}
+
+	// Copy the shared core table the first time this evaluator is extended
+	if !e.ownBuiltins {
+		table := make(map[string]BuiltinFunc, len(e.builtins)+1)
+		for verb, builtin := range e.builtins {
+			table[verb] = builtin
+		}
+		e.builtins = table
+		e.ownBuiltins = true
+	}
+
+	e.builtins[name] = fn
+	return nil
+}
+
+// hostNamespace reports whether the host registered verbs under namespace
+func (e *Evaluator) hostNamespace(namespace string) bool {
+	prefix := namespace + "."
+	for name := range e.builtins {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func validVerbName(name string) error {
+	if name == "" || strings.ContainsAny(name, " \t\n\"'`$#[]") {
+		return fmt.Errorf("invalid verb name %q", name)
+	}
+	return nil
+}
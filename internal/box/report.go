@@ -0,0 +1,148 @@
+package box
+
+import (
+	"encoding/json"
+	"path/filepath"
+)
+
+// Machine-readable error output. A JSON line carries one BoxError with its
+// location, help, code and stack; a SARIF log carries every error found
+// in a parse or check so code review tools can annotate the lines.
+// Each check rule becomes a SARIF rule, box/<rule>; errors that are not
+// from a check use box/error.
+
+// FormatErrorJSON renders an error as a single line of JSON
+func FormatErrorJSON(err *BoxError) (string, error) {
+	line, jsonErr := json.Marshal(err)
+	if jsonErr != nil {
+		return "", jsonErr
+	}
+	return string(line) + "\n", nil
+}
+
+// FormatDiagnosticJSON renders a diagnostic as a single line of JSON, the
+// error's fields with its rule and severity
+func FormatDiagnosticJSON(d *Diagnostic) (string, error) {
+	line, err := json.Marshal(d)
+	if err != nil {
+		return "", err
+	}
+	return string(line) + "\n", nil
+}
+
+const (
+	sarifSchema  = "https://json.schemastore.org/sarif-2.1.0.json"
+	sarifVersion = "2.1.0"
+	sarifInfoURI = "https://github.com/shrub4thedub/boxlang"
+)
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string `json:"name"`
+	InformationURI string `json:"informationUri"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId,omitempty"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations,omitempty"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifact `json:"artifactLocation"`
+	Region           *sarifRegion  `json:"region,omitempty"`
+}
+
+type sarifArtifact struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn,omitempty"`
+	EndColumn   int `json:"endColumn,omitempty"`
+}
+
+// Diagnostics wraps errors, such as parse errors, as error diagnostics
+// under the rule "error"
+func Diagnostics(errs []*BoxError) []Diagnostic {
+	diags := make([]Diagnostic, len(errs))
+	for i, err := range errs {
+		diags[i] = Diagnostic{BoxError: *err, Rule: "error", Severity: "error"}
+	}
+	return diags
+}
+
+// FormatSARIF renders diagnostics as a SARIF 2.1.0 log with one result
+// each. The help is appended to the message, as SARIF viewers show only
+// one text per result.
+func FormatSARIF(diags []Diagnostic) (string, error) {
+	results := make([]sarifResult, 0, len(diags))
+	for _, diag := range diags {
+		err := &diag.BoxError
+		text := err.Message
+		if err.Help != "" {
+			text += "\n" + err.Help
+		}
+		result := sarifResult{
+			RuleID:  "box/" + diag.Rule,
+			Level:   diag.Severity,
+			Message: sarifMessage{Text: text},
+		}
+		if err.Location.Filename != "" {
+			result.Locations = []sarifLocation{{PhysicalLocation: sarifPhysical(err.Location)}}
+		}
+		results = append(results, result)
+	}
+
+	log := sarifLog{
+		Schema:  sarifSchema,
+		Version: sarifVersion,
+		Runs: []sarifRun{{
+			Tool:    sarifTool{Driver: sarifDriver{Name: "box", InformationURI: sarifInfoURI}},
+			Results: results,
+		}},
+	}
+	out, err := json.MarshalIndent(log, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(out) + "\n", nil
+}
+
+// sarifPhysical converts a location, leaving out the region when the line
+// is unknown
+func sarifPhysical(loc Location) sarifPhysicalLocation {
+	physical := sarifPhysicalLocation{ArtifactLocation: sarifArtifact{URI: filepath.ToSlash(loc.Filename)}}
+	if loc.Line > 0 {
+		region := &sarifRegion{StartLine: loc.Line, StartColumn: loc.Column}
+		if loc.Column > 0 && loc.Length > 0 {
+			region.EndColumn = loc.Column + loc.Length
+		}
+		physical.Region = region
+	}
+	return physical
+}
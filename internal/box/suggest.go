@@ -0,0 +1,106 @@
+package box
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// Suggest returns the candidate closest to name, or "" when none is close
+// enough to be a likely typo. It backs the "did you mean" hints in errors.
+func Suggest(name string, candidates []string) string {
+	// Allow roughly one edit per three characters
+	maxDistance := (len(name) + 2) / 3
+
+	best := ""
+	bestDistance := maxDistance + 1
+	for _, candidate := range candidates {
+		if candidate == name {
+			continue
+		}
+		if d := editDistance(name, candidate); d < bestDistance {
+			best = candidate
+			bestDistance = d
+		}
+	}
+	return best
+}
+
+// suggestProgram is Suggest for programs on $PATH. Besides typos it
+// catches a variant suffix on a real program, so "gcc-missing" suggests
+// "gcc" when there is one.
+func suggestProgram(name string, candidates []string) string {
+	if suggestion := Suggest(name, candidates); suggestion != "" {
+		return suggestion
+	}
+
+	best := ""
+	for _, candidate := range candidates {
+		if len(candidate) <= len(best) || len(candidate) >= len(name) || !strings.HasPrefix(name, candidate) {
+			continue
+		}
+		// Only split at a separator, so "go" is not offered for "gofmtx"
+		next := rune(name[len(candidate)])
+		if unicode.IsLetter(next) || unicode.IsDigit(next) {
+			continue
+		}
+		best = candidate
+	}
+	return best
+}
+
+// editDistance returns the number of single-character insertions,
+// deletions, substitutions and adjacent transpositions needed to turn a
+// into b, so "gti" is one edit from "git"
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	// Three rows: a transposition looks back two characters
+	prevPrev := make([]int, len(rb)+1)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				curr[j] = min(curr[j], prevPrev[j-2]+1)
+			}
+		}
+		prevPrev, prev, curr = prev, curr, prevPrev
+	}
+	return prev[len(rb)]
+}
+
+// pathCommands returns the names of the executables in the directories of
+// a $PATH value
+func pathCommands(path string) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, dir := range filepath.SplitList(path) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if seen[entry.Name()] || entry.IsDir() {
+				continue
+			}
+			info, err := os.Stat(filepath.Join(dir, entry.Name()))
+			if err != nil || info.IsDir() || info.Mode()&0111 == 0 {
+				continue
+			}
+			seen[entry.Name()] = true
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
@@ -0,0 +1,178 @@
+package box
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Invokable returns the functions that can be run from the command line:
+// those marked -i and not hidden, sorted by name
+func Invokable(program *Program) []*Block {
+	var fns []*Block
+	for _, fn := range program.Functions {
+		if fn.HasModifier("-i") && !fn.HasModifier("-h") {
+			fns = append(fns, fn)
+		}
+	}
+	sort.Slice(fns, func(i, j int) bool { return fns[i].Label < fns[j].Label })
+	return fns
+}
+
+// Signature renders a function's parameters for usage output: required
+// ones as <name>, defaulted ones as [name=default] and a variadic tail as
+// [name...]
+func (b *Block) Signature() string {
+	var params []string
+	for i, param := range b.Params() {
+		switch {
+		case param.Variadic:
+			params = append(params, "["+param.Name+"...]")
+		case param.HasDefault:
+			params = append(params, "["+b.Args[i]+"]")
+		default:
+			params = append(params, "<"+param.Name+">")
+		}
+	}
+	return strings.Join(params, " ")
+}
+
+// FormatUsage lists a script's invokable functions with their parameters
+// and the first line of their doc comment
+func FormatUsage(program *Program, script string) string {
+	fns := Invokable(program)
+	if len(fns) == 0 {
+		return fmt.Sprintf("%s has no invokable functions (mark one with [fn -i name])\n", script)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Usage: box %s <command> [args...]\n\nCommands:\n", script)
+
+	usages := make([]string, len(fns))
+	width := 0
+	for i, fn := range fns {
+		usages[i] = strings.TrimSpace(fn.Label + " " + fn.Signature())
+		width = max(width, len(usages[i]))
+	}
+
+	for i, fn := range fns {
+		summary, _, _ := strings.Cut(fn.Doc, "\n")
+		if summary == "" {
+			fmt.Fprintf(&b, "  %s\n", usages[i])
+		} else {
+			fmt.Fprintf(&b, "  %-*s  %s\n", width, usages[i], summary)
+		}
+	}
+	return b.String()
+}
+
+// unknownCommand reports a first argument that matches no -i function,
+// instead of quietly running [main] with it. Only an argument [main]
+// cannot take counts: without a [main], or with one that never reads its
+// arguments, any unmatched argument is an error, with the closest function
+// name as a suggestion.
+func (e *Evaluator) unknownCommand(program *Program, name string) error {
+	fns := Invokable(program)
+	if len(fns) == 0 || TakesArgs(program) {
+		return nil
+	}
+
+	names := make([]string, len(fns))
+	for i, fn := range fns {
+		names[i] = fn.Label
+	}
+
+	help := fmt.Sprintf("Run 'box %s --help' to list commands", e.filename)
+	if suggestion := Suggest(name, names); suggestion != "" {
+		help = fmt.Sprintf("Did you mean '%s'? %s", suggestion, help)
+	}
+
+	return &BoxError{
+		Message: fmt.Sprintf("unknown command: %s", name),
+		Help:    help,
+	}
+}
+
+var (
+	// argvReference matches $argv, ${argv[*]} and the like
+	argvReference = regexp.MustCompile(`\$\{?#?argv\b`)
+	// positionalReference matches $1, ${2} and the like
+	positionalReference = regexp.MustCompile(`\$\{?#?[0-9]+\b`)
+)
+
+// TakesArgs reports whether a script has a [main] that may read its
+// command line arguments: through $argv or $1 and on in [main] itself, or
+// through $argv in a function. A function's $1 is its own argument unless
+// it declares named parameters, in which case $1 is still the caller's.
+func TakesArgs(program *Program) bool {
+	if program.Main == nil {
+		return false
+	}
+
+	if reads(program.Main.Body, argvReference, positionalReference) {
+		return true
+	}
+	for _, fn := range program.Functions {
+		refs := []*regexp.Regexp{argvReference}
+		if len(fn.Params()) > 0 {
+			refs = append(refs, positionalReference)
+		}
+		if reads(fn.Body, refs...) {
+			return true
+		}
+	}
+	return false
+}
+
+// reads reports whether any expression in a body matches one of refs
+func reads(items []interface{}, refs ...*regexp.Regexp) bool {
+	matches := func(text string) bool {
+		for _, ref := range refs {
+			if ref.MatchString(text) {
+				return true
+			}
+		}
+		return false
+	}
+	readsCmd := func(cmd *Cmd) bool {
+		for ; cmd != nil; cmd = cmd.Fallback {
+			for _, arg := range cmd.Args {
+				if matches(arg.String()) {
+					return true
+				}
+			}
+			for _, redirect := range cmd.Redirects {
+				if matches(redirect.Text) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	for _, item := range items {
+		switch v := item.(type) {
+		case Cmd:
+			if readsCmd(&v) {
+				return true
+			}
+		case Pipeline:
+			for i := range v.Commands {
+				if readsCmd(&v.Commands[i]) {
+					return true
+				}
+			}
+		case Block:
+			for _, expr := range v.Exprs {
+				if matches(expr.String()) {
+					return true
+				}
+			}
+			if reads(v.Body, refs...) {
+				return true
+			}
+		}
+	}
+	return false
+}
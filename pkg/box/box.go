@@ -0,0 +1,299 @@
+// Package box embeds the Box interpreter in Go programs.
+//
+// A host parses a script once and runs it in an Interpreter configured
+// with its own arguments, environment, working directory, standard
+// streams and filesystem root:
+//
+//	program, err := box.ParseFile("build.box")
+//	if err != nil {
+//		return err
+//	}
+//	interp, err := box.New(box.WithArgs("release"), box.WithDir(workdir))
+//	if err != nil {
+//		return err
+//	}
+//	status, err := interp.Run(program)
+//
+// After a run, variables and data blocks can be read back as Go values.
+package box
+
+import (
+	"io"
+	"os"
+
+	ibox "box/internal/box"
+)
+
+// Program is a parsed Box script
+type Program = ibox.Program
+
+// Error is a located script error. Parse and runtime errors returned by
+// this package are usually of this type.
+type Error = ibox.BoxError
+
+// ErrorList is returned by ParseFile and ParseString when a script has
+// more than one error; each is an *Error, in source order
+type ErrorList = ibox.ErrorList
+
+// Diagnostic is a problem Check found: an Error with the rule that found
+// it and a severity, "error" or "warning"
+type Diagnostic = ibox.Diagnostic
+
+// Frame is one function call in an Error's Stack
+type Frame = ibox.Frame
+
+// Verb is a host-provided command. It receives the evaluated arguments
+// and a Context holding the calling scope, streams and path helpers.
+type Verb = ibox.BuiltinFunc
+
+// Value is a Box value, a list of strings
+type Value = ibox.Value
+
+// Context is what a Verb runs with. Errors a Verb returns without a
+// location are placed at the command; use Context.ArgLocation to point at
+// one of its arguments instead.
+type Context = ibox.Context
+
+// Result is what a Verb returns: an exit status or an error, and optionally
+// a Value that $(...) yields
+type Result = ibox.Result
+
+// ParseFile parses the script at path
+func ParseFile(path string) (*Program, error) {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseString(path, string(source))
+}
+
+// ParseString parses source, using name as the filename in errors. A
+// script with several errors returns them all as an ErrorList.
+func ParseString(name, source string) (*Program, error) {
+	parser, err := ibox.NewParticleParser(name)
+	if err != nil {
+		return nil, err
+	}
+	return parser.ParseString(source)
+}
+
+// Format returns source in canonical form, as 'box fmt' prints it. Imports
+// are not read, so a script formats without the files it imports.
+func Format(name, source string) (string, error) {
+	return ibox.FormatSource(name, source)
+}
+
+// Option configures an Interpreter
+type Option func(*config)
+
+type config struct {
+	args    []string
+	env     map[string]string
+	dir     string
+	root    string
+	strict  bool
+	streams ibox.Streams
+	verbs   []func(*ibox.Evaluator) error
+}
+
+// WithArgs sets the script arguments ($argv, $1, ...)
+func WithArgs(args ...string) Option {
+	return func(c *config) {
+		c.args = args
+	}
+}
+
+// WithEnv gives the interpreter its own environment instead of the process
+// one. 'env' reads and writes it and external commands receive it.
+func WithEnv(env map[string]string) Option {
+	return func(c *config) {
+		c.env = env
+	}
+}
+
+// WithDir sets the working directory relative paths resolve against and
+// external commands run in. 'cd' changes it without touching the process.
+func WithDir(dir string) Option {
+	return func(c *config) {
+		c.dir = dir
+	}
+}
+
+// WithStdio sets the streams scripts read from and write to. Nil streams
+// keep the process ones.
+func WithStdio(stdin io.Reader, stdout, stderr io.Writer) Option {
+	return func(c *config) {
+		c.streams = ibox.Streams{Stdin: stdin, Stdout: stdout, Stderr: stderr}
+	}
+}
+
+// WithRoot confines the file verbs to root: absolute script paths are
+// taken relative to it, and neither '..' nor symbolic links can leave it.
+// Links made by 'link' and 'untar' point inside root. Combined with
+// WithDir, dir is a path inside root.
+func WithRoot(root string) Option {
+	return func(c *config) {
+		c.root = root
+	}
+}
+
+// WithStrict runs scripts in strict mode: an undefined variable or data
+// field is an error even inside strings, as if the script began with
+// 'strict'
+func WithStrict() Option {
+	return func(c *config) {
+		c.strict = true
+	}
+}
+
+// WithVerb registers a host verb. Core verb names are rejected and so is
+// registering the same name twice; New reports the collision.
+func WithVerb(name string, fn Verb) Option {
+	return func(c *config) {
+		c.verbs = append(c.verbs, func(e *ibox.Evaluator) error {
+			return e.RegisterBuiltin(name, fn)
+		})
+	}
+}
+
+// WithNamespace registers a set of host verbs called as namespace.verb,
+// such as git.clone
+func WithNamespace(namespace string, verbs map[string]Verb) Option {
+	return func(c *config) {
+		c.verbs = append(c.verbs, func(e *ibox.Evaluator) error {
+			return e.RegisterNamespace(namespace, verbs)
+		})
+	}
+}
+
+// Interpreter runs programs with a fixed configuration. Variables and data
+// loaded by one run stay visible to the accessors until the next run.
+// An Interpreter must not be used from several goroutines at once.
+type Interpreter struct {
+	cfg   config
+	scope *ibox.Scope
+	eval  *ibox.Evaluator
+}
+
+// New creates an Interpreter
+func New(opts ...Option) (*Interpreter, error) {
+	var cfg config
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	in := &Interpreter{cfg: cfg}
+	if _, err := in.reset(); err != nil {
+		return nil, err
+	}
+	return in, nil
+}
+
+// reset gives the interpreter a fresh evaluator for the next run
+func (in *Interpreter) reset() (*ibox.Evaluator, error) {
+	scope := ibox.NewScope()
+	eval := ibox.NewEvaluator(scope)
+	eval.SetStreams(in.cfg.streams)
+	eval.SetStrict(in.cfg.strict)
+
+	if in.cfg.env != nil {
+		eval.SetEnv(in.cfg.env)
+	}
+	if in.cfg.dir != "" {
+		eval.SetDir(in.cfg.dir)
+	}
+	if in.cfg.root != "" {
+		if err := eval.SetRoot(in.cfg.root); err != nil {
+			return nil, err
+		}
+	}
+	for _, register := range in.cfg.verbs {
+		if err := register(eval); err != nil {
+			return nil, err
+		}
+	}
+
+	in.scope = scope
+	in.eval = eval
+	return eval, nil
+}
+
+// Run executes the program the way the box command does: an -i function
+// named by the first argument, otherwise [main]. It returns the exit
+// status; a script error is returned with status 1.
+func (in *Interpreter) Run(program *Program) (int, error) {
+	eval, err := in.reset()
+	if err != nil {
+		return 1, err
+	}
+	eval.SetFilename(program.Filename)
+
+	return status(eval.Eval(program, in.cfg.args))
+}
+
+// Call runs one of the program's -i functions with args and returns its
+// exit status.
+func (in *Interpreter) Call(program *Program, name string, args ...string) (int, error) {
+	eval, err := in.reset()
+	if err != nil {
+		return 1, err
+	}
+	eval.SetFilename(program.Filename)
+
+	return status(eval.Invoke(program, name, args))
+}
+
+func status(result ibox.Result) (int, error) {
+	if result.Error != nil {
+		return 1, result.Error
+	}
+	return result.Status, nil
+}
+
+// Var returns a variable from the script's top-level scope
+func (in *Interpreter) Var(name string) ([]string, bool) {
+	value, ok := in.scope.Variables[name]
+	return value.List(), ok
+}
+
+// Vars returns every variable in the script's top-level scope
+func (in *Interpreter) Vars() map[string][]string {
+	vars := make(map[string][]string, len(in.scope.Variables))
+	for name, value := range in.scope.Variables {
+		vars[name] = value.List()
+	}
+	return vars
+}
+
+// Data returns the fields of a [data] block. Imported blocks are named
+// namespace.block.
+func (in *Interpreter) Data(block string) (map[string][]string, bool) {
+	fields, ok := in.scope.Data[block]
+	if !ok {
+		return nil, false
+	}
+
+	data := make(map[string][]string, len(fields))
+	for field, value := range fields {
+		data[field] = value.List()
+	}
+	return data, true
+}
+
+// Verbs returns the sorted names of every verb scripts can call, core and
+// host-registered
+func (in *Interpreter) Verbs() []string {
+	return in.eval.BuiltinNames()
+}
+
+// Check analyses a program without running it, as 'box check' does, and
+// returns its diagnostics in source order. The interpreter's host verbs
+// count as defined.
+func (in *Interpreter) Check(program *Program) []Diagnostic {
+	return ibox.Check(program, in.eval.BuiltinNames())
+}
+
+// HostVerbs returns the sorted names of the verbs registered by the host
+func (in *Interpreter) HostVerbs() []string {
+	return in.eval.RegisteredBuiltins()
+}
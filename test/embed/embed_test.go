@@ -0,0 +1,338 @@
+package embed
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"box/pkg/box"
+)
+
+func parse(t *testing.T, source string) *box.Program {
+	t.Helper()
+	program, err := box.ParseString("embed.box", source)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	return program
+}
+
+func TestRun(t *testing.T) {
+	t.Run("args, stdio and status", func(t *testing.T) {
+		program := parse(t, `[main]
+  prompt "name? "
+  echo "hello $reply from $1"
+  exit 3
+end`)
+
+		var stdout bytes.Buffer
+		interp, err := box.New(
+			box.WithArgs("host"),
+			box.WithStdio(strings.NewReader("box\n"), &stdout, nil),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		status, err := interp.Run(program)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != 3 {
+			t.Errorf("status = %d, want 3", status)
+		}
+		if got := stdout.String(); got != "name? hello box from host\n" {
+			t.Errorf("stdout = %q", got)
+		}
+	})
+
+	t.Run("variables and data read back", func(t *testing.T) {
+		program := parse(t, `[data -c pkg]
+  name example
+  deps a b c
+end
+
+[main]
+  set greeting hi there
+end`)
+
+		interp, err := box.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := interp.Run(program); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, ok := interp.Var("greeting"); !ok || !reflect.DeepEqual(got, []string{"hi", "there"}) {
+			t.Errorf("greeting = %v, %v", got, ok)
+		}
+		if _, ok := interp.Vars()["argv"]; !ok {
+			t.Errorf("Vars() is missing argv")
+		}
+
+		pkg, ok := interp.Data("pkg")
+		if !ok {
+			t.Fatal("pkg data block missing")
+		}
+		if !reflect.DeepEqual(pkg["deps"], []string{"a", "b", "c"}) {
+			t.Errorf("pkg.deps = %v", pkg["deps"])
+		}
+	})
+
+	t.Run("script errors are returned", func(t *testing.T) {
+		program := parse(t, `[main]
+  nosuchverb
+end`)
+
+		interp, err := box.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := interp.Run(program)
+		if err == nil || status != 1 {
+			t.Fatalf("Run = %d, %v; want status 1 and an error", status, err)
+		}
+		if _, ok := err.(*box.Error); !ok {
+			t.Errorf("error type = %T, want *box.Error", err)
+		}
+	})
+
+	t.Run("strict mode", func(t *testing.T) {
+		program := parse(t, `[main]
+  set target release
+  echo "build $traget"
+end`)
+
+		interp, err := box.New(box.WithStrict(), box.WithStdio(nil, &bytes.Buffer{}, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = interp.Run(program)
+		boxErr, ok := err.(*box.Error)
+		if !ok {
+			t.Fatalf("Run error = %v, want *box.Error", err)
+		}
+		if !strings.Contains(boxErr.Help, "$target") {
+			t.Errorf("help = %q, want a suggestion of $target", boxErr.Help)
+		}
+	})
+}
+
+func TestCall(t *testing.T) {
+	program := parse(t, `[fn -i build target]
+  echo "building $target"
+  return 4
+end
+
+[fn helper]
+  echo helper
+end
+
+[fn -i -h internal]
+  echo internal
+end
+
+[main]
+  echo main
+end`)
+
+	var stdout bytes.Buffer
+	interp, err := box.New(box.WithStdio(nil, &stdout, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := interp.Call(program, "build", "release")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != 4 || stdout.String() != "building release\n" {
+		t.Errorf("Call = %d with output %q", status, stdout.String())
+	}
+
+	if _, err := interp.Call(program, "helper"); err == nil {
+		t.Errorf("calling a function without -i should fail")
+	}
+	if _, err := interp.Call(program, "internal"); err == nil {
+		t.Errorf("calling a hidden function should fail")
+	}
+}
+
+func TestHostEnvironment(t *testing.T) {
+	t.Run("private environment", func(t *testing.T) {
+		program := parse(t, `[main]
+  env BOX_EMBED_VAR
+  set before ${_env_result}
+  env BOX_EMBED_VAR changed
+  run printenv BOX_EMBED_VAR
+end`)
+
+		var stdout bytes.Buffer
+		interp, err := box.New(
+			box.WithEnv(map[string]string{"BOX_EMBED_VAR": "original", "PATH": os.Getenv("PATH")}),
+			box.WithStdio(nil, &stdout, nil),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := interp.Run(program); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, _ := interp.Var("before"); !reflect.DeepEqual(got, []string{"original"}) {
+			t.Errorf("before = %v", got)
+		}
+		if got := stdout.String(); got != "changed\n" {
+			t.Errorf("child saw %q", got)
+		}
+		if os.Getenv("BOX_EMBED_VAR") != "" {
+			t.Errorf("process environment was modified")
+		}
+	})
+
+	t.Run("working directory", func(t *testing.T) {
+		dir := t.TempDir()
+		cwd, _ := os.Getwd()
+
+		program := parse(t, `[main]
+  mkdir sub
+  cd sub
+  write note.txt hello
+  run sh -c "pwd"
+end`)
+
+		var stdout bytes.Buffer
+		interp, err := box.New(box.WithDir(dir), box.WithStdio(nil, &stdout, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := interp.Run(program); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, "sub", "note.txt")); err != nil {
+			t.Errorf("file not written relative to dir: %v", err)
+		}
+		if got := strings.TrimSpace(stdout.String()); got != filepath.Join(dir, "sub") {
+			t.Errorf("run executed in %q", got)
+		}
+		if now, _ := os.Getwd(); now != cwd {
+			t.Errorf("process directory changed to %s", now)
+		}
+	})
+
+	t.Run("filesystem root", func(t *testing.T) {
+		root := t.TempDir()
+
+		program := parse(t, `[main]
+  mkdir /etc
+  write /etc/motd confined
+  write ../../escape.txt nope
+  glob /etc/*
+  set found ${_glob_result}
+  mktemp
+  set tmp ${_mktemp_result}
+end`)
+
+		interp, err := box.New(box.WithRoot(root))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := interp.Run(program); err != nil {
+			t.Fatal(err)
+		}
+
+		if content, err := os.ReadFile(filepath.Join(root, "etc", "motd")); err != nil || string(content) != "confined" {
+			t.Errorf("/etc/motd inside root = %q, %v", content, err)
+		}
+		if _, err := os.Stat(filepath.Join(root, "escape.txt")); err != nil {
+			t.Errorf("'..' should stop at the root: %v", err)
+		}
+		if got, _ := interp.Var("found"); !reflect.DeepEqual(got, []string{"/etc/motd"}) {
+			t.Errorf("glob = %v, want paths inside the root", got)
+		}
+		tmp, _ := interp.Var("tmp")
+		if len(tmp) != 1 || !strings.HasPrefix(tmp[0], "/tmp/") {
+			t.Fatalf("mktemp = %v", tmp)
+		}
+		if _, err := os.Stat(filepath.Join(root, tmp[0])); err != nil {
+			t.Errorf("mktemp directory not inside root: %v", err)
+		}
+	})
+
+	t.Run("links stay inside the root", func(t *testing.T) {
+		root := t.TempDir()
+		outside := t.TempDir()
+		if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("host"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// A link left by some other program, pointing out of the root
+		if err := os.Symlink(outside, filepath.Join(root, "planted")); err != nil {
+			t.Fatal(err)
+		}
+		archive := filepath.Join(root, "evil.tar")
+		writeTar(t, archive, []tar.Header{
+			{Name: "out", Typeflag: tar.TypeSymlink, Linkname: outside},
+			{Name: "out/dropped", Typeflag: tar.TypeReg, Mode: 0644},
+		})
+
+		program := parse(t, `[main]
+  mkdir /etc
+  write /etc/hostname confined
+  link /etc/hostname /esc
+  cat /esc
+  link ../../../../../.. /up
+  cat /up/etc/hostname
+  if exists /planted/secret
+    echo "planted link followed"
+  end
+  glob /planted/*
+  echo ${_glob_result[*]}
+  untar /evil.tar /unpacked
+end`)
+
+		var stdout bytes.Buffer
+		interp, err := box.New(box.WithRoot(root), box.WithStdio(nil, &stdout, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := interp.Run(program); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := stdout.String(); got != "confinedconfined\n" {
+			t.Errorf("stdout = %q", got)
+		}
+		if content, err := os.ReadFile(filepath.Join(root, "esc")); err != nil || string(content) != "confined" {
+			t.Errorf("the link is not kept inside the root for other programs: %q, %v", content, err)
+		}
+		if _, err := os.Stat(filepath.Join(outside, "dropped")); err == nil {
+			t.Errorf("untar wrote through a link out of the root")
+		}
+	})
+}
+
+// writeTar writes an archive of empty entries
+func writeTar(t *testing.T, path string, headers []tar.Header) {
+	t.Helper()
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	tw := tar.NewWriter(file)
+	for _, header := range headers {
+		if err := tw.WriteHeader(&header); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,128 @@
+package embed
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"box/pkg/box"
+)
+
+func TestHostVerbs(t *testing.T) {
+	greet := func(args []box.Value, ctx *box.Context) box.Result {
+		var names []string
+		for _, arg := range args {
+			names = append(names, arg.String())
+		}
+		fmt.Fprintf(ctx.Stdout, "hello %s\n", strings.Join(names, " "))
+		ctx.Scope.Set("_greet_result", box.Value{"done"})
+		return box.Result{Status: 0}
+	}
+	fail := func(args []box.Value, ctx *box.Context) box.Result {
+		return box.Result{Status: 2}
+	}
+
+	t.Run("verbs and namespaces are callable", func(t *testing.T) {
+		program := parse(t, `[main]
+  greet world
+  set out ${_greet_result}
+  git.clone repo
+  git.fail
+end`)
+
+		var stdout bytes.Buffer
+		interp, err := box.New(
+			box.WithVerb("greet", greet),
+			box.WithNamespace("git", map[string]box.Verb{"clone": greet, "fail": fail}),
+			box.WithStdio(nil, &stdout, nil),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := interp.Run(program)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != 2 {
+			t.Errorf("status = %d, want git.fail's 2", status)
+		}
+
+		if got := stdout.String(); got != "hello world\nhello repo\n" {
+			t.Errorf("stdout = %q", got)
+		}
+		if got, _ := interp.Var("out"); !reflect.DeepEqual(got, []string{"done"}) {
+			t.Errorf("out = %v", got)
+		}
+		if got := interp.HostVerbs(); !reflect.DeepEqual(got, []string{"git.clone", "git.fail", "greet"}) {
+			t.Errorf("HostVerbs() = %v", got)
+		}
+	})
+
+	t.Run("verbs belong to one interpreter", func(t *testing.T) {
+		program := parse(t, `[main]
+  greet world
+end`)
+
+		interp, err := box.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := interp.Run(program); err == nil {
+			t.Errorf("greet should be unknown without registration")
+		}
+		for _, verb := range interp.Verbs() {
+			if verb == "greet" {
+				t.Errorf("Verbs() lists another interpreter's verb")
+			}
+		}
+		if len(interp.HostVerbs()) != 0 {
+			t.Errorf("HostVerbs() = %v, want none", interp.HostVerbs())
+		}
+	})
+
+	t.Run("check knows host verbs", func(t *testing.T) {
+		program := parse(t, `[main]
+  greet world
+  git.clone repo
+  gret
+end`)
+
+		interp, err := box.New(
+			box.WithVerb("greet", greet),
+			box.WithNamespace("git", map[string]box.Verb{"clone": greet}),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		diags := interp.Check(program)
+		if len(diags) != 1 || diags[0].Rule != "undefined-command" || diags[0].Location.Line != 4 {
+			t.Fatalf("Check() = %v, want gret reported", diags)
+		}
+		if diags[0].Help != "Did you mean 'greet'?" {
+			t.Errorf("help = %q", diags[0].Help)
+		}
+	})
+
+	collisions := []struct {
+		name string
+		opts []box.Option
+	}{
+		{"core verb", []box.Option{box.WithVerb("echo", greet)}},
+		{"duplicate verb", []box.Option{box.WithVerb("greet", greet), box.WithVerb("greet", greet)}},
+		{"dotted verb", []box.Option{box.WithVerb("git.clone", greet)}},
+		{"duplicate namespaced verb", []box.Option{
+			box.WithNamespace("git", map[string]box.Verb{"clone": greet}),
+			box.WithNamespace("git", map[string]box.Verb{"clone": greet}),
+		}},
+		{"invalid name", []box.Option{box.WithVerb("two words", greet)}},
+	}
+	for _, tc := range collisions {
+		t.Run("rejects "+tc.name, func(t *testing.T) {
+			if _, err := box.New(tc.opts...); err == nil {
+				t.Errorf("New succeeded, want an error")
+			}
+		})
+	}
+}
@@ -18,8 +18,11 @@ type TestCase struct {
 	Stdin      string   // Input to provide
 	ExitCode   int      // Expected exit code
 	Stdout     string   // Expected stdout content
+	StdoutHas  string   // Expected to appear somewhere in stdout
 	Stderr     string   // Expected stderr content
 	ShouldFail bool     // Whether test should fail
+	NoScript   bool     // Run box without a script (interactive mode on stdin)
+	Subcommand []string // Arguments placed before the script path (e.g. "fns")
 }
 
 // RunBoxTest executes a Box script and validates the results
@@ -36,36 +39,13 @@ func RunBoxTest(t *testing.T, testCase TestCase) {
 	}
 
 	// Build command with args
-	cmdArgs := []string{scriptPath}
-	cmdArgs = append(cmdArgs, testCase.Args...)
-
-	// Get working directory and find Box binary
-	wd, err := os.Getwd()
-	if err != nil {
-		t.Fatalf("Failed to get working directory: %v", err)
-	}
-
-	// Always build the box binary at the project root
-	projectRoot := wd
-	for {
-		if _, err := os.Stat(filepath.Join(projectRoot, "go.mod")); err == nil {
-			break
-		}
-		parent := filepath.Dir(projectRoot)
-		if parent == projectRoot {
-			t.Fatalf("Could not locate project root from %s", wd)
-		}
-		projectRoot = parent
-	}
-
-	buildPath := filepath.Join(projectRoot, "box")
-	buildCmd := exec.Command("go", "build", "-o", buildPath, "./cmd/box")
-	buildCmd.Dir = projectRoot
-	if output, err := buildCmd.CombinedOutput(); err != nil {
-		t.Fatalf("Failed to build box binary: %v\nOutput: %s", err, string(output))
+	cmdArgs := append([]string{}, testCase.Subcommand...)
+	if !testCase.NoScript {
+		cmdArgs = append(cmdArgs, scriptPath)
 	}
+	cmdArgs = append(cmdArgs, testCase.Args...)
 
-	cmd := exec.Command(buildPath, cmdArgs...)
+	cmd := exec.Command(BuildBox(t), cmdArgs...)
 
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
@@ -100,6 +80,10 @@ func RunBoxTest(t *testing.T, testCase TestCase) {
 		}
 	}
 
+	if testCase.StdoutHas != "" && !strings.Contains(stdout.String(), testCase.StdoutHas) {
+		t.Errorf("Stdout mismatch:\nExpected to contain:\n%s\n\nActual:\n%s", testCase.StdoutHas, stdout.String())
+	}
+
 	// Check stderr
 	if testCase.Stderr != "" {
 		actualStderr := strings.TrimSpace(stderr.String())
@@ -119,6 +103,36 @@ func RunBoxTest(t *testing.T, testCase TestCase) {
 	}
 }
 
+// BuildBox builds the box binary at the project root and returns its path
+func BuildBox(t *testing.T) string {
+	t.Helper()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Failed to get working directory: %v", err)
+	}
+
+	projectRoot := wd
+	for {
+		if _, err := os.Stat(filepath.Join(projectRoot, "go.mod")); err == nil {
+			break
+		}
+		parent := filepath.Dir(projectRoot)
+		if parent == projectRoot {
+			t.Fatalf("Could not locate project root from %s", wd)
+		}
+		projectRoot = parent
+	}
+
+	buildPath := filepath.Join(projectRoot, "box")
+	buildCmd := exec.Command("go", "build", "-o", buildPath, "./cmd/box")
+	buildCmd.Dir = projectRoot
+	if output, err := buildCmd.CombinedOutput(); err != nil {
+		t.Fatalf("Failed to build box binary: %v\nOutput: %s", err, string(output))
+	}
+	return buildPath
+}
+
 // LoadTestDataFile loads a test file from testdata directory
 func LoadTestDataFile(filename string) (string, error) {
 	content, err := os.ReadFile(filepath.Join("testdata", filename))
@@ -0,0 +1,271 @@
+package integration
+
+import (
+	"box/test"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	check := []string{"check"}
+	tests := []test.TestCase{
+		{
+			Name: "clean script passes",
+			Script: `[data config]
+name box
+end
+
+[fn greet who greeting=hello]
+echo "$greeting $who"
+end
+
+[main]
+set count 0
+for f in a b c
+  greet $f
+  set count 1
+end
+if test $count
+  set mode some
+else
+  set mode none
+end
+echo $mode $config.name
+end`,
+			Subcommand: check,
+			ExitCode:   0,
+			Stdout:     "",
+		},
+		{
+			Name: "unknown command",
+			Script: `[fn greet]
+echo hi
+end
+
+[main]
+gret
+end`,
+			Subcommand: check,
+			ExitCode:   1,
+			Stderr:     "Did you mean 'greet'?",
+		},
+		{
+			Name: "missing argument",
+			Script: `[fn greet who]
+echo $who
+end
+
+[main]
+greet
+end`,
+			Subcommand: check,
+			ExitCode:   1,
+			Stderr:     "function 'greet' missing argument 'who'",
+		},
+		{
+			Name: "too many arguments",
+			Script: `[fn greet who]
+echo $who
+end
+
+[main]
+greet a b
+end`,
+			Subcommand: check,
+			ExitCode:   1,
+			Stderr:     "function 'greet' takes 1 argument(s), got 2",
+		},
+		{
+			Name: "function shadowing a verb is checked",
+			Script: `[fn copy src dst]
+run cp $src $dst
+end
+
+[main]
+copy onlyone
+end`,
+			Subcommand: check,
+			ExitCode:   1,
+			Stderr:     "function 'copy' missing argument 'dst'",
+		},
+		{
+			Name: "undefined variable",
+			Script: `[main]
+set name box
+echo $nme
+end`,
+			Subcommand: check,
+			ExitCode:   1,
+			Stderr:     "Did you mean '$name'?",
+		},
+		{
+			Name: "variable set on one branch only",
+			Script: `[main]
+if test $1
+  set mode fast
+end
+echo $mode
+end`,
+			Subcommand: check,
+			ExitCode:   0,
+			Stderr:     "variable 'mode' may be used before it is set",
+		},
+		{
+			Name: "function reads a caller's variable",
+			Script: `[fn show]
+echo $name
+end
+
+[main]
+set name box
+show
+end`,
+			Subcommand: check,
+			ExitCode:   0,
+			Stdout:     "",
+		},
+		{
+			Name: "function variable set nowhere is a warning",
+			Script: `[fn show]
+echo $target
+end
+
+[main]
+show
+end`,
+			Subcommand: check,
+			ExitCode:   0,
+			Stderr:     "⚠ undefined variable: target",
+		},
+		{
+			Name: "break outside a loop",
+			Script: `[main]
+break
+end`,
+			Subcommand: check,
+			ExitCode:   1,
+			Stderr:     "break outside a loop",
+		},
+		{
+			Name: "return outside a function",
+			Script: `[main]
+return 0
+end`,
+			Subcommand: check,
+			ExitCode:   1,
+			Stderr:     "Use 'exit' to end the script",
+		},
+		{
+			Name: "unreachable code after exit",
+			Script: `[main]
+exit 0
+echo never
+end`,
+			Subcommand: check,
+			ExitCode:   0,
+			Stderr:     "⚠ unreachable code",
+		},
+		{
+			Name: "code after unreachable code is still checked",
+			Script: `[fn helper]
+echo hi
+end
+
+[main]
+exit 0
+helper
+return 0
+end`,
+			Subcommand: check,
+			ExitCode:   1,
+			Stderr:     "1 error, 1 warning",
+		},
+		{
+			Name: "for without in",
+			Script: `[main]
+for x
+  echo $x
+end
+end`,
+			Subcommand: check,
+			ExitCode:   1,
+			Stderr:     "for: invalid syntax, expected 'for var in list'",
+		},
+		{
+			Name: "unused function and data",
+			Script: `[data spare]
+x 1
+end
+
+[fn helper]
+echo hi
+end
+
+[main]
+echo main
+end`,
+			Subcommand: check,
+			ExitCode:   0,
+			Stderr:     "0 errors, 2 warnings",
+		},
+		{
+			Name: "write to constant data",
+			Script: `[data -c config]
+port 80
+end
+
+[main]
+data set config.port 90
+echo $config.port
+end`,
+			Subcommand: check,
+			ExitCode:   1,
+			Stderr:     "cannot modify constant data block 'config'",
+		},
+		{
+			Name: "hidden member of an import",
+			Script: `import ../runtime/testdata/hidden_util
+
+[main]
+hidden_util.helper x
+end`,
+			Subcommand: check,
+			ExitCode:   1,
+			Stderr:     "function 'helper' is hidden in namespace 'hidden_util'",
+		},
+		{
+			Name: "parse errors fail the check",
+			Script: `[main]
+echo "unterminated
+end`,
+			Subcommand: check,
+			ExitCode:   1,
+			Stderr:     "unterminated string",
+		},
+		{
+			Name: "json carries rule and severity",
+			Script: `[main]
+exit 0
+echo never
+end`,
+			Subcommand: []string{"check", "--error-format=json"},
+			ExitCode:   0,
+			Stderr:     `"rule":"unreachable","severity":"warning"}`,
+		},
+		{
+			Name: "sarif names the rule",
+			Script: `[main]
+break
+end`,
+			Subcommand: []string{"check", "--error-format=sarif"},
+			ExitCode:   1,
+			StdoutHas: `"ruleId": "box/misplaced-verb",
+          "level": "error",`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			test.RunBoxTest(t, tc)
+		})
+	}
+}
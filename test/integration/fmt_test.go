@@ -0,0 +1,157 @@
+package integration
+
+import (
+	"box/test"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFmt(t *testing.T) {
+	fmtCmd := []string{"fmt"}
+	tests := []test.TestCase{
+		{
+			Name: "indents blocks and control structures",
+			Script: `[fn   greet who]
+echo   "hi $who"
+if test $who
+echo yes
+    else
+ echo no
+end
+end`,
+			Subcommand: fmtCmd,
+			Stdout: `[fn greet who]
+  echo "hi $who"
+  if test $who
+    echo yes
+  else
+    echo no
+  end
+end`,
+		},
+		{
+			Name: "aligns data values",
+			Script: `[data -c config]
+name myproject
+  version 1.0
+author   me
+end`,
+			Subcommand: fmtCmd,
+			Stdout: `[data -c config]
+  name     myproject
+  version  1.0
+  author   me
+end`,
+		},
+		{
+			Name: "keeps comments and single blank lines",
+			Script: `# Greets people
+[fn greet who]   # header
+
+
+  echo $who # trailing
+
+  # before end
+end
+
+
+# footer`,
+			Subcommand: fmtCmd,
+			Stdout: `# Greets people
+[fn greet who] # header
+  echo $who # trailing
+
+  # before end
+end
+
+# footer`,
+		},
+		{
+			Name: "normalises quotes and spacing",
+			Script: `[main]
+echo 'plain' '$literal' "x"|sort>out.txt
+run false ?   echo failed
+end`,
+			Subcommand: fmtCmd,
+			Stdout: `[main]
+  echo "plain" '$literal' "x" | sort > out.txt
+  run false ? echo failed
+end`,
+		},
+		{
+			Name: "keeps imports and top-level code in place",
+			Script: `import   testdata/missing
+set x 1
+[fn show]
+echo $x
+end
+show`,
+			Subcommand: fmtCmd,
+			Stdout: `import testdata/missing
+set x 1
+[fn show]
+  echo $x
+end
+show`,
+		},
+		{
+			Name: "diff mode",
+			Script: `[main]
+echo   hi
+end`,
+			Subcommand: []string{"fmt", "-d"},
+			StdoutHas: `@@ -1,3 +1,3 @@
+ [main]
+-echo   hi
++  echo hi
+ end`,
+		},
+		{
+			Name:       "formats stdin",
+			NoScript:   true,
+			Subcommand: fmtCmd,
+			Stdin:      "for x in a b\necho $x\nend\n",
+			Stdout: `for x in a b
+  echo $x
+end`,
+		},
+		{
+			Name: "refuses a script that does not parse",
+			Script: `[main]
+echo "unterminated
+end`,
+			Subcommand: fmtCmd,
+			ExitCode:   1,
+			Stderr:     "unterminated string",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			test.RunBoxTest(t, tc)
+		})
+	}
+}
+
+func TestFmtWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "script.box")
+	if err := os.WriteFile(path, []byte("[main]\necho   hi\nend\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	test.RunBoxTest(t, test.TestCase{
+		Name:       "rewrites the file",
+		NoScript:   true,
+		Subcommand: []string{"fmt", "-w", path},
+		Stdout:     "",
+	})
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "[main]\n  echo hi\nend\n"; string(got) != want {
+		t.Errorf("file = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,365 @@
+package integration
+
+import (
+	"box/test"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// lspClient drives 'box lsp' over its stdin and stdout
+type lspClient struct {
+	t             *testing.T
+	in            io.WriteCloser
+	out           *bufio.Reader
+	nextID        int
+	notifications []lspMessage
+}
+
+type lspMessage struct {
+	ID     *int            `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (c *lspClient) send(msg map[string]any) {
+	c.t.Helper()
+	msg["jsonrpc"] = "2.0"
+	body, err := json.Marshal(msg)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if _, err := fmt.Fprintf(c.in, "Content-Length: %d\r\n\r\n%s", len(body), body); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *lspClient) receive() lspMessage {
+	c.t.Helper()
+	length := 0
+	for {
+		line, err := c.out.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("reading header: %v", err)
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if value, ok := strings.CutPrefix(line, "Content-Length: "); ok {
+			length, _ = strconv.Atoi(value)
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(c.out, body); err != nil {
+		c.t.Fatalf("reading body: %v", err)
+	}
+	var msg lspMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		c.t.Fatalf("decoding %s: %v", body, err)
+	}
+	return msg
+}
+
+// request sends a request and decodes its result into result, keeping
+// the notifications that arrive before it
+func (c *lspClient) request(method string, params any, result any) {
+	c.t.Helper()
+	c.nextID++
+	c.send(map[string]any{"id": c.nextID, "method": method, "params": params})
+	for {
+		msg := c.receive()
+		if msg.ID == nil {
+			c.notifications = append(c.notifications, msg)
+			continue
+		}
+		if *msg.ID != c.nextID {
+			c.t.Fatalf("%s: got the response to request %d", method, *msg.ID)
+		}
+		if msg.Error != nil {
+			c.t.Fatalf("%s: %s", method, msg.Error.Message)
+		}
+		if result != nil {
+			if err := json.Unmarshal(msg.Result, result); err != nil {
+				c.t.Fatalf("%s: decoding %s: %v", method, msg.Result, err)
+			}
+		}
+		return
+	}
+}
+
+func (c *lspClient) notify(method string, params any) {
+	c.t.Helper()
+	c.send(map[string]any{"method": method, "params": params})
+}
+
+// diagnostics waits for the diagnostics published for uri
+func (c *lspClient) diagnostics(uri string) []lspDiagnostic {
+	c.t.Helper()
+	for {
+		var msg lspMessage
+		if len(c.notifications) > 0 {
+			msg, c.notifications = c.notifications[0], c.notifications[1:]
+		} else {
+			msg = c.receive()
+		}
+		if msg.Method != "textDocument/publishDiagnostics" {
+			continue
+		}
+		var params struct {
+			URI         string          `json:"uri"`
+			Diagnostics []lspDiagnostic `json:"diagnostics"`
+		}
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			c.t.Fatal(err)
+		}
+		if params.URI == uri {
+			return params.Diagnostics
+		}
+	}
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Code     string   `json:"code"`
+	Message  string   `json:"message"`
+}
+
+func TestLSP(t *testing.T) {
+	dir := t.TempDir()
+	lib := `# Shouts a word
+[fn shout word]
+  echo $word
+end
+
+[data settings]
+  level loud
+end`
+	script := `import lib
+
+[data -c config]
+  name    box
+  version 1.0
+end
+
+# Greets someone
+[fn greet who greeting=hello]
+  echo "$greeting $who"
+end
+
+[main]
+  greet $config.name
+  lib.shout $lib.settings.level
+  gret
+end`
+	for name, content := range map[string]string{"lib.box": lib, "script.box": script} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Imports are found from the server's directory, as when running
+	cmd := exec.Command(test.BuildBox(t), "lsp")
+	cmd.Dir = dir
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	client := &lspClient{t: t, in: in, out: bufio.NewReader(out)}
+	uri := (&url.URL{Scheme: "file", Path: filepath.Join(dir, "script.box")}).String()
+	libURI := (&url.URL{Scheme: "file", Path: filepath.Join(dir, "lib.box")}).String()
+	doc := map[string]any{"uri": uri}
+	at := func(line, character int) map[string]any {
+		return map[string]any{"textDocument": doc, "position": lspPosition{line, character}}
+	}
+
+	var initResult struct {
+		Capabilities map[string]any `json:"capabilities"`
+	}
+	client.request("initialize", map[string]any{"processId": nil, "rootUri": nil, "capabilities": map[string]any{}}, &initResult)
+	for _, capability := range []string{"definitionProvider", "hoverProvider", "completionProvider", "documentSymbolProvider"} {
+		if initResult.Capabilities[capability] == nil {
+			t.Errorf("initialize: no %s", capability)
+		}
+	}
+	client.notify("initialized", map[string]any{})
+
+	t.Run("diagnostics", func(t *testing.T) {
+		client.t = t
+		client.notify("textDocument/didOpen", map[string]any{"textDocument": map[string]any{
+			"uri": uri, "languageId": "box", "version": 1, "text": script,
+		}})
+		diags := client.diagnostics(uri)
+		if len(diags) != 1 {
+			t.Fatalf("diagnostics = %+v, want gret reported", diags)
+		}
+		want := lspRange{lspPosition{15, 2}, lspPosition{15, 6}}
+		if d := diags[0]; d.Code != "undefined-command" || d.Severity != 1 || d.Range != want || !strings.Contains(d.Message, "Did you mean 'greet'?") {
+			t.Errorf("diagnostic = %+v", d)
+		}
+	})
+
+	t.Run("definition", func(t *testing.T) {
+		client.t = t
+		tests := []struct {
+			name      string
+			line, col int
+			uri       string
+			want      int
+		}{
+			{"function", 13, 3, uri, 8},
+			{"data field", 13, 17, uri, 3},
+			{"data block", 13, 11, uri, 2},
+			{"imported function", 14, 8, libURI, 1},
+			{"imported data field", 14, 27, libURI, 6},
+			{"imported data block", 14, 20, libURI, 5},
+			{"import", 0, 8, libURI, 0},
+		}
+		for _, tc := range tests {
+			var location struct {
+				URI   string   `json:"uri"`
+				Range lspRange `json:"range"`
+			}
+			client.request("textDocument/definition", at(tc.line, tc.col), &location)
+			if location.URI != tc.uri || location.Range.Start.Line != tc.want {
+				t.Errorf("%s: definition = %+v, want line %d of %s", tc.name, location, tc.want, tc.uri)
+			}
+		}
+	})
+
+	t.Run("hover", func(t *testing.T) {
+		client.t = t
+		tests := []struct {
+			name      string
+			line, col int
+			want      []string
+		}{
+			{"function", 13, 3, []string{"greet <who> [greeting=hello]", "Greets someone"}},
+			{"imported function", 14, 8, []string{"lib.shout <word>", "Shouts a word"}},
+			{"verb", 9, 3, []string{"echo ARG…", "Print the arguments"}},
+			{"data field", 13, 17, []string{"config.name box"}},
+		}
+		for _, tc := range tests {
+			var hover struct {
+				Contents struct {
+					Value string `json:"value"`
+				} `json:"contents"`
+			}
+			client.request("textDocument/hover", at(tc.line, tc.col), &hover)
+			for _, want := range tc.want {
+				if !strings.Contains(hover.Contents.Value, want) {
+					t.Errorf("%s: hover = %q, want %q in it", tc.name, hover.Contents.Value, want)
+				}
+			}
+		}
+	})
+
+	t.Run("completion", func(t *testing.T) {
+		client.t = t
+		tests := []struct {
+			name string
+			line string
+			want []string
+		}{
+			{"verbs and functions", "  gr", []string{"greet"}},
+			{"namespaces", "  l", []string{"len", "lib", "link"}},
+			{"namespaced functions", "  lib.", []string{"shout"}},
+			{"variables", "  echo $", []string{"argv", "config", "lib", "status"}},
+			{"data fields", "  echo ${config.", []string{"name", "version"}},
+			{"imported data", "  echo $lib.settings.", []string{"level"}},
+		}
+		for i, tc := range tests {
+			edited := strings.Replace(script, "  gret\n", tc.line+"\n", 1)
+			client.notify("textDocument/didChange", map[string]any{
+				"textDocument":   map[string]any{"uri": uri, "version": i + 2},
+				"contentChanges": []map[string]any{{"text": edited}},
+			})
+			var list struct {
+				Items []struct {
+					Label string `json:"label"`
+				} `json:"items"`
+			}
+			client.request("textDocument/completion", at(15, len(tc.line)), &list)
+			var labels []string
+			for _, item := range list.Items {
+				labels = append(labels, item.Label)
+			}
+			got := strings.Join(labels, " ")
+			for _, want := range tc.want {
+				if !strings.Contains(" "+got+" ", " "+want+" ") {
+					t.Errorf("%s: completion = %v, want %s", tc.name, labels, want)
+				}
+			}
+		}
+	})
+
+	t.Run("document symbols", func(t *testing.T) {
+		client.t = t
+		var symbols []struct {
+			Name     string `json:"name"`
+			Kind     int    `json:"kind"`
+			Range    lspRange
+			Children []struct {
+				Name string `json:"name"`
+			} `json:"children"`
+		}
+		client.request("textDocument/documentSymbol", map[string]any{"textDocument": doc}, &symbols)
+		if len(symbols) != 2 || symbols[0].Name != "config" || symbols[1].Name != "greet" {
+			t.Fatalf("symbols = %+v, want config and greet", symbols)
+		}
+		if len(symbols[0].Children) != 2 || symbols[0].Children[1].Name != "version" {
+			t.Errorf("config fields = %+v", symbols[0].Children)
+		}
+		if symbols[1].Range.Start.Line != 8 || symbols[1].Range.End.Line != 10 {
+			t.Errorf("greet range = %+v", symbols[1].Range)
+		}
+	})
+
+	client.t = t
+	client.request("shutdown", nil, nil)
+	client.notify("exit", nil)
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("exit after shutdown: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server did not exit")
+	}
+}
@@ -0,0 +1,72 @@
+package integration
+
+import (
+	"box/test"
+	"testing"
+)
+
+func TestInteractiveSession(t *testing.T) {
+	tests := []test.TestCase{
+		{
+			Name:     "state persists across lines",
+			NoScript: true,
+			Stdin: `set name "box user"
+echo "hello $name"
+set name again
+echo $name`,
+			ExitCode: 0,
+			Stdout: `hello box user
+again`,
+		},
+		{
+			Name:     "multi-line blocks are buffered until end",
+			NoScript: true,
+			Stdin: `[fn greet who]
+  echo "hi $who"
+end
+for i in 1 2
+  greet $i
+end
+if exists /
+  echo "root exists"
+end`,
+			ExitCode: 0,
+			Stdout: `hi 1
+hi 2
+root exists`,
+		},
+		{
+			Name:     "errors do not end the session",
+			NoScript: true,
+			Stdin: `nosuchverb
+echo "still here"`,
+			ExitCode: 0,
+			Stdout:   "still here",
+			Stderr:   "unknown command: nosuchverb",
+		},
+		{
+			Name:     "importing a file again is a no-op",
+			NoScript: true,
+			Stdin: `import ../runtime/testdata/const_util
+echo ${const_util.cfg.name}
+import ../runtime/testdata/const_util`,
+			ExitCode: 0,
+			Stdout:   "fixed",
+		},
+		{
+			Name:     "exit ends the session with its status",
+			NoScript: true,
+			Stdin: `echo before
+exit 4
+echo after`,
+			ExitCode: 4,
+			Stdout:   "before",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.Name, func(t *testing.T) {
+			test.RunBoxTest(t, testCase)
+		})
+	}
+}
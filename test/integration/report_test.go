@@ -0,0 +1,74 @@
+package integration
+
+import (
+	"box/test"
+	"testing"
+)
+
+func TestErrorFormats(t *testing.T) {
+	tests := []test.TestCase{
+		{
+			Name: "json reports a runtime error on one line",
+			Script: `[fn greet]
+echo $nme
+end
+
+[main]
+set name world
+greet
+end`,
+			Subcommand: []string{"--error-format=json"},
+			ExitCode:   1,
+			Stderr:     `{"message":"undefined variable: nme","location":{"file":`,
+		},
+		{
+			Name: "json includes help and stack",
+			Script: `[fn greet]
+echo $nme
+end
+
+[main]
+set name world
+greet
+end`,
+			Subcommand: []string{"--error-format=json"},
+			ExitCode:   1,
+			Stderr:     `"line":2,"column":6,"length":4},"help":"Did you mean '$name'?","stack":[{"function":"greet",`,
+		},
+		{
+			Name: "sarif reports parse errors on stdout",
+			Script: `[main]
+echo "unterminated
+end`,
+			Subcommand: []string{"check", "--error-format=sarif"},
+			ExitCode:   1,
+			StdoutHas: `"level": "error",
+          "message": {
+            "text": "unterminated string`,
+		},
+		{
+			Name: "sarif is refused when running a script",
+			Script: `[main]
+echo ran
+end`,
+			Subcommand: []string{"--error-format=sarif"},
+			ExitCode:   1,
+			Stderr:     "use 'box check --error-format=sarif <script.box>'",
+		},
+		{
+			Name: "unknown format",
+			Script: `[main]
+echo ran
+end`,
+			Subcommand: []string{"--error-format=xml"},
+			ExitCode:   1,
+			Stderr:     `Unknown error format "xml"`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			test.RunBoxTest(t, tc)
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package integration
+
+import (
+	"box/test"
+	"strings"
+	"testing"
+)
+
+const invokableScript = `# Build the project for a target
+[fn -i build target=debug]
+echo "build $target"
+end
+
+# Open a file
+# in the editor
+[fn -i open path]
+echo "open $path"
+end
+
+[fn -i -h secret]
+echo "secret"
+end
+
+[fn helper]
+echo "helper"
+end
+
+[main]
+echo "main $1"
+end`
+
+// quietScript's [main] ignores its arguments, so one can only be a command
+var quietScript = strings.Replace(invokableScript, `echo "main $1"`, `echo "main"`, 1)
+
+// helperArgsScript's only $1 is a helper's own argument
+var helperArgsScript = strings.Replace(quietScript, `echo "helper"`, `echo "helper $1"`, 1)
+
+func TestInvokableUsage(t *testing.T) {
+	tests := []test.TestCase{
+		{
+			Name:     "--help lists invokable functions",
+			Script:   quietScript,
+			Args:     []string{"--help"},
+			ExitCode: 0,
+			StdoutHas: `Commands:
+  build [target=debug]  Build the project for a target
+  open <path>           Open a file`,
+		},
+		{
+			Name:       "fns subcommand lists invokable functions",
+			Script:     invokableScript,
+			Subcommand: []string{"fns"},
+			ExitCode:   0,
+			StdoutHas: `Commands:
+  build [target=debug]  Build the project for a target
+  open <path>           Open a file`,
+		},
+		{
+			Name:     "mistyped command suggests the closest function",
+			Script:   quietScript,
+			Args:     []string{"buidl"},
+			ExitCode: 1,
+			Stderr:   "Did you mean 'build'?",
+		},
+		{
+			Name:     "unrelated argument is an error when main ignores arguments",
+			Script:   quietScript,
+			Args:     []string{"totally-unrelated"},
+			ExitCode: 1,
+			Stderr:   "unknown command: totally-unrelated",
+		},
+		{
+			Name:     "a function's own $1 is not main's argument",
+			Script:   helperArgsScript,
+			Args:     []string{"biuld"},
+			ExitCode: 1,
+			Stderr:   "Did you mean 'build'?",
+		},
+		{
+			Name:     "--help lists commands when only a function reads $1",
+			Script:   helperArgsScript,
+			Args:     []string{"--help"},
+			ExitCode: 0,
+			StdoutHas: `Commands:
+  build [target=debug]`,
+		},
+		{
+			Name:     "near miss reaches a main that reads it",
+			Script:   invokableScript,
+			Args:     []string{"bold"},
+			ExitCode: 0,
+			Stdout:   "main bold",
+		},
+		{
+			Name:     "--help reaches a main that reads it",
+			Script:   invokableScript,
+			Args:     []string{"--help"},
+			ExitCode: 0,
+			Stdout:   "main --help",
+		},
+		{
+			Name:     "unrelated arguments still reach main",
+			Script:   invokableScript,
+			Args:     []string{"notes.txt"},
+			ExitCode: 0,
+			Stdout:   "main notes.txt",
+		},
+		{
+			Name: "unknown command without main is an error",
+			Script: `[fn -i build]
+echo "build"
+end`,
+			Args:     []string{"deploy"},
+			ExitCode: 1,
+			Stderr:   "unknown command: deploy",
+		},
+		{
+			Name: "script without invokable functions",
+			Script: `[main]
+echo "main"
+end`,
+			Args:      []string{"--help"},
+			ExitCode:  0,
+			StdoutHas: "has no invokable functions",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.Name, func(t *testing.T) {
+			test.RunBoxTest(t, testCase)
+		})
+	}
+}
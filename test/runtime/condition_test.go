@@ -0,0 +1,246 @@
+package runtime
+
+import (
+	"box/test"
+	"testing"
+)
+
+func TestConditions(t *testing.T) {
+	tests := []test.TestCase{
+		{
+			Name: "not negates a command",
+			Script: `[main]
+if not exists /definitely/not/here
+echo missing
+end
+end`,
+			ExitCode: 0,
+			Stdout:   "missing",
+		},
+		{
+			Name: "and requires both",
+			Script: `[main]
+set a 1
+if match $a 1 and match $a 2
+echo both
+else
+echo "not both"
+end
+end`,
+			ExitCode: 0,
+			Stdout:   "not both",
+		},
+		{
+			Name: "or short-circuits",
+			Script: `[main]
+if match x x or exit 3
+echo short
+end
+end`,
+			ExitCode: 0,
+			Stdout:   "short",
+		},
+		{
+			Name: "not binds tighter than and",
+			Script: `[main]
+if not match a b and match c c
+echo yes
+end
+end`,
+			ExitCode: 0,
+			Stdout:   "yes",
+		},
+		{
+			Name: "elif with operators",
+			Script: `[main]
+set v 2
+if match $v 1
+echo one
+elif match $v 2 or match $v 3
+echo "two or three"
+end
+end`,
+			ExitCode: 0,
+			Stdout:   "two or three",
+		},
+		{
+			Name: "while with not",
+			Script: `[main]
+set i 0
+while not match $i 3
+set i $(arith $i + 1)
+end
+echo $i
+end`,
+			ExitCode: 0,
+			Stdout:   "3",
+		},
+		{
+			Name: "failing condition does not halt",
+			Script: `[main]
+if run false
+echo wrong
+end
+echo "still running"
+end`,
+			ExitCode: 0,
+			Stdout:   "still running",
+		},
+		{
+			Name: "lone variable tests for a value",
+			Script: `[main]
+set empty ""
+set full yes
+if $empty
+echo wrong
+end
+if $full and not ${argv[0]}
+echo "full, no args"
+end
+end`,
+			ExitCode: 0,
+			Stdout:   "full, no args",
+		},
+		{
+			Name: "missing command after operator",
+			Script: `[main]
+if exists /tmp and
+echo x
+end
+end`,
+			ExitCode: 1,
+			Stderr:   "if: missing command in condition",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.Name, func(t *testing.T) {
+			test.RunBoxTest(t, testCase)
+		})
+	}
+}
+
+func TestControlHeaders(t *testing.T) {
+	tests := []test.TestCase{
+		{
+			Name: "quoted argument with spaces",
+			Script: `[main]
+set greeting "hello world"
+if match $greeting "hello world"
+echo matched
+end
+end`,
+			ExitCode: 0,
+			Stdout:   "matched",
+		},
+		{
+			Name: "whole list in a condition",
+			Script: `[main]
+set xs a b c
+if match c ${xs[*]}
+echo "has c"
+end
+end`,
+			ExitCode: 0,
+			Stdout:   "has c",
+		},
+		{
+			Name: "command substitution in a condition",
+			Script: `[main]
+if match $(len a) 1
+echo one
+end
+end`,
+			ExitCode: 0,
+			Stdout:   "one",
+		},
+		{
+			Name: "while re-evaluates its header",
+			Script: `[main]
+set n 0
+while not match $n 2
+echo "n=$n"
+set n $(arith $n + 1)
+end
+end`,
+			ExitCode: 0,
+			Stdout: `n=0
+n=1`,
+		},
+		{
+			Name: "for expands its list",
+			Script: `[main]
+set files a.c "b c.c"
+set dir src
+for f in ${files[*]} ${dir}/main.c
+echo $f
+end
+end`,
+			ExitCode: 0,
+			Stdout: `a.c
+b c.c
+src/main.c`,
+		},
+		{
+			Name: "header error is located",
+			Script: `[main]
+if match $missing x
+echo no
+end
+end`,
+			ExitCode: 1,
+			Stderr:   "undefined variable: missing",
+		},
+		{
+			Name: "while true until break",
+			Script: `[main]
+set i 0
+while true
+set i $(arith $i + 1)
+if match $i 3
+break
+end
+end
+echo $i
+if false
+echo never
+end
+end`,
+			ExitCode: 0,
+			Stdout:   "3",
+		},
+		{
+			Name: "verb error is false",
+			Script: `[main]
+if cat /nonexistent/file
+echo yes
+else
+echo "no $status"
+end
+while cat /nonexistent/file
+echo never
+end
+echo done
+end`,
+			ExitCode: 0,
+			Stdout: `no 1
+done`,
+		},
+		{
+			Name: "unknown command is an error",
+			Script: `[main]
+if gret
+echo yes
+end
+end`,
+			ExitCode: 1,
+			Stderr:   "unknown command: gret",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.Name, func(t *testing.T) {
+			test.RunBoxTest(t, testCase)
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package runtime
+
+import (
+	"box/test"
+	"testing"
+)
+
+func TestDataBlocks(t *testing.T) {
+	tests := []test.TestCase{
+		{
+			Name: "data set updates a mutable block",
+			Script: `[data state]
+step init
+end
+
+[main]
+data set state.step build
+echo ${state.step}
+end`,
+			ExitCode: 0,
+			Stdout:   "build",
+		},
+		{
+			Name: "data set from a function is visible to the caller",
+			Script: `[data state]
+count 0
+end
+
+[fn bump]
+data set state.count 1
+end
+
+[main]
+bump
+echo ${state.count}
+end`,
+			ExitCode: 0,
+			Stdout:   "1",
+		},
+		{
+			Name: "data set adds new fields",
+			Script: `[data state]
+step init
+end
+
+[main]
+data set state.tags a b c
+echo ${state.tags}
+end`,
+			ExitCode: 0,
+			Stdout:   "a",
+		},
+		{
+			Name: "constant blocks cannot be modified",
+			Script: `[data -c pkg]
+name pack
+end
+
+[main]
+data set pkg.name other
+echo "unreachable"
+end`,
+			ExitCode: 1,
+			Stderr:   "cannot modify constant data block 'pkg'",
+		},
+		{
+			Name: "constant modification error is located",
+			Script: `[data -c pkg]
+name pack
+end
+
+[main]
+data set pkg.name other
+end`,
+			ExitCode: 1,
+			Stderr:   "test.box:6:1",
+		},
+		{
+			Name: "constant blocks cannot be modified from their own file",
+			Script: `import testdata/const_util
+
+[main]
+const_util.tweak
+echo "unreachable"
+end`,
+			ExitCode: 1,
+			Stderr:   "cannot modify constant data block 'cfg'",
+		},
+		{
+			Name: "imported functions set their own file's blocks",
+			Script: `import testdata/const_util
+
+[main]
+const_util.advance
+echo ${const_util.state.name} ${const_util.cfg.name}
+end`,
+			ExitCode: 0,
+			Stdout:   "moved fixed",
+		},
+		{
+			Name: "constant blocks cannot be redefined",
+			Script: `[data -c pkg]
+name pack
+end
+
+[data pkg]
+name other
+end
+
+[main]
+echo ${pkg.name}
+end`,
+			ExitCode: 1,
+			Stderr:   "cannot redefine constant data block 'pkg'",
+		},
+		{
+			Name: "an import cannot redefine an imported constant block",
+			Script: `import testdata/const_util
+import testdata/other/const_util
+
+[main]
+echo ${const_util.cfg.name}
+end`,
+			ExitCode: 1,
+			Stderr:   "test.box:2:8]",
+		},
+		{
+			Name: "data set on a missing block",
+			Script: `[main]
+data set nothing.field value
+end`,
+			ExitCode: 1,
+			Stderr:   "no data block 'nothing'",
+		},
+		{
+			Name: "data set needs a field",
+			Script: `[data state]
+step init
+end
+
+[main]
+data set state value
+end`,
+			ExitCode: 1,
+			Stderr:   "expected block.field",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.Name, func(t *testing.T) {
+			test.RunBoxTest(t, testCase)
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package runtime
+
+import (
+	"box/test"
+	"testing"
+)
+
+func TestParameterExpansion(t *testing.T) {
+	tests := []test.TestCase{
+		{
+			Name: "suffix strip for object files",
+			Script: `[main]
+set f main.c
+echo ${f%.c}.o
+echo "${f%.c}.o"
+end`,
+			ExitCode: 0,
+			Stdout: `main.o
+main.o`,
+		},
+		{
+			Name: "modifier applies to every element",
+			Script: `[main]
+set srcs a.c lib/b.c
+set objs ${srcs[*]%.c}
+for o in ${objs[*]}
+echo ${o}.o
+end
+end`,
+			ExitCode: 0,
+			Stdout: `a.o
+lib/b.o`,
+		},
+		{
+			Name: "shortest and longest prefix and suffix",
+			Script: `[main]
+set p /usr/lib/libx.so.1
+echo ${p##*/}
+echo ${p%/*}
+echo ${p%%.*}
+echo ${p%.*}
+echo ${p#/*/}
+end`,
+			ExitCode: 0,
+			Stdout: `libx.so.1
+/usr/lib
+/usr/lib/libx
+/usr/lib/libx.so
+lib/libx.so.1`,
+		},
+		{
+			Name: "defaults",
+			Script: `[main]
+set empty ""
+echo ${missing:-fallback}
+echo "${argv[0]:-no args}"
+echo "[${empty-unset}] [${empty:-empty}]"
+end`,
+			ExitCode: 0,
+			Stdout: `fallback
+no args
+[] [empty]`,
+		},
+		{
+			Name: "error if unset",
+			Script: `[main]
+echo ${target:?no target given}
+end`,
+			ExitCode: 1,
+			Stderr:   "target: no target given",
+		},
+		{
+			Name: "lengths",
+			Script: `[main]
+set xs one three
+echo ${#xs}
+echo ${#xs[*]}
+echo ${#xs[1]}
+echo "${#xs[*]} items"
+end`,
+			ExitCode: 0,
+			Stdout: `3
+2
+5
+2 items`,
+		},
+		{
+			Name: "negative indices and slices",
+			Script: `[main]
+set xs a b c d
+echo ${xs[-1]}
+echo "${xs[1:3]}"
+echo "${xs[:-2]}"
+echo "${xs[-2:]}"
+set tail ${xs[1:]}
+echo ${#tail[*]}
+end`,
+			ExitCode: 0,
+			Stdout: `d
+b c
+a b
+c d
+3`,
+		},
+		{
+			Name: "unknown modifier",
+			Script: `[main]
+set x 1
+echo ${x^^}
+end`,
+			ExitCode: 1,
+			Stderr:   "invalid expansion",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.Name, func(t *testing.T) {
+			test.RunBoxTest(t, testCase)
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package runtime
+
+import (
+	"box/test"
+	"testing"
+)
+
+func TestForLoops(t *testing.T) {
+	tests := []test.TestCase{
+		{
+			Name: "whole list variable",
+			Script: `[main]
+set files a.c "b c.c"
+for f in ${files[*]}
+echo $f
+end
+end`,
+			ExitCode: 0,
+			Stdout: `a.c
+b c.c`,
+		},
+		{
+			Name: "glob producer",
+			Script: `[main]
+set tmp $(mktemp)
+touch ${tmp}/one.c
+touch ${tmp}/two.c
+touch ${tmp}/skip.h
+for f in glob ${tmp}/*.c
+echo found
+end
+delete $tmp
+end`,
+			ExitCode: 0,
+			Stdout: `found
+found`,
+		},
+		{
+			Name: "range producer",
+			Script: `[main]
+for i in range 3
+echo $i
+end
+for i in range 10 4 -3
+echo $i
+end
+end`,
+			ExitCode: 0,
+			Stdout: `0
+1
+2
+10
+7`,
+		},
+		{
+			Name: "function result through substitution",
+			Script: `[fn names]
+result ada grace
+end
+
+[main]
+for n in $(names)
+echo "hi $n"
+end
+end`,
+			ExitCode: 0,
+			Stdout: `hi ada
+hi grace`,
+		},
+		{
+			Name: "function and verb names are plain items",
+			Script: `[fn build]
+echo "build ran"
+end
+
+[main]
+set victim $(mktemp)
+for step in build test install
+echo $step
+end
+for w in delete $victim
+echo $w
+end
+exists $victim
+delete $victim
+end`,
+			ExitCode: 0,
+			StdoutHas: `build
+test
+install
+delete`,
+		},
+		{
+			Name: "command substitution lines",
+			Script: `[fn lines]
+echo first
+echo second
+end
+
+[main]
+for l in $(lines)
+echo "- $l"
+end
+end`,
+			ExitCode: 0,
+			Stdout: `- first
+- second`,
+		},
+		{
+			Name: "index variant",
+			Script: `[main]
+set xs a b c
+for i x in ${xs[*]}
+echo "$i=$x"
+end
+end`,
+			ExitCode: 0,
+			Stdout: `0=a
+1=b
+2=c`,
+		},
+		{
+			Name: "nested loops with break and continue",
+			Script: `[main]
+for i in range 2
+for j in range 5
+if match $j 1
+continue
+end
+if match $j 3
+break
+end
+echo "$i$j"
+end
+end
+end`,
+			ExitCode: 0,
+			Stdout: `00
+02
+10
+12`,
+		},
+		{
+			Name: "quoted verb name is a plain item",
+			Script: `[main]
+for w in "range" 2
+echo $w
+end
+end`,
+			ExitCode: 0,
+			Stdout: `range
+2`,
+		},
+		{
+			Name: "invalid header",
+			Script: `[main]
+for $x in a b
+echo $x
+end
+end`,
+			ExitCode: 1,
+			Stderr:   "for: invalid syntax",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.Name, func(t *testing.T) {
+			test.RunBoxTest(t, testCase)
+		})
+	}
+}
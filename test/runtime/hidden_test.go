@@ -0,0 +1,85 @@
+package runtime
+
+import (
+	"box/test"
+	"testing"
+)
+
+func TestHiddenBlocks(t *testing.T) {
+	tests := []test.TestCase{
+		{
+			Name: "hidden blocks are usable inside their own file",
+			Script: `import testdata/hidden_util
+
+[main]
+hidden_util.public
+echo ${hidden_util.conf.name}
+end`,
+			ExitCode: 0,
+			Stdout: `helper one s3cr3t
+helper two s3cr3t
+utilconf`,
+		},
+		{
+			Name: "hidden function rejected from importer",
+			Script: `import testdata/hidden_util
+
+[main]
+hidden_util.helper three
+end`,
+			ExitCode: 1,
+			Stderr:   "function 'helper' is hidden in namespace 'hidden_util'",
+		},
+		{
+			Name: "hidden data rejected from importer",
+			Script: `import testdata/hidden_util
+
+[main]
+echo ${hidden_util.secret.key}
+end`,
+			ExitCode: 1,
+			Stderr:   "data block 'secret' is hidden in namespace 'hidden_util'",
+		},
+		{
+			Name: "hidden data cannot be set from importer",
+			Script: `import testdata/hidden_util
+
+[main]
+data set hidden_util.secret.key pwned
+end`,
+			ExitCode: 1,
+			Stderr:   "data block 'secret' is hidden in namespace 'hidden_util'",
+		},
+		{
+			Name: "hidden function is not dispatched from the command line",
+			Script: `[fn -i -h internal]
+echo "internal"
+end
+
+[main]
+echo "main"
+end`,
+			Args:     []string{"internal"},
+			ExitCode: 0,
+			Stdout:   "main",
+		},
+		{
+			Name: "hidden function callable within the script",
+			Script: `[fn -h helper]
+echo "helped"
+end
+
+[main]
+helper
+end`,
+			ExitCode: 0,
+			Stdout:   "helped",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.Name, func(t *testing.T) {
+			test.RunBoxTest(t, testCase)
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package runtime
+
+import (
+	"box/test"
+	"testing"
+)
+
+func TestInterpolation(t *testing.T) {
+	tests := []test.TestCase{
+		{
+			Name: "adjacent braced variables",
+			Script: `[main]
+set a A
+set b B
+echo "${a}${b}"
+echo ${a}${b}
+end`,
+			ExitCode: 0,
+			Stdout: `AB
+AB`,
+		},
+		{
+			Name: "escaped dollar is literal",
+			Script: `[main]
+echo "cost: \$5"
+echo \$HOME
+end`,
+			ExitCode: 0,
+			Stdout: `cost: $5
+$HOME`,
+		},
+		{
+			Name: "single quotes are literal",
+			Script: `[main]
+set a A
+echo 'single $a ${a}'
+end`,
+			ExitCode: 0,
+			Stdout:   `single $a ${a}`,
+		},
+		{
+			Name: "values are not expanded twice",
+			Script: `[main]
+set b B
+set v '$b'
+echo "value: $v"
+echo $v
+end`,
+			ExitCode: 0,
+			Stdout: `value: $b
+$b`,
+		},
+		{
+			Name: "adjacent tokens form one word",
+			Script: `[main]
+set a A
+set parts pre"$a b"'$c'
+echo ${#parts[*]}
+echo $parts
+end`,
+			ExitCode: 0,
+			Stdout: `1
+preA b$c`,
+		},
+		{
+			Name: "lists and substitutions inside strings",
+			Script: `[main]
+set xs 1 2 3
+echo "all ${xs[*]} first $xs second $xs[1] count $(len ${xs[*]})"
+end`,
+			ExitCode: 0,
+			Stdout:   `all 1 2 3 first 1 second 2 count 3`,
+		},
+		{
+			Name: "names stop at punctuation",
+			Script: `[main]
+set a A
+echo "$a.txt ${a}_x $ lone"
+end`,
+			ExitCode: 0,
+			Stdout:   `A.txt A_x $ lone`,
+		},
+		{
+			Name: "escapes keep multibyte text intact",
+			Script: `[main]
+echo "─┬─\tok"
+end`,
+			ExitCode: 0,
+			Stdout:   "─┬─\tok",
+		},
+		{
+			Name: "substitution errors inside strings propagate",
+			Script: `[main]
+echo "value: $(nosuchcmd)"
+end`,
+			ExitCode: 1,
+			Stderr:   "unknown command: nosuchcmd",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			test.RunBoxTest(t, tt)
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package runtime
+
+import (
+	"box/test"
+	"testing"
+)
+
+func TestErrorLocations(t *testing.T) {
+	tests := []test.TestCase{
+		{
+			Name: "verb errors point at the offending argument",
+			Script: `[main]
+copy missing.txt out.txt
+end`,
+			ExitCode: 1,
+			Stderr: `test.box:2:6]
+  │
+  1│ [main]
+  2│ copy missing.txt out.txt
+  │      ─┬────────── here`,
+		},
+		{
+			Name: "other verb errors point at the command",
+			Script: `[main]
+  len
+end`,
+			ExitCode: 1,
+			Stderr:   "test.box:2:3]",
+		},
+		{
+			Name: "argument errors point at the argument",
+			Script: `[main]
+echo ok "${name:?required}"
+end`,
+			ExitCode: 1,
+			Stderr:   "test.box:2:9]",
+		},
+		{
+			Name: "substitution errors point at the substitution",
+			Script: `[main]
+set x $(nosuchcmd)
+end`,
+			ExitCode: 1,
+			Stderr:   "test.box:2:7]",
+		},
+		{
+			Name: "errors in imported functions name their file",
+			Script: `import testdata/located_util
+
+[main]
+located_util.fail
+end`,
+			ExitCode: 1,
+			Stdout:   "before",
+			Stderr:   "located_util.box:4:13]",
+		},
+		{
+			Name: "unterminated string",
+			Script: `[main]
+echo "abc
+end`,
+			ExitCode: 1,
+			Stderr:   "unterminated string",
+		},
+		{
+			Name: "header errors point at the word",
+			Script: `[main extra]
+end`,
+			ExitCode: 1,
+			Stderr:   "test.box:1:7]",
+		},
+		{
+			Name: "import errors point at the path",
+			Script: `import testdata/no_such_file
+[main]
+end`,
+			ExitCode: 1,
+			Stderr:   "test.box:1:8]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			test.RunBoxTest(t, tt)
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package runtime
+
+import (
+	"box/test"
+	"testing"
+)
+
+func TestFunctionParams(t *testing.T) {
+	tests := []test.TestCase{
+		{
+			Name: "missing argument is a located error",
+			Script: `[fn greet name]
+echo "hello $name"
+end
+
+[main]
+greet
+end`,
+			ExitCode: 1,
+			Stderr:   "function 'greet' missing argument 'name'",
+		},
+		{
+			Name: "arity error points at the call",
+			Script: `[fn greet name]
+echo "hello $name"
+end
+
+[main]
+greet a b
+end`,
+			ExitCode: 1,
+			Stderr:   "test.box:6:1",
+		},
+		{
+			Name: "too many arguments",
+			Script: `[fn greet name]
+echo "hello $name"
+end
+
+[main]
+greet a b
+end`,
+			ExitCode: 1,
+			Stderr:   "function 'greet' takes 1 argument(s), got 2",
+		},
+		{
+			Name: "defaults fill missing arguments",
+			Script: `[fn greet name greeting="hello"]
+echo "$greeting $name"
+end
+
+[main]
+greet bob
+greet bob hi
+end`,
+			ExitCode: 0,
+			Stdout: `hello bob
+hi bob`,
+		},
+		{
+			Name: "variadic parameter collects the rest",
+			Script: `[fn build mode targets...]
+echo "$mode: ${targets[*]}"
+len ${targets[*]}
+echo "count $_len_result"
+end
+
+[main]
+set extra c d
+build release a b ${extra[*]}
+build debug
+end`,
+			ExitCode: 0,
+			Stdout: `release: a b c d
+count 4
+debug: 
+count 0`,
+		},
+		{
+			Name: "list arguments are not flattened",
+			Script: `[fn show items]
+echo "${items[*]}"
+echo "${items[1]}"
+end
+
+[main]
+set fruits apple orange banana
+show ${fruits[*]}
+end`,
+			ExitCode: 0,
+			Stdout: `apple orange banana
+orange`,
+		},
+		{
+			Name: "functions without parameters take any arguments",
+			Script: `[fn loose]
+echo "$1 $2"
+end
+
+[main]
+loose a b
+end`,
+			ExitCode: 0,
+			Stdout:   "a b",
+		},
+		{
+			Name: "variadic parameter must be last",
+			Script: `[fn build targets... mode]
+echo "$mode"
+end
+
+[main]
+build a
+end`,
+			ExitCode: 1,
+			Stderr:   "variadic parameter 'targets...' must be the last parameter",
+		},
+		{
+			Name: "cli dispatch checks arity",
+			Script: `[fn -i deploy env]
+echo "deploy $env"
+end
+
+[main]
+echo "main"
+end`,
+			Args:     []string{"deploy"},
+			ExitCode: 1,
+			Stderr:   "Usage: deploy <env>",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.Name, func(t *testing.T) {
+			test.RunBoxTest(t, testCase)
+		})
+	}
+}
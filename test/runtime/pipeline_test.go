@@ -0,0 +1,80 @@
+package runtime
+
+import (
+	"box/test"
+	"testing"
+)
+
+func TestPipelines(t *testing.T) {
+	tests := []test.TestCase{
+		{
+			Name: "builtin stages",
+			Script: `[main]
+echo "hello pipes" | cat
+join , a b c | cat
+end`,
+			ExitCode: 0,
+			Stdout: `hello pipes
+a,b,c`,
+		},
+		{
+			Name: "output larger than the pipe buffer",
+			Script: `[main]
+run seq 1 200000 | run tail -n 1
+end`,
+			ExitCode: 0,
+			Stdout:   "200000",
+		},
+		{
+			Name: "streaming stage stops when reader exits",
+			Script: `[main]
+run yes | run head -n 2
+echo "status: ${status[*]}"
+end`,
+			ExitCode: 0,
+			Stdout: `y
+y
+status: 141 0`,
+		},
+		{
+			Name: "exit codes collected in order",
+			Script: `[main]
+run sh -c "exit 3" | echo "middle" | cat
+echo "codes: ${status[*]}"
+end`,
+			ExitCode: 0,
+			Stdout: `middle
+codes: 3 0 0`,
+		},
+		{
+			Name: "builtin feeding external command",
+			Script: `[main]
+echo "one two three" | run wc -w
+end`,
+			ExitCode: 0,
+			Stdout:   "3",
+		},
+		{
+			Name: "data set in a stage stays in the stage",
+			Script: `[data cfg]
+  a 1
+end
+
+[main]
+data set cfg.a 3 | data set cfg.a 4
+echo $cfg.a
+data set cfg.a 5
+echo $cfg.a
+end`,
+			ExitCode: 0,
+			Stdout: `1
+5`,
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.Name, func(t *testing.T) {
+			test.RunBoxTest(t, testCase)
+		})
+	}
+}
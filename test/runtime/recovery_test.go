@@ -0,0 +1,171 @@
+package runtime
+
+import (
+	"box/test"
+	"testing"
+)
+
+const brokenScript = `import
+
+[fn build target]
+  echo building > 
+end
+
+[main]
+  echo hi | | sort
+  build x
+end
+end`
+
+func TestParseRecovery(t *testing.T) {
+	tests := []test.TestCase{
+		{
+			Name:     "every error is reported",
+			Script:   brokenScript,
+			ExitCode: 1,
+			Stderr:   "4 errors",
+		},
+		{
+			Name:     "bad import",
+			Script:   brokenScript,
+			ExitCode: 1,
+			Stderr: `✗ expected import path after 'import'
+  ╭─[`,
+		},
+		{
+			Name:     "invalid redirect",
+			Script:   brokenScript,
+			ExitCode: 1,
+			Stderr:   "test.box:4:17]",
+		},
+		{
+			Name:     "empty pipeline command",
+			Script:   brokenScript,
+			ExitCode: 1,
+			Stderr:   "✗ missing command before '|'",
+		},
+		{
+			Name:     "stray end",
+			Script:   brokenScript,
+			ExitCode: 1,
+			Stderr: `✗ unexpected 'end'
+  ╭─[`,
+		},
+		{
+			Name: "unclosed block stops at the next header",
+			Script: `[fn helper]
+  echo helping
+
+[main]
+  helper
+end`,
+			ExitCode: 1,
+			Stderr: `✗ unclosed block
+  ╭─[`,
+		},
+		{
+			Name: "unclosed control structure",
+			Script: `[main]
+  if exists /
+    echo root
+end`,
+			ExitCode: 1,
+			Stderr:   "✗ unclosed 'if'",
+		},
+		{
+			Name: "malformed header does not hide later errors",
+			Script: `[fn]
+  echo nameless
+end
+
+[data]
+end`,
+			ExitCode: 1,
+			Stderr:   "[data] block missing data name",
+		},
+		{
+			Name: "lexing resumes on the next line",
+			Script: `[main]
+  echo "unterminated
+end
+]`,
+			ExitCode: 1,
+			Stderr:   "✗ unexpected ']'",
+		},
+		{
+			Name: "errors in an imported file",
+			Script: `import testdata/broken_util
+[main]
+  broken_util.fine
+end`,
+			ExitCode: 1,
+			Stderr:   "2 errors",
+		},
+		{
+			Name: "missing fallback after !",
+			Script: `[main]
+  exists /nope !
+end`,
+			ExitCode: 1,
+			Stderr:   "✗ missing fallback command after '!'",
+		},
+		{
+			Name: "malformed control headers",
+			Script: `[main]
+  echo never
+  for x
+    echo $x
+  end
+  if
+    echo no condition
+  end
+  while not
+  end
+end`,
+			ExitCode: 1,
+			Stderr:   "3 errors",
+		},
+		{
+			Name: "for without in",
+			Script: `[main]
+  for x
+    echo $x
+  end
+end`,
+			ExitCode: 1,
+			Stderr:   "✗ for: invalid syntax, expected 'for var in list'",
+		},
+		{
+			Name: "if without a condition",
+			Script: `[main]
+  if
+    echo no condition
+  end
+end`,
+			ExitCode: 1,
+			Stderr:   "✗ if: missing condition",
+		},
+		{
+			Name: "keywords only count at the start of a line",
+			Script: `[main]
+  echo if you build it, they will end
+end`,
+			ExitCode: 0,
+			Stdout:   "if you build it, they will end",
+		},
+		{
+			Name: "? inside a word is not an error policy",
+			Script: `[main]
+  echo file?.txt
+end`,
+			ExitCode: 0,
+			Stdout:   "file?.txt",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			test.RunBoxTest(t, tc)
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package runtime
+
+import (
+	"box/test"
+	"testing"
+)
+
+func TestFunctionScope(t *testing.T) {
+	tests := []test.TestCase{
+		{
+			Name: "function variables stay local",
+			Script: `[fn helper]
+set i 99
+set temp scratch
+end
+
+[main]
+set i 1
+helper
+echo "i=$i"
+echo "temp=${temp[*]}"
+end`,
+			ExitCode: 0,
+			Stdout: `i=1
+temp=`,
+		},
+		{
+			Name: "functions read the caller's variables",
+			Script: `[fn show]
+echo "name=$name"
+end
+
+[main]
+set name box
+show
+end`,
+			ExitCode: 0,
+			Stdout:   "name=box",
+		},
+		{
+			Name: "loop variable survives helper calls",
+			Script: `[fn helper]
+set item clobbered
+end
+
+[main]
+for item in a b
+helper
+echo $item
+end
+end`,
+			ExitCode: 0,
+			Stdout: `a
+b`,
+		},
+		{
+			Name: "export assigns in the caller",
+			Script: `[fn load]
+export config a b c
+end
+
+[main]
+load
+echo "${config[*]}"
+end`,
+			ExitCode: 0,
+			Stdout:   "a b c",
+		},
+		{
+			Name: "export without a value exports the local",
+			Script: `[fn compute]
+set answer 42
+export answer
+end
+
+[main]
+compute
+echo $answer
+end`,
+			ExitCode: 0,
+			Stdout:   "42",
+		},
+		{
+			Name: "export reaches only the direct caller",
+			Script: `[fn inner]
+export level inner
+end
+
+[fn outer]
+inner
+echo "outer sees $level"
+end
+
+[main]
+set level main
+outer
+echo "main sees $level"
+end`,
+			ExitCode: 0,
+			Stdout: `outer sees inner
+main sees main`,
+		},
+		{
+			Name: "result returns a list to the caller",
+			Script: `[fn pair a b]
+result $b $a
+end
+
+[main]
+pair x y
+echo "${_result[*]}"
+echo "${_result[1]}"
+end`,
+			ExitCode: 0,
+			Stdout: `y x
+x`,
+		},
+		{
+			Name: "result outside a function",
+			Script: `[main]
+result nope
+end`,
+			ExitCode: 1,
+			Stderr:   "result: only valid inside a function",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.Name, func(t *testing.T) {
+			test.RunBoxTest(t, testCase)
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package runtime
+
+import (
+	"box/test"
+	"testing"
+)
+
+func TestCallStack(t *testing.T) {
+	tests := []test.TestCase{
+		{
+			Name: "frames from the failure out to main",
+			Script: `[fn inner]
+  arith 1 / 0
+end
+
+[fn outer]
+  inner
+end
+
+[main]
+  outer
+end`,
+			ExitCode: 1,
+			Stderr:   "Call stack:\n  │   at inner (",
+		},
+		{
+			Name: "each frame is where that function had reached",
+			Script: `[fn inner]
+  arith 1 / 0
+end
+
+[fn outer]
+  inner
+end
+
+[main]
+  echo start
+  outer
+end`,
+			ExitCode: 1,
+			Stdout:   "start",
+			Stderr:   "test.box:6:3)\n  │   at [main] (",
+		},
+		{
+			Name: "imported frames name their file and namespace",
+			Script: `import testdata/located_util
+
+[fn build]
+  located_util.fail
+end
+
+[main]
+  build
+end`,
+			ExitCode: 1,
+			Stdout:   "before",
+			Stderr:   "at located_util.fail (testdata/located_util.box:4:13)",
+		},
+		{
+			Name: "calls inside substitutions are placed at the argument",
+			Script: `import testdata/located_util
+
+[main]
+  set x $(located_util.fail)
+end`,
+			ExitCode: 1,
+			Stderr:   "test.box:4:9)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			test.RunBoxTest(t, tt)
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package runtime
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"box/internal/box"
+	"box/test"
+)
+
+// runWithStreams evaluates a script with its output captured in buffers
+func runWithStreams(t *testing.T, script, stdin string) (string, string) {
+	t.Helper()
+
+	parser, err := box.NewParticleParser("streams.box")
+	if err != nil {
+		t.Fatalf("parser: %v", err)
+	}
+	program, err := parser.ParseString(script)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	evaluator := box.NewEvaluatorWithFilename(box.NewScope(), "streams.box")
+	evaluator.SetStreams(box.Streams{
+		Stdin:  strings.NewReader(stdin),
+		Stdout: &stdout,
+		Stderr: &stderr,
+	})
+
+	if result := evaluator.Eval(program, nil); result.Error != nil {
+		t.Fatalf("eval: %v", result.Error)
+	}
+	return stdout.String(), stderr.String()
+}
+
+func TestEvaluatorStreams(t *testing.T) {
+	t.Run("output is captured per evaluator", func(t *testing.T) {
+		first, _ := runWithStreams(t, "[main]\necho first\nend", "")
+		second, _ := runWithStreams(t, "[main]\necho second\nend", "")
+		if first != "first\n" || second != "second\n" {
+			t.Errorf("got %q and %q", first, second)
+		}
+	})
+
+	t.Run("stdin, stderr and substitution use the evaluator streams", func(t *testing.T) {
+		stdout, stderr := runWithStreams(t, `[main]
+prompt "name? "
+set upper $(echo "got $reply" | cat)
+echo $upper
+run sh -c "echo oops 1>&2"
+end`, "box\n")
+		if stdout != "name? got box\n" {
+			t.Errorf("stdout = %q", stdout)
+		}
+		if stderr != "oops\n" {
+			t.Errorf("stderr = %q", stderr)
+		}
+	})
+}
+
+func TestRedirects(t *testing.T) {
+	tests := []test.TestCase{
+		{
+			Name: "stdout and stderr redirects",
+			Script: `[fn speak]
+  echo "from function"
+end
+
+[main]
+set out "redirect.txt"
+echo "first" > $out
+speak >> $out
+run sh -c "echo problem 1>&2" 2> "errors.txt"
+cat $out errors.txt
+delete $out
+delete errors.txt
+end`,
+			ExitCode: 0,
+			Stdout: `first
+from function
+problem`,
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.Name, func(t *testing.T) {
+			test.RunBoxTest(t, testCase)
+		})
+	}
+}
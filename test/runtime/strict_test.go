@@ -0,0 +1,122 @@
+package runtime
+
+import (
+	"box/test"
+	"testing"
+)
+
+func TestStrictMode(t *testing.T) {
+	tests := []test.TestCase{
+		{
+			Name: "strings are lenient by default",
+			Script: `[main]
+set prefix out
+echo "delete /$prefx"
+end`,
+			ExitCode: 0,
+			Stdout:   "delete /",
+		},
+		{
+			Name: "strict verb rejects undefined variables in strings",
+			Script: `[main]
+set prefix out
+strict
+echo "delete /$prefx"
+end`,
+			ExitCode: 1,
+			Stderr:   "Did you mean '$prefix'?",
+		},
+		{
+			Name: "error is located at the argument",
+			Script: `[main]
+strict
+echo "$missing"
+end`,
+			ExitCode: 1,
+			Stderr:   ":3:6",
+		},
+		{
+			Name: "main modifier",
+			Script: `[data pkg]
+  repo github.com/x/y
+end
+
+[main -s]
+echo "fetch ${pkg.repoo}"
+end`,
+			ExitCode: 1,
+			Stderr:   "Did you mean 'pkg.repo'?",
+		},
+		{
+			Name: "unknown data block",
+			Script: `[data pkg]
+  repo github.com/x/y
+end
+
+[main -s]
+echo "fetch ${pgk.repo}"
+end`,
+			ExitCode: 1,
+			Stderr:   "undefined data block: pgk",
+		},
+		{
+			Name: "function modifier ends with the call",
+			Script: `[fn -s check]
+echo "check ${name:-none}"
+end
+
+[main]
+check
+echo "after $missing|"
+end`,
+			ExitCode: 0,
+			Stdout: `check none
+after |`,
+		},
+		{
+			Name: "strict off",
+			Script: `[main -s]
+strict off
+echo "value: $missing|"
+end`,
+			ExitCode: 0,
+			Stdout:   "value: |",
+		},
+		{
+			Name: "conditions still test for unset variables",
+			Script: `[main]
+strict
+if $missing
+echo set
+else
+echo unset
+end
+end`,
+			ExitCode: 0,
+			Stdout:   "unset",
+		},
+		{
+			Name:       "command line flag",
+			Subcommand: []string{"--strict"},
+			Script: `[main]
+echo "home: $hmoe"
+end`,
+			ExitCode: 1,
+			Stderr:   "undefined variable: hmoe",
+		},
+		{
+			Name: "invalid argument",
+			Script: `[main]
+strict maybe
+end`,
+			ExitCode: 1,
+			Stderr:   "strict: expected on or off",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			test.RunBoxTest(t, tt)
+		})
+	}
+}
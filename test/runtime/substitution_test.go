@@ -0,0 +1,91 @@
+package runtime
+
+import (
+	"box/test"
+	"testing"
+)
+
+func TestResultValues(t *testing.T) {
+	tests := []test.TestCase{
+		{
+			Name: "verb result as a value",
+			Script: `[main]
+set xs a b c
+set n $(len ${xs[*]})
+echo "n=$n"
+end`,
+			ExitCode: 0,
+			Stdout:   "n=3",
+		},
+		{
+			Name: "list result keeps its elements",
+			Script: `[main]
+set vars $(env)
+set n $(len ${vars[*]})
+if test $n -gt 1
+echo many
+end
+end`,
+			ExitCode: 0,
+			Stdout:   "many",
+		},
+		{
+			Name: "compatibility variables are still set",
+			Script: `[main]
+arith 2 + 3
+echo $_arith_result
+echo $(arith 4 * 5)
+end`,
+			ExitCode: 0,
+			Stdout: `5
+20`,
+		},
+		{
+			Name: "function result",
+			Script: `[fn swap a b]
+echo ignored
+result $b $a
+end
+
+[main]
+set pair $(swap x y)
+echo "${pair[*]}"
+echo ${pair[1]}
+end`,
+			ExitCode: 0,
+			Stdout: `y x
+x`,
+		},
+		{
+			Name: "output without a result value",
+			Script: `[fn greet]
+echo hello
+end
+
+[main]
+set out $(greet)
+echo "got $out"
+end`,
+			ExitCode: 0,
+			Stdout:   "got hello",
+		},
+		{
+			Name: "mktemp path",
+			Script: `[main]
+set tmp $(mktemp)
+if exists $tmp
+echo created
+end
+delete $tmp
+end`,
+			ExitCode: 0,
+			Stdout:   "created",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.Name, func(t *testing.T) {
+			test.RunBoxTest(t, testCase)
+		})
+	}
+}
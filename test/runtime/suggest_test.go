@@ -0,0 +1,108 @@
+package runtime
+
+import (
+	"box/test"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSuggestions(t *testing.T) {
+	// A PATH holding only a gcc and a git stub, so the suggestions do not
+	// depend on what the machine has installed
+	bin := t.TempDir()
+	for _, name := range []string{"gcc", "git"} {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte("#!/bin/sh\n"), 0755); err != nil {
+			t.Fatalf("Failed to write %s stub: %v", name, err)
+		}
+	}
+
+	tests := []test.TestCase{
+		{
+			Name: "misspelled builtin",
+			Script: `[main]
+ech hi
+end`,
+			ExitCode: 1,
+			Stderr:   "Did you mean 'echo'?",
+		},
+		{
+			Name: "misspelled function",
+			Script: `[fn compile]
+echo compiling
+end
+
+[main]
+compil
+end`,
+			ExitCode: 1,
+			Stderr:   "Did you mean 'compile'?",
+		},
+		{
+			Name: "misspelled namespaced function",
+			Script: `import testdata/located_util
+[main]
+located_util.fial
+end`,
+			ExitCode: 1,
+			Stderr:   "Did you mean 'located_util.fail'?",
+		},
+		{
+			Name: "misspelled namespace",
+			Script: `import testdata/located_util
+[main]
+located_utl.fail
+end`,
+			ExitCode: 1,
+			Stderr:   "Did you mean 'located_util.fail'?",
+		},
+		{
+			Name: "unrelated name falls back to run",
+			Script: `[main]
+zzqxv
+end`,
+			ExitCode: 1,
+			Stderr:   "Use 'run zzqxv' for external programs.",
+		},
+		{
+			Name: "missing program",
+			Script: `[main]
+run zzqxv-missing
+end`,
+			ExitCode: 1,
+			Stderr:   "run: command 'zzqxv-missing' not found in PATH",
+		},
+		{
+			Name: "missing program suggests the program it extends",
+			Script: `[main]
+env PATH "` + bin + `"
+run gcc-missing -o app main.c
+end`,
+			ExitCode: 1,
+			Stderr:   "Help: Did you mean 'gcc'?",
+		},
+		{
+			Name: "transposed program name",
+			Script: `[main]
+env PATH "` + bin + `"
+run gti status
+end`,
+			ExitCode: 1,
+			Stderr:   "Help: Did you mean 'git'?",
+		},
+		{
+			Name: "transposed builtin",
+			Script: `[main]
+ehco hi
+end`,
+			ExitCode: 1,
+			Stderr:   "Did you mean 'echo'?",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			test.RunBoxTest(t, tc)
+		})
+	}
+}